@@ -0,0 +1,477 @@
+// Copyright (c) 2013 Beijing CmsTop Technology Co.,Ltd. (http://www.cmstop.com)
+
+/*
+Package client provides SFSS client.
+It handles the SFSS protocol framing, AES envelope and OrderData,
+and multiplexes concurrent calls over one persistent connection.
+*/
+package client
+
+import (
+	"crypto/aes"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net"
+	"sfss/util"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	DEF_TIMEOUT = 60 * time.Second // 默认请求超时时间
+)
+
+var (
+	ErrClosed  = errors.New("sfss client closed")     // 客户端已关闭
+	ErrTimeout = errors.New("sfss request timed out") // 请求超时
+)
+
+// 服务器返回的错误
+type Error struct {
+	Method  string             // 业务方法
+	Code    int                // 状态码，见util.CODE_VALIDATION等
+	Message string             // 错误信息
+	Details *util.ErrorDetails // 错误详情，可以为nil
+}
+
+func (e *Error) Error() string {
+	return "sfss " + e.Method + " error " + strconv.Itoa(e.Code) + ": " + e.Message
+}
+
+// 客户端配置
+type Config struct {
+	Network  string        // 网络类型，tcp或unix，默认tcp
+	Addr     string        // 服务地址，如127.0.0.1:9467，unix时为socket路径
+	Serverid int           // 控制端编号
+	IV       []byte        // AES-CBC加密向量，协议版本3及以下使用
+	Key      []byte        // 加密密钥，协议版本4时为Keyid对应的密钥
+	Keyid    string        // AES-GCM密钥编号，为空时使用服务器的默认密钥
+	Version  int           // 协议版本，默认util.PROTOCOL_V4
+	TLS      *tls.Config   // TLS配置，为nil时不使用TLS
+	Timeout  time.Duration // 请求超时时间，默认60秒
+}
+
+// 客户端
+type Client struct {
+	conf    Config
+	lock    sync.Mutex              // 连接和等待响应的请求锁
+	wlock   sync.Mutex              // 写锁
+	conn    net.Conn                // 当前连接，断开后下次请求时重新连接
+	id      uint32                  // 上一个请求编号
+	pending map[uint32]chan *result // 等待响应的请求
+	closed  bool                    // 是否已关闭
+}
+
+// 请求结果
+type result struct {
+	data []byte
+	err  error
+}
+
+// 连接服务器
+func Dial(conf Config) (*Client, error) {
+	if conf.Network == "" {
+		conf.Network = "tcp"
+	}
+	if conf.Version == 0 {
+		conf.Version = util.PROTOCOL_V4
+	}
+	if conf.Network == "unix" {
+		conf.Version = util.PROTOCOL_V2 // 本地管理接口不加密
+	}
+	if conf.Timeout <= 0 {
+		conf.Timeout = DEF_TIMEOUT
+	}
+	if conf.Network != "unix" && conf.Version < util.PROTOCOL_V4 && len(conf.IV) != aes.BlockSize {
+		return nil, errors.New("sfss client IV should be " + strconv.Itoa(aes.BlockSize) + " bytes for AES-CBC")
+	}
+	c := new(Client)
+	c.conf = conf
+	c.pending = make(map[uint32]chan *result)
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if _, err := c.connect(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// 关闭客户端
+func (c *Client) Close() error {
+	c.lock.Lock()
+	c.closed = true
+	conn := c.conn
+	c.lock.Unlock()
+	if conn != nil {
+		c.drop(conn, ErrClosed)
+	}
+	return nil
+}
+
+// 调用业务方法，返回服务器的响应消息
+// data为旧版的字符串数据，服务器按方法的参数类型转换；需要列表等类型时使用Do
+func (c *Client) Call(method string, data map[string]string) (string, error) {
+	send, err := c.Do(&util.OrderData{Method: method, Data: toData(data)})
+	if err != nil {
+		return "", err
+	}
+	return send.Message, nil
+}
+
+// 发送业务数据，返回完整的响应
+// 服务器返回失败时同时返回响应和*Error
+func (c *Client) Do(order *util.OrderData) (*util.SendData, error) {
+	payload, err := c.call(order)
+	if err != nil {
+		return nil, err
+	}
+	send := new(util.SendData)
+	err = json.Unmarshal(payload, send)
+	if err != nil {
+		return nil, errors.New("SendData json decode Error: " + err.Error())
+	}
+	if send.Code != util.CODE_OK {
+		return send, &Error{Method: order.Method, Code: send.Code, Message: send.Message, Details: send.Details}
+	}
+	return send, nil
+}
+
+// 带幂等键调用业务方法，超时或断线后使用同一个key重试不会重复执行
+// key可以使用NewIdempotencyKey生成
+func (c *Client) CallIdempotent(method, key string, data map[string]string) (string, error) {
+	send, err := c.Do(&util.OrderData{Method: method, Data: toData(data), IdempotencyKey: key})
+	if err != nil {
+		return "", err
+	}
+	return send.Message, nil
+}
+
+// 作为异步任务调用业务方法，返回提交的任务
+func (c *Client) CallAsync(method string, data map[string]string) (*util.JobData, error) {
+	send, err := c.Do(&util.OrderData{Method: method, Data: toData(data), Async: true})
+	if err != nil {
+		return nil, err
+	}
+	return send.Job, nil
+}
+
+// 查询异步任务状态和结果
+func (c *Client) JobStatus(id string) (*util.JobData, error) {
+	send, err := c.Do(&util.OrderData{Method: "job_status", Data: map[string]interface{}{"id": id}})
+	if err != nil {
+		return nil, err
+	}
+	return send.Job, nil
+}
+
+// 列出异步任务，status为空时列出全部
+func (c *Client) JobList(status string) ([]util.JobData, error) {
+	send, err := c.Do(&util.OrderData{Method: "job_list", Data: map[string]interface{}{"status": status}})
+	if err != nil {
+		return nil, err
+	}
+	return send.Jobs, nil
+}
+
+// 取消异步任务
+func (c *Client) JobCancel(id string) (*util.JobData, error) {
+	send, err := c.Do(&util.OrderData{Method: "job_cancel", Data: map[string]interface{}{"id": id}})
+	if err != nil {
+		return nil, err
+	}
+	return send.Job, nil
+}
+
+// 查询审计记录，query为查询条件，可用domain、name、method、since、until和limit
+func (c *Client) AuditQuery(query map[string]string) ([]util.AuditData, error) {
+	send, err := c.Do(&util.OrderData{Method: "audit_query", Data: toData(query)})
+	if err != nil {
+		return nil, err
+	}
+	return send.Audit, nil
+}
+
+// 测试连接，返回服务器类型和支持的方法
+func (c *Client) InitTest() (*util.InitTestData, error) {
+	payload, err := c.call(&util.OrderData{Method: "init_test"})
+	if err != nil {
+		return nil, err
+	}
+	send := new(util.InitTestData)
+	err = json.Unmarshal(payload, send)
+	if err != nil {
+		return nil, errors.New("InitTestData json decode Error: " + err.Error())
+	}
+	if send.Code != util.CODE_OK {
+		return nil, &Error{Method: "init_test", Code: send.Code, Message: send.Message}
+	}
+	return send, nil
+}
+
+// 批量操作，任意一步失败时服务器撤销已执行的步骤
+// 返回每一步的执行结果，失败时error为*Error
+func (c *Client) Batch(orders []util.OrderData) ([]util.StepResult, error) {
+	send, err := c.Do(&util.OrderData{Method: "batch", Orders: orders})
+	if send == nil {
+		return nil, err
+	}
+	return send.Steps, err
+}
+
+// 创建站点
+func (c *Client) SiteCreate(data map[string]string) (string, error) {
+	return c.Call("site_create", data)
+}
+
+// 更新站点
+func (c *Client) SiteUpdate(data map[string]string) (string, error) {
+	return c.Call("site_update", data)
+}
+
+// 暂停站点
+func (c *Client) SitePause(domain string) (string, error) {
+	return c.Call("site_pause", map[string]string{"domain": domain})
+}
+
+// 开启站点
+func (c *Client) SiteStart(domain string) (string, error) {
+	return c.Call("site_start", map[string]string{"domain": domain})
+}
+
+// 删除站点
+func (c *Client) SiteDelete(domain, root string) (string, error) {
+	return c.Call("site_delete", map[string]string{"domain": domain, "root": root})
+}
+
+// 创建数据库
+func (c *Client) DbCreate(data map[string]string) (string, error) {
+	return c.Call("db_create", data)
+}
+
+// 更新数据库
+func (c *Client) DbUpdate(data map[string]string) (string, error) {
+	return c.Call("db_update", data)
+}
+
+// 暂停数据库
+func (c *Client) DbPause(user string) (string, error) {
+	return c.Call("db_pause", map[string]string{"user": user})
+}
+
+// 开启数据库
+func (c *Client) DbStart(user, password string) (string, error) {
+	return c.Call("db_start", map[string]string{"user": user, "password": password})
+}
+
+// 删除数据库
+func (c *Client) DbDelete(name, user string) (string, error) {
+	return c.Call("db_delete", map[string]string{"name": name, "user": user})
+}
+
+// 发送请求并等待响应，返回解密后的响应数据
+func (c *Client) call(order *util.OrderData) ([]byte, error) {
+	nonce, err := newNonce()
+	if err != nil {
+		return nil, err
+	}
+	order.Time = time.Now().Unix()
+	order.Nonce = nonce
+	payload, err := json.Marshal(order)
+	if err != nil {
+		return nil, err
+	}
+	receive := new(util.ReceiveData)
+	receive.Serverid = c.conf.Serverid
+	receive.Keepalive = true
+	receive.Version = c.conf.Version
+	receive.Keyid = c.conf.Keyid
+	err = c.seal(payload, receive)
+	if err != nil {
+		return nil, err
+	}
+
+	// 分配请求编号并登记
+	ch := make(chan *result, 1)
+	c.lock.Lock()
+	conn, err := c.connect()
+	if err != nil {
+		c.lock.Unlock()
+		return nil, err
+	}
+	c.id++
+	if c.id == 0 {
+		c.id++ // 0表示没有编号
+	}
+	receive.Id = c.id
+	c.pending[receive.Id] = ch
+	c.lock.Unlock()
+
+	frame, err := json.Marshal(receive)
+	if err == nil {
+		c.wlock.Lock()
+		err = util.ConnWrite(conn, frame)
+		c.wlock.Unlock()
+	}
+	if err != nil {
+		c.drop(conn, err)
+		return nil, err
+	}
+	select {
+	case r := <-ch:
+		return r.data, r.err
+	case <-time.After(c.conf.Timeout):
+		c.lock.Lock()
+		delete(c.pending, receive.Id)
+		c.lock.Unlock()
+		return nil, ErrTimeout
+	}
+}
+
+// 建立连接，调用时需持有c.lock
+func (c *Client) connect() (net.Conn, error) {
+	if c.closed {
+		return nil, ErrClosed
+	}
+	if c.conn != nil {
+		return c.conn, nil
+	}
+	var conn net.Conn
+	var err error
+	dialer := &net.Dialer{Timeout: c.conf.Timeout}
+	if c.conf.TLS != nil {
+		conn, err = tls.DialWithDialer(dialer, c.conf.Network, c.conf.Addr, c.conf.TLS)
+	} else {
+		conn, err = dialer.Dial(c.conf.Network, c.conf.Addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	c.conn = conn
+	go c.reader(conn)
+	return conn, nil
+}
+
+// 断开连接，所有等待响应的请求返回err
+func (c *Client) drop(conn net.Conn, err error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.conn != conn {
+		return
+	}
+	c.conn = nil
+	conn.Close()
+	for id, ch := range c.pending {
+		ch <- &result{err: err}
+		delete(c.pending, id)
+	}
+}
+
+// 读取响应并按请求编号分发
+func (c *Client) reader(conn net.Conn) {
+	for {
+		data, err := util.ConnRead(conn, 0)
+		if err != nil {
+			c.drop(conn, err)
+			return
+		}
+		id, payload, err := c.open(data)
+		c.lock.Lock()
+		ch, ok := c.pending[id]
+		delete(c.pending, id)
+		c.lock.Unlock()
+		if ok {
+			ch <- &result{data: payload, err: err}
+		}
+	}
+}
+
+// 加密请求数据
+func (c *Client) seal(payload []byte, receive *util.ReceiveData) error {
+	switch {
+	case receive.Version >= util.PROTOCOL_V4:
+		data, nonce, err := util.GcmEncrypt(payload, c.conf.Key)
+		if err != nil {
+			return err
+		}
+		receive.Data = string(data)
+		receive.Nonce = string(nonce)
+	case c.conf.Network == "unix":
+		receive.Data = string(payload)
+	default:
+		data, err := util.AesEncrypt(payload, c.conf.IV, c.conf.Key)
+		if err != nil {
+			return err
+		}
+		receive.Data = string(data)
+	}
+	return nil
+}
+
+// 解析响应，加密的响应解密后返回
+// 协议版本3及以上的请求只接受加密的响应，协议版本4的请求只接受AES-GCM加密的响应，
+// 避免没有TLS时中间人伪造明文响应或降级到不校验完整性的AES-CBC
+func (c *Client) open(data []byte) (uint32, []byte, error) {
+	frame := new(struct {
+		Id      uint32          `json:"id"`
+		Code    *int            `json:"code"`
+		Version int             `json:"version"`
+		Nonce   string          `json:"nonce"`
+		Data    json.RawMessage `json:"data"`
+	})
+	err := json.Unmarshal(data, frame)
+	if err != nil {
+		return 0, nil, errors.New("response json decode Error: " + err.Error())
+	}
+	// 明文响应
+	if frame.Code != nil || len(frame.Data) == 0 || frame.Data[0] != '"' {
+		if c.conf.Version >= util.PROTOCOL_V3 {
+			return frame.Id, nil, errors.New("response is not encrypted, rejected")
+		}
+		return frame.Id, data, nil
+	}
+	if c.conf.Version >= util.PROTOCOL_V4 && frame.Version < util.PROTOCOL_V4 {
+		return frame.Id, nil, errors.New("response is not AES-GCM encrypted, rejected")
+	}
+	var crypted string
+	json.Unmarshal(frame.Data, &crypted)
+	if frame.Version >= util.PROTOCOL_V4 {
+		data, err = util.GcmDecrypt([]byte(crypted), []byte(frame.Nonce), c.conf.Key)
+	} else {
+		data, err = util.AesDecrypt([]byte(crypted), c.conf.IV, c.conf.Key)
+	}
+	if err != nil {
+		return frame.Id, nil, errors.New("response decrypt Error: " + err.Error())
+	}
+	return frame.Id, data, nil
+}
+
+// 将字符串map转换为业务数据
+func toData(data map[string]string) map[string]interface{} {
+	if data == nil {
+		return nil
+	}
+	m := make(map[string]interface{}, len(data))
+	for k, v := range data {
+		m[k] = v
+	}
+	return m
+}
+
+// 生成幂等键
+func NewIdempotencyKey() (string, error) {
+	return newNonce()
+}
+
+// 生成请求的唯一随机字符串，用于重放检测
+func newNonce() (string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,82 @@
+// Copyright (c) 2013 Beijing CmsTop Technology Co.,Ltd. (http://www.cmstop.com)
+
+package client
+
+import (
+	"encoding/json"
+	"net"
+	"sfss/util"
+	"testing"
+	"time"
+)
+
+var key = []byte("1234567890123456")
+
+// 模拟服务器：解密请求，使用AES-GCM加密响应业务方法名称
+func testServer(t *testing.T, l net.Listener) {
+	conn, err := l.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	for {
+		data, err := util.ConnRead(conn, time.Second)
+		if err != nil {
+			return
+		}
+		receive := new(util.ReceiveData)
+		json.Unmarshal(data, receive)
+		data, err = util.GcmDecrypt([]byte(receive.Data), []byte(receive.Nonce), key)
+		if err != nil {
+			t.Error("server decrypt failed: ", err.Error())
+			return
+		}
+		order := new(util.OrderData)
+		json.Unmarshal(data, order)
+		send := &util.SendData{Id: receive.Id, Message: order.Method}
+		if order.Method == "db_delete" {
+			send.Code = util.CODE_AUTH
+		}
+		data, _ = json.Marshal(send)
+		if order.Method == "site_start" {
+			// 伪造的明文响应
+			util.ConnWrite(conn, data)
+			continue
+		}
+		sealed, nonce, _ := util.GcmEncrypt(data, key)
+		envelope := &util.ReceiveData{Id: receive.Id, Version: receive.Version, Data: string(sealed), Nonce: string(nonce)}
+		data, _ = json.Marshal(envelope)
+		util.ConnWrite(conn, data)
+	}
+}
+
+func TestCall1(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go testServer(t, l)
+
+	c, err := Dial(Config{Addr: l.Addr().String(), Key: key, Timeout: time.Second})
+	if err != nil {
+		t.Fatal("Dial failed: ", err.Error())
+	}
+	defer c.Close()
+	msg, err := c.SitePause("a.9466.cn")
+	if err != nil || msg != "site_pause" {
+		t.Error("call site_pause failed: ", msg, err)
+	}
+	_, err = c.DbDelete("a", "a")
+	if e, ok := err.(*Error); !ok || e.Code != util.CODE_AUTH {
+		t.Error("db_delete should return auth error: ", err)
+	}
+	_, err = c.SiteStart("a.9466.cn")
+	if err == nil {
+		t.Error("unencrypted response should be rejected")
+	}
+	_, err = Dial(Config{Addr: l.Addr().String(), Key: key, IV: []byte("short"), Version: util.PROTOCOL_V3})
+	if err == nil {
+		t.Error("short IV should be rejected for AES-CBC")
+	}
+}
@@ -0,0 +1,349 @@
+// Copyright (c) 2013 Beijing CmsTop Technology Co.,Ltd. (http://www.cmstop.com)
+
+/*
+Command nfssctl is the SFSS admin client.
+
+	nfssctl [flags] <method> [field=value ...]
+
+For example:
+
+	nfssctl init_test
+	nfssctl site_create siteid=1 domain=a.9466.cn root=a.9466.cn connections=100 bandwidth=1024
+	nfssctl -json db_pause user=a
+	nfssctl -async site_create siteid=1 domain=a.9466.cn root=a.9466.cn connections=100 bandwidth=1024
+	nfssctl job_status id=4f2a9c0d1e3b5a77
+	nfssctl job_list status=running limit=50 offset=50
+	nfssctl audit_query domain=a.9466.cn since=1700000000 limit=20
+	nfssctl -orders orders.json batch
+
+The batch orders file is a JSON array of orders, "-" reads it from stdin:
+
+	[{"method": "db_create", "data": {"name": "a", "user": "a", "password": "123456"}},
+	 {"method": "site_create", "data": {"siteid": 1, "domain": "a.9466.cn", "root": "a.9466.cn", "connections": 100, "bandwidth": 1024}}]
+
+Keys and address are read from sfss.conf the same way as the server does,
+including NFSS_* environment overrides and file: secret references,
+and can be overridden by flags.
+If the admin socket is configured and no address is given, it is used first.
+*/
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/9466/goconfig"
+	"io/ioutil"
+	"os"
+	"sfss/client"
+	"sfss/util"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+var (
+	configFile = flag.String("config", "", "SFSS config file, default <binary dir>/conf/sfss.conf")
+	addr       = flag.String("addr", "", "server address host:port, default [server] listen:port")
+	socket     = flag.String("unix", "", "admin unix socket, default [admin] socket")
+	serverid   = flag.Int("serverid", 0, "controller serverid")
+	iv         = flag.String("iv", "", "AES-CBC iv, default [server] serverIV")
+	key        = flag.String("key", "", "AES key, default [server] serverKEY or [keys] keyid")
+	keyid      = flag.String("keyid", "", "AES-GCM keyid")
+	version    = flag.Int("version", util.PROTOCOL_V4, "protocol version")
+	useTLS     = flag.Bool("tls", false, "use TLS")
+	caFile     = flag.String("ca", "", "TLS server CA file")
+	certFile   = flag.String("cert", "", "TLS client certificate file")
+	keyFile    = flag.String("certkey", "", "TLS client certificate key file")
+	timeout    = flag.Duration("timeout", client.DEF_TIMEOUT, "request timeout")
+	jsonOut    = flag.Bool("json", false, "output JSON")
+	async      = flag.Bool("async", false, "run as asynchronous job, print the job id")
+	idemKey    = flag.String("idempotency-key", "", "idempotency key, retry with the same key returns the first result")
+	ordersFile = flag.String("orders", "", "batch orders JSON file, - for stdin")
+)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: nfssctl [flags] <method> [field=value ...]")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() < 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	method := flag.Arg(0)
+	data := make(map[string]interface{})
+	for _, arg := range flag.Args()[1:] {
+		kv := strings.SplitN(arg, "=", 2)
+		if len(kv) != 2 {
+			fatal("bad argument " + arg + ", should be field=value")
+		}
+		data[kv[0]] = kv[1]
+	}
+	orders, err := readOrders(method)
+	if err != nil {
+		fatal(err.Error())
+	}
+
+	conf, err := clientConfig()
+	if err != nil {
+		fatal(err.Error())
+	}
+	c, err := client.Dial(conf)
+	if err != nil {
+		fatal("Dial Error: " + err.Error())
+	}
+	defer c.Close()
+
+	if method == "init_test" {
+		send, err := c.InitTest()
+		if err != nil {
+			fatal(err.Error())
+		}
+		printInitTest(send)
+		return
+	}
+	send, err := c.Do(&util.OrderData{Method: method, Data: data, Orders: orders, Async: *async, IdempotencyKey: *idemKey})
+	if send == nil {
+		fatal(err.Error())
+	}
+	printResult(send)
+	if err != nil {
+		os.Exit(1)
+	}
+}
+
+// 读取批量操作的子操作，只有batch方法需要
+func readOrders(method string) ([]util.OrderData, error) {
+	if method != "batch" {
+		if *ordersFile != "" {
+			return nil, errors.New("-orders is only used by batch")
+		}
+		return nil, nil
+	}
+	if *ordersFile == "" {
+		return nil, errors.New("batch requires -orders file")
+	}
+	var data []byte
+	var err error
+	if *ordersFile == "-" {
+		data, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		data, err = ioutil.ReadFile(*ordersFile)
+	}
+	if err != nil {
+		return nil, errors.New("read orders Error: " + err.Error())
+	}
+	orders := make([]util.OrderData, 0)
+	err = json.Unmarshal(data, &orders)
+	if err != nil {
+		return nil, errors.New("orders json decode Error: " + err.Error())
+	}
+	return orders, nil
+}
+
+// 根据配置文件和命令行参数生成客户端配置
+func clientConfig() (client.Config, error) {
+	var conf client.Config
+	file := *configFile
+	if file == "" {
+		dir, err := util.GetDir()
+		if err != nil {
+			return conf, err
+		}
+		file = dir + "/conf/sfss.conf"
+	}
+	// 与服务器相同的规则读取配置：合并NFSS_*环境变量，读取file:开头的密钥文件
+	// 配置文件不存在时只使用命令行参数
+	sfssConf := goconfig.NewConfigFile()
+	if ok, _ := util.IsExist(file); ok {
+		c, err := util.LoadConfig(file, os.Environ(), nil)
+		if err != nil {
+			return conf, err
+		}
+		sfssConf = c
+	}
+	get := func(flagValue, section, option string) string {
+		if flagValue != "" {
+			return flagValue
+		}
+		v, _ := sfssConf.GetString(section, option)
+		return v
+	}
+
+	conf.Serverid = *serverid
+	conf.Version = *version
+	conf.Timeout = *timeout
+	conf.Keyid = *keyid
+	conf.IV = []byte(get(*iv, "server", "serverIV"))
+	if *keyid != "" {
+		conf.Key = []byte(get(*key, "keys", *keyid))
+	} else {
+		conf.Key = []byte(get(*key, "server", "serverKEY"))
+	}
+
+	// 优先使用本地管理接口
+	sock := get(*socket, "admin", "socket")
+	if *addr == "" && sock != "" {
+		if ok, _ := util.IsExist(sock); ok {
+			conf.Network = "unix"
+			conf.Addr = sock
+			return conf, nil
+		}
+	}
+	conf.Network = "tcp"
+	conf.Addr = *addr
+	if conf.Addr == "" {
+		host := get("", "server", "listen")
+		if host == "" || host == "0.0.0.0" {
+			host = "127.0.0.1"
+		}
+		port := get("", "server", "port")
+		if port == "" {
+			port = "9467"
+		}
+		conf.Addr = host + ":" + port
+	}
+	if *useTLS {
+		conf.TLS = new(tls.Config)
+		if *caFile != "" {
+			pem, err := ioutil.ReadFile(*caFile)
+			if err != nil {
+				return conf, err
+			}
+			conf.TLS.RootCAs = x509.NewCertPool()
+			conf.TLS.RootCAs.AppendCertsFromPEM(pem)
+		}
+		if *certFile != "" {
+			cert, err := tls.LoadX509KeyPair(*certFile, *keyFile)
+			if err != nil {
+				return conf, err
+			}
+			conf.TLS.Certificates = []tls.Certificate{cert}
+		}
+	}
+	return conf, nil
+}
+
+// 输出方法执行结果
+func printResult(send *util.SendData) {
+	if *jsonOut {
+		printJSON(send)
+		return
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "CODE\tMESSAGE")
+	fmt.Fprintf(w, "%d\t%s\n", send.Code, send.Message)
+	w.Flush()
+	printDetails(send.Details)
+	if send.Reload != nil {
+		fmt.Println("  applied: " + strings.Join(send.Reload.Applied, " "))
+		fmt.Println("  restart required: " + strings.Join(send.Reload.Restart, " "))
+	}
+	if len(send.Steps) > 0 {
+		fmt.Println()
+		w = tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "STEP\tMETHOD\tCODE\tMESSAGE\tROLLBACK")
+		for i, step := range send.Steps {
+			fmt.Fprintf(w, "%d\t%s\t%d\t%s\t%s\n", i+1, step.Method, step.Code, step.Message, step.Rollback)
+		}
+		w.Flush()
+	}
+	jobs := send.Jobs
+	if send.Job != nil {
+		jobs = append(jobs, *send.Job)
+	}
+	if len(jobs) > 0 || send.Jobs != nil {
+		fmt.Println()
+		w = tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "JOB\tOWNER\tMETHOD\tSTATUS\tPROGRESS\tCREATED\tFINISHED\tRESULT")
+		for _, job := range jobs {
+			result := job.Message
+			if job.Result != nil {
+				result = job.Result.Message
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d%%\t%s\t%s\t%s\n", job.Id, job.Owner, job.Method, job.Status, job.Progress,
+				formatTime(job.Created), formatTime(job.Finished), result)
+		}
+		w.Flush()
+	}
+	if len(send.Audit) > 0 {
+		fmt.Println()
+		w = tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "TIME\tCONTROLLER\tREMOTE\tMETHOD\tDATA\tCODE\tMESSAGE\tDURATION")
+		for _, a := range send.Audit {
+			data, _ := json.Marshal(a.Data)
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%d\t%s\t%dms\n", formatTime(a.Time), a.Controller, a.Remote, a.Method,
+				data, a.Code, a.Message, a.Duration)
+		}
+		w.Flush()
+	}
+}
+
+// 输出错误详情
+func printDetails(d *util.ErrorDetails) {
+	if d == nil {
+		return
+	}
+	for _, f := range d.Fields {
+		fmt.Println("  " + f.Field + ": " + f.Message)
+	}
+	if d.Cause != "" {
+		fmt.Println("  cause: " + d.Cause)
+	}
+	if d.Output != "" {
+		fmt.Println("  output:")
+		for _, line := range strings.Split(d.Output, "\n") {
+			fmt.Println("    " + line)
+		}
+	}
+}
+
+// 格式化unix时间戳，0时输出-
+func formatTime(t int64) string {
+	if t == 0 {
+		return "-"
+	}
+	return time.Unix(t, 0).Format("2006-01-02 15:04:05")
+}
+
+// 输出测试接口结果
+func printInitTest(send *util.InitTestData) {
+	if *jsonOut {
+		printJSON(send)
+		return
+	}
+	roles := make([]string, 0)
+	list, _ := send.Data["roles"].([]interface{})
+	for _, r := range list {
+		roles = append(roles, fmt.Sprint(r))
+	}
+	fmt.Printf("serverType: %v, roles: %s\n\n", send.Data["serverType"], strings.Join(roles, " "))
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "METHOD\tFIELDS\tDESC")
+	methods, _ := send.Data["methods"].([]interface{})
+	for _, v := range methods {
+		m, _ := v.(map[string]interface{})
+		fields := make([]string, 0)
+		list, _ := m["fields"].([]interface{})
+		for _, f := range list {
+			fields = append(fields, fmt.Sprint(f))
+		}
+		fmt.Fprintf(w, "%v\t%s\t%v\n", m["name"], strings.Join(fields, ","), m["desc"])
+	}
+	w.Flush()
+}
+
+func printJSON(v interface{}) {
+	data, _ := json.MarshalIndent(v, "", "  ")
+	fmt.Println(string(data))
+}
+
+func fatal(msg string) {
+	fmt.Fprintln(os.Stderr, "nfssctl: "+msg)
+	os.Exit(1)
+}
@@ -9,13 +9,14 @@ protocol details in wiki http://wiki.9466.dev/
 package main
 
 import (
+	"flag"
 	"fmt"
-	"github.com/9466/goconfig"
 	"log"
 	"os"
 	"os/signal"
 	"sfss/server"
 	"sfss/util"
+	"strings"
 	"syscall"
 	"time"
 )
@@ -24,41 +25,74 @@ const (
 	PROCESS_NUM = 1 // 系统当前会启动的进程数，目前只有2个，分别是server和monitor
 )
 
+// 命令行中的配置覆盖，-set可以重复使用
+type setFlags []string
+
+func (f *setFlags) String() string {
+	return strings.Join(*f, " ")
+}
+
+func (f *setFlags) Set(v string) error {
+	_, _, _, err := util.ParseConfigSet(v)
+	if err != nil {
+		return err
+	}
+	*f = append(*f, v)
+	return nil
+}
+
 func main() {
-	// 初始化配置文件
+	var sets setFlags
+	configFile := flag.String("config", "", "配置文件路径，默认为程序目录下的conf/sfss.conf")
+	checkMode := flag.Bool("check", false, "检测配置文件并输出检测报告后退出")
+	dumpMode := flag.Bool("dump", false, "输出合并后的配置（密钥已隐藏）后退出")
+	flag.Var(&sets, "set", "覆盖配置项，格式为section.option=value，可以重复使用")
+	flag.Parse()
+
+	// 初始化配置文件：配置文件、环境变量、命令行参数依次覆盖
 	var err error
 	var dir string
 	dir, err = util.GetDir()
 	if err != nil {
 		log.Fatalln("GetDir Error:", err.Error())
 	}
-	var configFile string = dir + "/conf/sfss.conf"
+	if *configFile == "" {
+		*configFile = dir + "/conf/sfss.conf"
+	}
 	sfss := new(util.SFSS)
-	sfss.ConnNum = 0
-	sfss.Conf, err = goconfig.ReadConfigFile(configFile)
+	sfss.ConfFile = *configFile
+	sfss.ConfSets = sets
+	sfss.Conf, err = util.LoadConfig(sfss.ConfFile, os.Environ(), sfss.ConfSets)
 	if err != nil {
-		log.Fatalln("ReadConfigFile Err: ", err.Error(), "\nConfigFile:", configFile)
+		log.Fatalln("LoadConfig Err: ", err.Error(), "\nConfigFile:", sfss.ConfFile)
+	}
+
+	// 输出合并后的配置
+	if *dumpMode {
+		fmt.Print(util.DumpConfig(sfss.Conf))
+		return
+	}
+
+	// 检测模式：输出检测报告，全部通过时退出码为0
+	if *checkMode {
+		os.Exit(checkReport(sfss))
 	}
 
 	// 初始化日志
-	logFile, err := sfss.Conf.GetString("log", "file")
+	logConf, err := util.LoadLogConfig(sfss.Conf)
 	if err != nil {
 		log.Fatalln("ConfigFile Parse Error.", err.Error())
 	}
-	if logFile[0] != '/' {
-		logFile = dir + "/" + logFile
-	}
-	logFileHandle, err := os.OpenFile(logFile, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0666)
-	defer logFileHandle.Close()
+	sfss.Log, err = util.OpenLog(logConf)
 	if err != nil {
 		log.Fatalln(err.Error())
 	}
-	sfss.Logger = log.New(logFileHandle, "", log.Ldate|log.Ltime|log.Lshortfile)
+	defer sfss.Log.Close()
+	sfss.Logger = sfss.Log.Std()
 
 	// 开始启动服务
 	sfss.Logger.Println("SFSS starting...")
 	sfss.Chs = make(chan int, PROCESS_NUM) // 初始化channel数量
-	sfss.Shutdown = false                  // 默认关闭状态为false
 
 	// 启动一个新的server
 	sfssSever, err := server.NewServer(sfss)
@@ -77,30 +111,39 @@ func main() {
 	// trap signal
 	sch := make(chan os.Signal, 10)
 	signal.Notify(sch, syscall.SIGTERM, syscall.SIGKILL, syscall.SIGINT,
-		syscall.SIGHUP, syscall.SIGSTOP, syscall.SIGQUIT)
+		syscall.SIGHUP, syscall.SIGSTOP, syscall.SIGQUIT, syscall.SIGUSR1, syscall.SIGUSR2)
 	go func(ch <-chan os.Signal) {
-		sig := <-ch
-		sfss.Logger.Println("signal recieved " + sig.String() + ", at: " + time.Now().String())
-		sfss.Shutdown = true
-		sfssSever.Close()
-		if sig == syscall.SIGHUP {
-			sfss.Logger.Println("SFSS restart now...")
-			procAttr := new(os.ProcAttr)
-			procAttr.Files = []*os.File{nil, os.Stdout, os.Stderr}
-			procAttr.Dir = os.Getenv("PWD")
-			procAttr.Env = os.Environ()
-			process, err := os.StartProcess(os.Args[0], os.Args, procAttr)
-			if err != nil {
-				sfss.Logger.Println("SFSS restart process failed:" + err.Error())
-				return
+		for sig := range ch {
+			sfss.Logger.Println("signal recieved " + sig.String() + ", at: " + time.Now().String())
+			if sig == syscall.SIGUSR1 {
+				// 热加载配置，结果已记录日志
+				_, err := sfssSever.Reload()
+				if err != nil {
+					sfss.Logger.Println("SFSS config reload failed: " + err.Error())
+				}
+				continue
 			}
-			waitMsg, err := process.Wait()
-			if err != nil {
-				sfss.Logger.Println("SFSS restart wait error:" + err.Error())
+			if sig == syscall.SIGUSR2 {
+				// 外部切割日志后重新打开日志文件
+				err := sfss.Log.Reopen()
+				if err != nil {
+					fmt.Fprintln(os.Stderr, "SFSS log reopen failed: "+err.Error())
+				}
+				continue
 			}
-			sfss.Logger.Println(waitMsg)
-		} else {
-			sfss.Logger.Println("SFSS shutdown now...")
+			if sig == syscall.SIGHUP {
+				// 平滑重启：新进程使用同一个监听socket开始服务后，当前进程再停止服务，关闭状态文件后交给新进程
+				sfss.Logger.Println("SFSS restart now...")
+				err := sfssSever.Restart()
+				if err != nil {
+					sfss.Logger.Println("SFSS restart failed, serve continue: " + err.Error())
+					continue
+				}
+			} else {
+				sfss.Logger.Println("SFSS shutdown now...")
+			}
+			sfss.Shutdown() // 结束生命周期，server停止接收新连接并等待处理中的请求
+			return
 		}
 	}(sch)
 
@@ -111,7 +154,7 @@ func main() {
 		go func(s *util.SFSS) {
 			tick := time.Tick(time.Second)
 			for now := range tick {
-				fmt.Printf("%v SFSS.ConnNum %d\n", now, s.ConnNum)
+				fmt.Printf("%v SFSS.ConnNum %d\n", now, s.ConnNum())
 			}
 		}(sfss)
 
@@ -121,8 +164,7 @@ func main() {
 			go func(s *util.SFSS) {
 				time.Sleep(time.Duration(debugTime) * time.Second)
 				fmt.Println("timed out")
-				s.Shutdown = true
-				sfssSever.Close()
+				s.Shutdown()
 			}(sfss)
 		}
 	}
@@ -133,3 +175,27 @@ func main() {
 	}
 	sfss.Logger.Println("SFSS stopped.")
 }
+
+// 检测配置文件并输出检测报告，返回进程退出码
+func checkReport(sfss *util.SFSS) int {
+	results := server.Check(sfss)
+	for _, r := range results {
+		if r.Err == nil {
+			fmt.Printf("[ OK ] %s\n", r.Item)
+			continue
+		}
+		fmt.Printf("[FAIL] %s: %s\n", r.Item, r.Err.Error())
+		if e, ok := r.Err.(*util.Error); ok && e.Details != nil && e.Details.Output != "" {
+			for _, line := range strings.Split(e.Details.Output, "\n") {
+				fmt.Println("       " + line)
+			}
+		}
+	}
+	failed := server.CheckFailed(results)
+	if len(failed) > 0 {
+		fmt.Printf("%d of %d checks failed\n", len(failed), len(results))
+		return 1
+	}
+	fmt.Printf("all %d checks passed\n", len(results))
+	return 0
+}
@@ -0,0 +1,107 @@
+// Copyright (c) 2013 Beijing CmsTop Technology Co.,Ltd. (http://www.cmstop.com)
+
+// Provides local admin socket
+/*
+本地管理接口
+在Unix socket上提供与TCP接口相同的业务方法，供本机脚本和管理工具使用。
+请求格式与TCP接口相同，但data字段为未加密的OrderData JSON，
+不需要密钥，也不做重放检测，响应始终使用长度前缀封装的明文SendData。
+socket文件权限为0660，只有root和管理组的用户可以访问。
+*/
+
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/9466/goconfig"
+	"net"
+	"os"
+	"os/user"
+	"sfss/util"
+	"strconv"
+	"syscall"
+)
+
+// 创建本地管理接口监听，未配置socket时返回nil
+func listenAdmin(conf *goconfig.ConfigFile) (net.Listener, error) {
+	socket, _ := conf.GetString("admin", "socket")
+	if socket == "" {
+		return nil, nil
+	}
+	socket, err := util.GetPath(socket)
+	if err != nil {
+		return nil, err
+	}
+	// 平滑重启时使用父进程的socket，权限已经设置
+	listener, err := inheritListener(LISTEN_ADMIN)
+	if listener != nil || err != nil {
+		return listener, err
+	}
+	// 清理上次未正常退出时残留的socket文件
+	if ok, _ := util.IsExist(socket); ok {
+		if c, err := net.Dial("unix", socket); err == nil {
+			c.Close()
+			return nil, errors.New("admin socket " + socket + " is in use")
+		}
+		os.Remove(socket)
+	}
+	// 创建时即限制权限，避免chmod之前被访问
+	mask := syscall.Umask(0117)
+	listener, err = net.Listen("unix", socket)
+	syscall.Umask(mask)
+	if err != nil {
+		return nil, err
+	}
+	err = os.Chmod(socket, 0660)
+	if err != nil {
+		listener.Close()
+		return nil, errors.New("admin socket chmod Error: " + err.Error())
+	}
+	group, _ := conf.GetString("admin", "group")
+	if group != "" {
+		g, err := user.LookupGroup(group)
+		if err != nil {
+			listener.Close()
+			return nil, errors.New("admin group Error: " + err.Error())
+		}
+		gid, _ := strconv.Atoi(g.Gid)
+		err = os.Chown(socket, 0, gid)
+		if err != nil {
+			listener.Close()
+			return nil, errors.New("admin socket chown Error: " + err.Error())
+		}
+	}
+	return listener, nil
+}
+
+// 本地管理接口开始服务
+func (s *Serve) adminAccept() {
+	s.main.Logger.Println("SFSS admin socket begin serve.")
+	for {
+		conn, err := s.admin.Accept()
+		if err != nil {
+			if oerr, ok := err.(*net.OpError); ok && oerr.Err.Error() == "use of closed network connection" {
+				break // listener被关闭，停止服务
+			}
+			s.main.Logger.Println(err.Error())
+			continue
+		}
+		s.main.ConnBegin() // 每启动一个处理，连接数+1
+		go s.clientHandle(conn, true)
+	}
+	s.main.Logger.Println("SFSS admin socket has been shutdown.")
+}
+
+// 解析本地管理接口的请求，data字段为未加密的业务数据
+func (s *Serve) adminOpen(receive *util.ReceiveData, from *origin) (*util.OrderData, int, error) {
+	order := new(util.OrderData)
+	err := json.Unmarshal([]byte(receive.Data), order)
+	if err != nil {
+		err2 := "OrderData json decode Error: " + err.Error()
+		s.main.Logger.Println(err2)
+		return nil, util.CODE_ERROR, errors.New(err2)
+	}
+	s.main.Logger.Println("order " + order.Method + " from " + from.String())
+	return order, util.CODE_OK, nil
+}
@@ -0,0 +1,36 @@
+// Copyright (c) 2013 Beijing CmsTop Technology Co.,Ltd. (http://www.cmstop.com)
+
+package server
+
+import (
+	"encoding/json"
+	"net"
+	"sfss/util"
+	"testing"
+	"time"
+)
+
+func TestAdminInitTest(t *testing.T) {
+	client, conn := net.Pipe()
+	defer client.Close()
+	s := testServe()
+	s.Register(&Method{Name: "empty", Handle: s.empty})
+	go s.clientHandle(conn, true)
+
+	receive := &util.ReceiveData{Data: `{"method":"init_test"}`}
+	data, _ := json.Marshal(receive)
+	if err := util.ConnWrite(client, data); err != nil {
+		t.Fatal("ConnWrite failed: ", err.Error())
+	}
+	data, err := util.ConnRead(client, time.Second)
+	if err != nil {
+		t.Fatal("ConnRead failed: ", err.Error())
+	}
+	send := new(util.InitTestData)
+	if err = json.Unmarshal(data, send); err != nil {
+		t.Fatal("InitTestData decode failed: ", err.Error())
+	}
+	if methods, ok := send.Data["methods"].([]interface{}); !ok || len(methods) != 1 {
+		t.Error("init_test methods error: ", send.Data["methods"])
+	}
+}
@@ -0,0 +1,203 @@
+// Copyright (c) 2013 Beijing CmsTop Technology Co.,Ltd. (http://www.cmstop.com)
+
+// Provides audit trail of control operations
+/*
+审计
+开启[audit]后，除查询方法（Method.Query）外的每个业务请求都记录审计日志，
+包括时间、控制端、来源地址、方法、业务数据、执行结果和耗时，失败的请求同样记录。
+业务数据中名称包含pass、key、secret、token的字段（如password）只记录为******。
+异步任务记录两条：提交时记录提交结果和任务编号，任务结束（完成、失败或取消）时
+记录最终结果和执行耗时，两条记录的任务编号（job）相同。
+被拒绝的请求（控制端认证、解密、重放检测和方法权限检测失败）同样记录，消息以rejected开头，
+无法解密的请求只记录控制端编号和来源地址。
+控制端通过audit_query按站点域名、数据库名称、方法和时间范围查询审计记录，
+只能查询自己的记录；密钥表中明确列出audit_all权限的控制端和本地管理接口可以查询所有记录。
+*/
+
+package server
+
+import (
+	"context"
+	"errors"
+	"sfss/util"
+	"strconv"
+	"time"
+)
+
+const (
+	PERM_AUDIT_ALL = "audit_all" // 查询所有控制端审计记录的权限，需要在控制端的methods中明确列出
+)
+
+// 审计查询参数
+type auditQueryParams struct {
+	Domain string `json:"domain" check:"domain"`      // 站点域名
+	Name   string `json:"name" check:"name"`          // 数据库名称
+	Method string `json:"method" check:"len=1-64"`    // 业务操作类型
+	Since  int64  `json:"since" check:"range=0-"`     // 开始时间，unix时间戳
+	Until  int64  `json:"until" check:"range=0-"`     // 结束时间，unix时间戳
+	Limit  int    `json:"limit" check:"range=0-1000"` // 返回的记录数，默认100
+}
+
+func newAuditQueryParams() interface{} { return new(auditQueryParams) }
+
+// 初始化审计日志
+func (s *Serve) initAudit() (*util.AuditLog, error) {
+	enable, _ := s.main.Conf.GetBool("audit", "enable")
+	if !enable {
+		return nil, nil
+	}
+	file, _ := s.main.Conf.GetString("audit", "file")
+	if file == "" {
+		file = "log/audit.log"
+	}
+	file, err := util.GetPath(file)
+	if err != nil {
+		return nil, err
+	}
+	chain, _ := s.main.Conf.GetBool("audit", "chain")
+	if s.pending != nil {
+		return util.NewPendingAuditLog(file, chain), nil // 父进程交接后打开，见attachState
+	}
+	audit, err := util.NewAuditLog(file, chain)
+	if err != nil {
+		return nil, errors.New("AuditLog init Error: " + err.Error())
+	}
+	return audit, nil
+}
+
+// 记录控制操作的审计日志，start为开始处理请求的时间
+func (s *Serve) auditRecord(c *caller, order *util.OrderData, send *util.SendData, start time.Time) {
+	if s.audit == nil || s.query(order) {
+		return
+	}
+	e := new(util.AuditData)
+	e.Time = start.Unix()
+	e.Controller = c.controller
+	e.Remote = c.remote
+	e.Method = order.Method
+	e.Data = auditOrderData(order)
+	e.Code = send.Code
+	e.Message = send.Message
+	e.Duration = int64(time.Since(start) / time.Millisecond)
+	if send.Job != nil {
+		e.Job = send.Job.Id
+	}
+	s.auditAppend(e)
+}
+
+// 记录异步任务最终结果的审计日志，由任务管理在任务结束时调用
+// start为开始执行的时间，排队时取消或停止服务时未执行的任务耗时为0
+func (s *Serve) auditJob(info *util.JobData, order *util.OrderData, c *caller, start time.Time) {
+	if s.audit == nil {
+		return
+	}
+	e := new(util.AuditData)
+	e.Time = info.Finished
+	e.Controller = c.controller
+	e.Remote = c.remote
+	e.Method = order.Method
+	e.Data = auditOrderData(order)
+	switch {
+	case info.Result != nil:
+		e.Code = info.Result.Code
+		e.Message = "job " + info.Status + ": " + info.Result.Message
+	case info.Status == util.JOB_CANCELED:
+		e.Code = util.CODE_CONFLICT
+		e.Message = "job " + info.Status
+	default:
+		e.Code = util.CODE_UNAVAILABLE
+		e.Message = "job " + info.Status + ": " + info.Message
+	}
+	if !start.IsZero() {
+		e.Duration = int64(time.Since(start) / time.Millisecond)
+	}
+	e.Job = info.Id
+	s.auditAppend(e)
+}
+
+// 写入审计记录，失败时只记录错误日志，不影响业务结果
+func (s *Serve) auditAppend(e *util.AuditData) {
+	err := s.audit.Append(e)
+	if err != nil {
+		s.main.Log.Error("order "+e.Method+" audit Error: "+err.Error(), util.LogFields{"method": e.Method})
+	}
+}
+
+// 记录被拒绝的请求，order为nil表示请求无法解密，method为HTTP接口路径指定的方法
+func (s *Serve) auditReject(receive *util.ReceiveData, from *origin, order *util.OrderData, method string, code int, err error) {
+	if s.audit == nil {
+		return
+	}
+	c := s.newCaller(receive, from)
+	e := new(util.AuditData)
+	e.Time = time.Now().Unix()
+	e.Controller = c.controller
+	e.Remote = c.remote
+	e.Method = method
+	if order != nil {
+		e.Method = order.Method
+		e.Data = auditOrderData(order)
+	}
+	e.Code = code
+	e.Message = "rejected: " + err.Error()
+	s.auditAppend(e)
+}
+
+// 判断是否只读的查询方法
+func (s *Serve) query(order *util.OrderData) bool {
+	m, ok := s.methods.get(order.Method)
+	return ok && m.Query
+}
+
+// 审计记录的业务数据，隐藏密码等字段，批量操作的子操作放在orders中
+func auditOrderData(order *util.OrderData) map[string]interface{} {
+	data := make(map[string]interface{}, len(order.Data)+1)
+	for k, v := range order.Data {
+		if util.IsSecretField(k) {
+			v = util.CONFIG_SECRET_MASK
+		}
+		data[k] = v
+	}
+	if len(order.Orders) > 0 {
+		orders := make([]interface{}, 0, len(order.Orders))
+		for i := range order.Orders {
+			orders = append(orders, map[string]interface{}{
+				"method": order.Orders[i].Method,
+				"data":   auditOrderData(&order.Orders[i]),
+			})
+		}
+		data["orders"] = orders
+	}
+	return data
+}
+
+// audit_query：查询审计记录，控制端只能查询自己的记录
+func (s *Serve) execAuditQuery(ctx context.Context, params interface{}) *util.SendData {
+	if s.audit == nil {
+		return util.ErrorSend(util.NewError(util.CODE_UNSUPPORTED, "audit is not enabled"))
+	}
+	p := params.(*auditQueryParams)
+	c := callerFrom(ctx)
+	q := new(util.AuditQuery)
+	if c.scope != CALLER_ADMIN && !c.auditAll {
+		q.Controller = c.scope // 只能查询自己的记录
+	}
+	q.Domain = p.Domain
+	q.Name = p.Name
+	q.Method = p.Method
+	q.Since = p.Since
+	q.Until = p.Until
+	q.Limit = p.Limit
+	result, more, err := s.audit.Query(q)
+	if err != nil {
+		return util.ErrorSend(util.WrapError(util.CODE_INTERNAL, "audit query Error", err))
+	}
+	send := new(util.SendData)
+	send.Message = "audit query ok"
+	if more && len(result) > 0 {
+		// 响应大小有限制，更早的记录通过until继续查询，时间相同的记录可能重复返回
+		send.Message = "audit query ok, older records omitted, query again with until=" + strconv.FormatInt(result[0].Time, 10)
+	}
+	send.Audit = result
+	return send
+}
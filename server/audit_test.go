@@ -0,0 +1,105 @@
+// Copyright (c) 2013 Beijing CmsTop Technology Co.,Ltd. (http://www.cmstop.com)
+
+package server
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"sfss/util"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAuditOrderData1(t *testing.T) {
+	order := &util.OrderData{Method: "batch", Orders: []util.OrderData{
+		{Method: "db_create", Data: map[string]interface{}{"name": "a", "password": "secret"}},
+	}}
+	data := auditOrderData(order)
+	orders, _ := data["orders"].([]interface{})
+	if len(orders) != 1 {
+		t.Fatal("batch orders should be recorded: ", data)
+	}
+	sub := orders[0].(map[string]interface{})["data"].(map[string]interface{})
+	if sub["password"] != util.CONFIG_SECRET_MASK || sub["name"] != "a" {
+		t.Error("password should be redacted: ", sub)
+	}
+	if order.Orders[0].Data["password"] != "secret" {
+		t.Error("order data should not be modified")
+	}
+}
+
+func TestAuditJob1(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "sfss")
+	defer os.RemoveAll(dir)
+	s := testServe()
+	audit, err := util.NewAuditLog(dir+"/audit.log", false)
+	if err != nil {
+		t.Fatal("NewAuditLog failed: ", err.Error())
+	}
+	defer audit.Close()
+	s.audit = audit
+	order := &util.OrderData{Method: "site_create", Data: map[string]interface{}{"domain": "a.com"}}
+	info := &util.JobData{Id: "j1", Method: "site_create", Status: util.JOB_FAILED, Finished: time.Now().Unix()}
+	info.Result = &util.SendData{Code: util.CODE_CONFLICT, Message: "site exists"}
+	s.auditJob(info, order, &caller{controller: "1", remote: "127.0.0.1"}, time.Now().Add(-time.Second))
+	list, _, err := audit.Query(&util.AuditQuery{Domain: "a.com"})
+	if err != nil || len(list) != 1 {
+		t.Fatal("job audit not recorded: ", list, err)
+	}
+	e := list[0]
+	if e.Job != "j1" || e.Code != util.CODE_CONFLICT || e.Controller != "1" || e.Duration < 1000 {
+		t.Error("job audit error: ", e)
+	}
+}
+
+func testAuditServe(t *testing.T, dir string) *Serve {
+	s := testServe()
+	s.main.Log = util.NewLogger(ioutil.Discard, util.LOG_ERROR, false)
+	audit, err := util.NewAuditLog(dir+"/audit.log", false)
+	if err != nil {
+		t.Fatal("NewAuditLog failed: ", err.Error())
+	}
+	s.audit = audit
+	return s
+}
+
+func TestAuditQueryScope1(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "sfss")
+	defer os.RemoveAll(dir)
+	s := testAuditServe(t, dir)
+	defer s.audit.Close()
+	s.audit.Append(&util.AuditData{Controller: "1(panel-1)", Method: "site_create"})
+	s.audit.Append(&util.AuditData{Controller: "2", Method: "site_create"})
+	query := func(c *caller) []util.AuditData {
+		ctx := context.WithValue(context.Background(), callerKey{}, c)
+		return s.execAuditQuery(ctx, new(auditQueryParams)).Audit
+	}
+	if list := query(&caller{scope: "1"}); len(list) != 1 || list[0].Controller != "1(panel-1)" {
+		t.Error("controller should only see its own records: ", list)
+	}
+	if list := query(&caller{scope: "1", auditAll: true}); len(list) != 2 {
+		t.Error("audit_all should see all records: ", list)
+	}
+	if list := query(&caller{scope: CALLER_ADMIN}); len(list) != 2 {
+		t.Error("admin should see all records: ", list)
+	}
+}
+
+func TestAuditReject1(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "sfss")
+	defer os.RemoveAll(dir)
+	s := testAuditServe(t, dir)
+	defer s.audit.Close()
+	s.ctrls.table = map[int]*controller{}
+	receive := &util.ReceiveData{Serverid: 3, Version: util.PROTOCOL_V3}
+	_, code, err := s.orderOpen(receive, &origin{remote: "10.0.0.1:1234"}, "")
+	if err == nil || code != util.CODE_AUTH {
+		t.Fatal("unknown controller should be rejected: ", err)
+	}
+	list, _, _ := s.audit.Query(&util.AuditQuery{Controller: "3"})
+	if len(list) != 1 || list[0].Code != util.CODE_AUTH || !strings.HasPrefix(list[0].Message, "rejected: ") {
+		t.Error("rejected order should be audited: ", list)
+	}
+}
@@ -0,0 +1,127 @@
+// Copyright (c) 2013 Beijing CmsTop Technology Co.,Ltd. (http://www.cmstop.com)
+
+// Provides batch orders
+/*
+批量操作
+batch方法按顺序执行order.Orders中的子操作，任意一步失败时，
+按相反顺序撤销已经执行成功的步骤，响应的steps中报告每一步的执行和回滚结果。
+失败步骤之后的步骤不再执行，标记为skipped，状态码为CODE_CONFLICT，与可重试的错误区分。
+每个业务方法通过Method.Undo定义回滚操作，没有定义的方法执行后无法撤销，
+只能作为批量操作的最后一步，否则在执行任何步骤之前拒绝整个批量操作，保证批量操作全部生效或全部撤销。
+*/
+
+package server
+
+import (
+	"context"
+	"sfss/util"
+	"strconv"
+)
+
+const (
+	METHOD_BATCH = "batch" // 批量操作方法名称
+)
+
+// 执行批量操作
+// 作为异步任务执行时报告进度，任务被取消时停止执行后续步骤并回滚
+func (s *Serve) batchExec(ctx context.Context, order *util.OrderData) *util.SendData {
+	send := new(util.SendData)
+	if len(order.Orders) == 0 {
+		return util.ErrorSend(util.NewError(util.CODE_VALIDATION, "batch orders is empty"))
+	}
+	if err := s.batchCheck(order); err != nil {
+		return util.ErrorSend(err)
+	}
+	send.Steps = make([]util.StepResult, len(order.Orders))
+	undos := make([]func() error, len(order.Orders))
+	failed := -1
+	for i := range order.Orders {
+		step := &send.Steps[i]
+		step.Method = order.Orders[i].Method
+		if failed >= 0 {
+			step.Code = util.CODE_CONFLICT
+			step.Message = "skipped, step " + strconv.Itoa(failed+1) + " failed"
+			step.Skipped = true
+			continue
+		}
+		JobProgress(ctx, i*100/len(order.Orders), "step "+strconv.Itoa(i+1)+" "+step.Method)
+		undo, result, err := s.stepExec(ctx, &order.Orders[i])
+		if err != nil {
+			s.main.Logger.Println("batch step " + strconv.Itoa(i+1) + " " + step.Method + " Error: " + err.Error())
+			e := util.ErrorSend(err)
+			step.Code = e.Code
+			step.Message = e.Message
+			step.Details = e.Details
+			failed = i
+			continue
+		}
+		step.Message = result
+		undos[i] = undo
+	}
+	if failed < 0 {
+		send.Message = "batch ok"
+		return send
+	}
+	// 按相反顺序撤销已经执行成功的步骤
+	for i := failed - 1; i >= 0; i-- {
+		step := &send.Steps[i]
+		err := undos[i]()
+		if err != nil {
+			s.main.Logger.Println("batch step " + strconv.Itoa(i+1) + " " + step.Method + " rollback Error: " + err.Error())
+			step.Rollback = "failed: " + err.Error()
+			continue
+		}
+		step.Rollback = "ok"
+	}
+	send.Code = send.Steps[failed].Code
+	send.Details = send.Steps[failed].Details
+	send.Message = "batch failed at step " + strconv.Itoa(failed+1) + " " + send.Steps[failed].Method + ": " + send.Steps[failed].Message
+	return send
+}
+
+// 执行前检查批量操作的每一步：方法存在且可以在批量操作中使用，
+// 无法撤销的方法只能作为最后一步，之后没有可能失败的步骤
+func (s *Serve) batchCheck(order *util.OrderData) error {
+	last := len(order.Orders) - 1
+	for i := range order.Orders {
+		step := "batch step " + strconv.Itoa(i+1) + " "
+		m, err := s.method(order.Orders[i].Method)
+		if err != nil {
+			return util.WrapError(util.ErrorCode(err), step+"Error", err)
+		}
+		if m.Exec != nil {
+			return util.NewError(util.CODE_VALIDATION, step+"method "+m.Name+" can not be used in batch")
+		}
+		if m.Undo == nil && i < last {
+			return util.NewError(util.CODE_VALIDATION, step+"method "+m.Name+" can not be rolled back, only allowed as the last step")
+		}
+	}
+	return nil
+}
+
+// 执行批量操作中的一步，返回用于撤销该步骤的函数，无法撤销时为nil
+func (s *Serve) stepExec(ctx context.Context, order *util.OrderData) (func() error, string, error) {
+	if ctx.Err() != nil {
+		return nil, "", util.NewError(util.CODE_CONFLICT, "batch canceled")
+	}
+	m, err := s.method(order.Method)
+	if err != nil {
+		return nil, "", err
+	}
+	params, err := decodeParams(m, order.Data)
+	if err != nil {
+		return nil, "", err
+	}
+	var undo func() error
+	if m.Undo != nil {
+		undo, err = m.Undo(params)
+		if err != nil {
+			return nil, "", util.WrapError(util.ErrorCode(err), "prepare rollback Error", err)
+		}
+	}
+	result, err := m.Handle(ctx, params)
+	if err != nil {
+		return nil, "", err
+	}
+	return undo, result, nil
+}
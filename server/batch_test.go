@@ -0,0 +1,83 @@
+// Copyright (c) 2013 Beijing CmsTop Technology Co.,Ltd. (http://www.cmstop.com)
+
+package server
+
+import (
+	"context"
+	"sfss/util"
+	"testing"
+)
+
+type fakeParams struct {
+	Name string `json:"name" check:"required,name"`
+}
+
+func TestBatchRollback1(t *testing.T) {
+	s := testServe()
+	created := make(map[string]bool)
+	s.Register(&Method{
+		Name:   "fake_create",
+		Params: func() interface{} { return new(fakeParams) },
+		Handle: func(ctx context.Context, params interface{}) (string, error) {
+			name := params.(*fakeParams).Name
+			if name == "bad" {
+				return "", util.NewError(util.CODE_EXISTS, "bad name")
+			}
+			created[name] = true
+			return "ok", nil
+		},
+		Undo: func(params interface{}) (func() error, error) {
+			name := params.(*fakeParams).Name
+			return func() error {
+				delete(created, name)
+				return nil
+			}, nil
+		},
+	})
+	order := new(util.OrderData)
+	order.Method = METHOD_BATCH
+	order.Orders = []util.OrderData{
+		{Method: "fake_create", Data: map[string]interface{}{"name": "a"}},
+		{Method: "fake_create", Data: map[string]interface{}{"name": "bad"}},
+		{Method: "fake_create", Data: map[string]interface{}{"name": "c"}},
+	}
+	send := s.orderExec(context.Background(), new(caller), order)
+	if send.Code != util.CODE_EXISTS || len(send.Steps) != 3 || send.Steps[1].Code != util.CODE_EXISTS {
+		t.Fatal("batch should fail with 3 steps: ", send)
+	}
+	if send.Steps[0].Rollback != "ok" || !send.Steps[2].Skipped || send.Steps[2].Code != util.CODE_CONFLICT {
+		t.Error("batch steps error: ", send.Steps)
+	}
+	if len(created) != 0 {
+		t.Error("batch rollback failed: ", created)
+	}
+}
+
+func TestBatchCheck1(t *testing.T) {
+	s := testServe()
+	ran := false
+	s.Register(&Method{
+		Name:   "fake_delete",
+		Params: func() interface{} { return new(fakeParams) },
+		Handle: func(ctx context.Context, params interface{}) (string, error) {
+			ran = true
+			return "ok", nil
+		},
+	})
+	order := new(util.OrderData)
+	order.Method = METHOD_BATCH
+	order.Orders = []util.OrderData{
+		{Method: "fake_delete", Data: map[string]interface{}{"name": "a"}},
+		{Method: "fake_delete", Data: map[string]interface{}{"name": "b"}},
+	}
+	// 无法撤销的方法不是最后一步时，不执行任何步骤
+	send := s.orderExec(context.Background(), new(caller), order)
+	if send.Code != util.CODE_VALIDATION || ran {
+		t.Fatal("irreversible step in the middle should be rejected: ", send)
+	}
+	order.Orders = order.Orders[1:]
+	send = s.orderExec(context.Background(), new(caller), order)
+	if send.Code != util.CODE_OK || !ran {
+		t.Error("irreversible last step should be allowed: ", send)
+	}
+}
@@ -0,0 +1,232 @@
+// Copyright (c) 2013 Beijing CmsTop Technology Co.,Ltd. (http://www.cmstop.com)
+
+// Provides config self-check
+/*
+配置检测
+检测sfss.conf的每一项配置，启动、热加载和-check模式使用相同的检测：
+	server  服务器类型、通讯密钥和加密向量长度、控制端密钥表
+	log     日志级别、格式和切割配置
+	tls     证书和客户端CA
+	files   日志、重放检测、幂等键、审计日志、任务状态和本地管理接口socket所在目录存在且可写
+	site    Nginx配置目录、站点目录和日志目录存在且可写，Nginx可以执行且配置检测（nginxTest）通过，
+	        站点模板包含必需的变量
+	db      备份目录存在且可写，MySQL可以连接，管理帐号有创建数据库和帐号需要的权限
+站点和数据库配置按服务器类型检测。
+*/
+
+package server
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sfss/util"
+	"strings"
+	"time"
+)
+
+const (
+	DEF_CHECK_TIMEOUT = 10 // 检测时执行外部命令的超时时间，单位秒
+)
+
+// 站点模板必需的变量
+var siteTplVars = []string{"[DOMAIN]", "[ALIAS]", "[ROOT]", "[LOG]"}
+
+// 管理帐号需要的全局权限
+var mysqlPrivileges = []string{"SELECT", "UPDATE", "DELETE", "CREATE", "DROP", "RELOAD", "GRANT OPTION"}
+
+// 配置检测结果
+type CheckResult struct {
+	Item string // 检测项，如site.siteDir
+	Err  error  // 检测失败的原因，通过时为nil
+}
+
+// 配置检测
+type checker struct {
+	main    *util.SFSS    // 系统接口，使用其中的配置文件
+	results []CheckResult // 检测结果
+}
+
+// 记录一项检测结果
+func (c *checker) add(item string, err error) bool {
+	c.results = append(c.results, CheckResult{Item: item, Err: err})
+	return err == nil
+}
+
+// 检测配置文件的每一项，返回所有检测结果
+func Check(s *util.SFSS) []CheckResult {
+	c := new(checker)
+	c.main = s
+	serverType := c.checkServer()
+	c.checkFiles()
+	if serverType&SERVER_TYPE_WEB != 0 {
+		c.checkSite()
+	}
+	if serverType&SERVER_TYPE_DB != 0 {
+		c.checkDb()
+	}
+	return c.results
+}
+
+// 检测失败的项目，全部通过时为空
+func CheckFailed(results []CheckResult) []string {
+	failed := make([]string, 0)
+	for _, r := range results {
+		if r.Err != nil {
+			failed = append(failed, r.Item)
+		}
+	}
+	return failed
+}
+
+// 检测失败时返回CODE_VALIDATION错误，details.fields为每个失败的检测项，全部通过时返回nil
+func CheckError(results []CheckResult) error {
+	failed := CheckFailed(results)
+	if len(failed) == 0 {
+		return nil
+	}
+	e := util.NewError(util.CODE_VALIDATION, "config check failed: "+strings.Join(failed, ", "))
+	e.Details = new(util.ErrorDetails)
+	for _, r := range results {
+		if r.Err != nil {
+			e.Details.Fields = append(e.Details.Fields, util.FieldError{Field: r.Item, Message: r.Err.Error()})
+		}
+	}
+	return e
+}
+
+// 检测服务器配置，返回服务器类型
+func (c *checker) checkServer() int {
+	n := new(Serve)
+	n.main = c.main
+	if !c.add("server", n.checkConfig()) {
+		return 0
+	}
+	var err error
+	if n.serverType < SERVER_TYPE_WEB || n.serverType > SERVER_TYPE_ALL {
+		err = errors.New("serverType should be 1, 2 or 3")
+	}
+	c.add("server.serverType", err)
+	_, err = loadTLSConfig(c.main.Conf)
+	c.add("tls", err)
+	return n.serverType
+}
+
+// 检测日志配置，以及文件所在目录存在且可写
+func (c *checker) checkFiles() {
+	_, err := util.LoadLogConfig(c.main.Conf)
+	c.add("log", err)
+	files := []struct {
+		section, option, enable string
+	}{
+		{"log", "file", ""},
+		{"replay", "file", "enable"},
+		{"idempotency", "file", "enable"},
+		{"audit", "file", "enable"},
+		{"jobs", "file", ""},
+		{"admin", "socket", ""},
+	}
+	for _, f := range files {
+		if f.enable != "" {
+			if enable, _ := c.main.Conf.GetBool(f.section, f.enable); !enable {
+				continue
+			}
+		}
+		file, _ := c.main.Conf.GetString(f.section, f.option)
+		if file == "" {
+			continue
+		}
+		path, err := util.GetPath(file)
+		if err == nil {
+			err = checkDir(filepath.Dir(path))
+		}
+		c.add(f.section+"."+f.option, err)
+	}
+}
+
+// 检测站点配置
+func (c *checker) checkSite() {
+	conf, err := loadSiteConf(c.main.Conf)
+	if !c.add("site", err) {
+		return
+	}
+	c.add("site.nginxConfDir", checkDir(conf.nginxConfDir))
+	c.add("site.siteDir", checkDir(conf.siteDir))
+	c.add("site.logDir", checkDir(conf.logDir))
+	ctx, cancel := context.WithTimeout(context.Background(), DEF_CHECK_TIMEOUT*time.Second)
+	defer cancel()
+	c.add("site.nginxBin", conf.test(ctx))
+	missing := make([]string, 0)
+	for _, v := range siteTplVars {
+		if !strings.Contains(conf.siteTpl, v) {
+			missing = append(missing, v)
+		}
+	}
+	err = nil
+	if len(missing) > 0 {
+		err = errors.New("missing " + strings.Join(missing, " "))
+	}
+	c.add("nginx.tpl", err)
+}
+
+// 检测数据库配置
+func (c *checker) checkDb() {
+	d, err := initDb(c.main)
+	if !c.add("db", err) {
+		return
+	}
+	conn := d.getConn()
+	defer conn.Conn.Close()
+	_, err = conn.Version()
+	if !c.add("db.mysqlHost", err) {
+		return
+	}
+	grants, err := conn.Grants()
+	if err == nil {
+		if missing := missingPrivileges(grants); len(missing) > 0 {
+			err = errors.New("missing privileges " + strings.Join(missing, ", "))
+		}
+	}
+	c.add("db.mysqlUser", err)
+}
+
+// 检测目录存在且可写
+func checkDir(dir string) error {
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return errors.New(dir + " is not a directory")
+	}
+	if ok, _ := util.IsWritable(dir); !ok {
+		return errors.New(dir + " is not writable")
+	}
+	return nil
+}
+
+// 根据SHOW GRANTS的结果，返回缺少的全局权限
+func missingPrivileges(grants []string) []string {
+	has := make(map[string]bool)
+	for _, g := range grants {
+		g = strings.ToUpper(g)
+		i := strings.Index(g, " ON *.* ")
+		if !strings.HasPrefix(g, "GRANT ") || i < 0 {
+			continue
+		}
+		for _, p := range strings.Split(g[len("GRANT "):i], ",") {
+			has[strings.TrimSpace(p)] = true
+		}
+		if strings.HasSuffix(g, "WITH GRANT OPTION") {
+			has["GRANT OPTION"] = true
+		}
+	}
+	missing := make([]string, 0)
+	for _, p := range mysqlPrivileges {
+		if !has[p] && !(has["ALL PRIVILEGES"] && p != "GRANT OPTION") {
+			missing = append(missing, p)
+		}
+	}
+	return missing
+}
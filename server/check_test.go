@@ -0,0 +1,56 @@
+// Copyright (c) 2013 Beijing CmsTop Technology Co.,Ltd. (http://www.cmstop.com)
+
+package server
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"sfss/util"
+	"testing"
+)
+
+func TestMissingPrivileges1(t *testing.T) {
+	grants := []string{"GRANT ALL PRIVILEGES ON *.* TO 'root'@'localhost' WITH GRANT OPTION"}
+	if missing := missingPrivileges(grants); len(missing) != 0 {
+		t.Error("root should have all privileges: ", missing)
+	}
+	grants = []string{
+		"GRANT SELECT, CREATE, DROP ON *.* TO 'sfss'@'localhost'",
+		"GRANT ALL PRIVILEGES ON `app`.* TO 'sfss'@'localhost'",
+	}
+	missing := missingPrivileges(grants)
+	if len(missing) != 4 || missing[0] != "UPDATE" || missing[3] != "GRANT OPTION" {
+		t.Error("missing privileges error: ", missing)
+	}
+}
+
+func TestCheckDir1(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sfss")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	if err = checkDir(dir); err != nil {
+		t.Error("temp dir should pass: ", err.Error())
+	}
+	if checkDir(dir+"/none") == nil {
+		t.Error("missing dir should fail")
+	}
+	ioutil.WriteFile(dir+"/file", []byte("x"), 0644)
+	if checkDir(dir+"/file") == nil {
+		t.Error("file should fail")
+	}
+}
+
+func TestCheckError1(t *testing.T) {
+	results := []CheckResult{{Item: "server"}, {Item: "site.siteDir", Err: errors.New("not writable")}}
+	err := CheckError(results)
+	e, ok := err.(*util.Error)
+	if !ok || e.Code != util.CODE_VALIDATION || len(e.Details.Fields) != 1 || e.Details.Fields[0].Field != "site.siteDir" {
+		t.Error("check error mismatch: ", err)
+	}
+	if CheckError(results[:1]) != nil {
+		t.Error("passed checks should return nil")
+	}
+}
@@ -0,0 +1,149 @@
+// Copyright (c) 2013 Beijing CmsTop Technology Co.,Ltd. (http://www.cmstop.com)
+
+// Provides controller credentials
+/*
+控制端密钥表
+每个控制端（控制面板）按ReceiveData.Serverid拥有独立的密钥和允许调用的方法，
+吊销某个控制端只需修改密钥表，不需要更换其他控制端的密钥。
+未配置密钥表时所有控制端共用[server]段的serverIV、serverKEY，可以调用全部方法。
+*/
+
+package server
+
+import (
+	"crypto/x509"
+	"errors"
+	"github.com/9466/goconfig"
+	"strconv"
+	"strings"
+)
+
+// 控制端
+type controller struct {
+	id      int      // 控制端编号，对应ReceiveData.Serverid
+	name    string   // 控制端名称，用于日志
+	crypt   *cryptor // 控制端通讯加密接口
+	methods []string // 允许调用的方法，支持*通配，为空表示全部
+	subject string   // 绑定的TLS客户端证书主题，为空表示不绑定
+}
+
+// 控制端标识，用于日志
+func (c *controller) String() string {
+	if c.name == "" {
+		return strconv.Itoa(c.id)
+	}
+	return strconv.Itoa(c.id) + "(" + c.name + ")"
+}
+
+// 判断控制端是否允许调用该方法
+func (c *controller) allowed(method string) bool {
+	if len(c.methods) == 0 {
+		return true
+	}
+	for _, m := range c.methods {
+		if m == "*" || m == method {
+			return true
+		}
+		if strings.HasSuffix(m, "*") && strings.HasPrefix(method, m[:len(m)-1]) {
+			return true
+		}
+	}
+	return false
+}
+
+// 判断控制端是否明确拥有该权限，*通配不包含此类权限，如PERM_AUDIT_ALL
+func (c *controller) explicit(perm string) bool {
+	for _, m := range c.methods {
+		if m == perm {
+			return true
+		}
+	}
+	return false
+}
+
+// 检测TLS客户端证书是否与控制端绑定的主题一致
+// subject可以是证书的CommonName或完整主题，如 CN=panel-1,O=9466
+func (c *controller) verify(cert *x509.Certificate) bool {
+	if c.subject == "" {
+		return true
+	}
+	if cert == nil {
+		return false
+	}
+	return c.subject == cert.Subject.CommonName || c.subject == cert.Subject.String()
+}
+
+// 控制端密钥表
+type controllerTable struct {
+	def   *controller         // 默认控制端，未配置密钥表时使用
+	table map[int]*controller // 按编号索引的控制端，配置密钥表时使用
+}
+
+// 获取控制端
+func (t *controllerTable) get(serverid int) (*controller, error) {
+	if t.table == nil {
+		return t.def, nil
+	}
+	c, ok := t.table[serverid]
+	if !ok {
+		return nil, errors.New("controller " + strconv.Itoa(serverid) + " not found or revoked")
+	}
+	return c, nil
+}
+
+// 加载控制端密钥表文件
+// 每个控制端一个段，段名为控制端编号
+func loadControllers(file string, allowCBC bool) (map[int]*controller, error) {
+	conf, err := goconfig.ReadConfigFile(file)
+	if err != nil {
+		return nil, err
+	}
+	table := make(map[int]*controller)
+	for _, section := range conf.GetSections() {
+		id, err := strconv.Atoi(section)
+		if err != nil {
+			continue // 非控制端段，如default
+		}
+		enable, err := conf.GetBool(section, "enable")
+		if err == nil && !enable {
+			continue // 已吊销
+		}
+		c := new(controller)
+		c.id = id
+		c.name, _ = conf.GetString(section, "name")
+		c.subject, _ = conf.GetString(section, "subject")
+		iv, err := conf.GetString(section, "serverIV")
+		if err != nil {
+			return nil, errors.New("controller " + section + " " + err.Error())
+		}
+		key, err := conf.GetString(section, "serverKEY")
+		if err != nil {
+			return nil, errors.New("controller " + section + " " + err.Error())
+		}
+		// AES-GCM密钥，格式为 key.密钥编号 = 密钥
+		keys := make(map[string][]byte)
+		options, _ := conf.GetOptions(section)
+		for _, option := range options {
+			if !strings.HasPrefix(option, "key.") {
+				continue
+			}
+			v, err := conf.GetString(section, option)
+			if err != nil {
+				return nil, errors.New("controller " + section + " " + err.Error())
+			}
+			keys[option[4:]] = []byte(v)
+		}
+		c.crypt, err = newCryptor([]byte(iv), []byte(key), keys, allowCBC)
+		if err != nil {
+			return nil, errors.New("controller " + section + " " + err.Error())
+		}
+		methods, _ := conf.GetString(section, "methods")
+		for _, m := range strings.Split(methods, ",") {
+			if m = strings.TrimSpace(m); m != "" {
+				c.methods = append(c.methods, m)
+			}
+		}
+		table[id] = c
+	}
+	return table, nil
+}
@@ -0,0 +1,41 @@
+// Copyright (c) 2013 Beijing CmsTop Technology Co.,Ltd. (http://www.cmstop.com)
+
+package server
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"testing"
+)
+
+func TestControllerAllowed1(t *testing.T) {
+	c := &controller{id: 1, methods: []string{"site_*", "init_test"}}
+	if !c.allowed("site_create") || !c.allowed("init_test") {
+		t.Error("method should be allowed")
+	}
+	if c.allowed("db_delete") {
+		t.Error("db_delete should not be allowed")
+	}
+}
+
+func TestControllerTable1(t *testing.T) {
+	tb := &controllerTable{table: map[int]*controller{1: {id: 1}}}
+	if _, err := tb.get(1); err != nil {
+		t.Error("controller 1 should be found")
+	}
+	if _, err := tb.get(2); err == nil {
+		t.Error("controller 2 should not be found")
+	}
+}
+
+func TestControllerVerify1(t *testing.T) {
+	c := &controller{id: 1, subject: "panel-1"}
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: "panel-1"}}
+	if !c.verify(cert) {
+		t.Error("certificate panel-1 should be verified")
+	}
+	cert.Subject.CommonName = "panel-2"
+	if c.verify(cert) || c.verify(nil) {
+		t.Error("certificate panel-2 or no certificate should not be verified")
+	}
+}
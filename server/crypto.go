@@ -0,0 +1,106 @@
+// Copyright (c) 2013 Beijing CmsTop Technology Co.,Ltd. (http://www.cmstop.com)
+
+// Provides protocol encryption
+/*
+通讯加密
+协议版本4使用AES-GCM加密，每个数据包使用随机nonce，并通过keyid选择密钥，
+更换密钥时先在[keys]中添加新密钥，控制端切换后再删除旧密钥。
+协议版本3及以下使用固定向量的AES-CBC加密，由allowCBC控制是否允许。
+*/
+
+package server
+
+import (
+	"crypto/aes"
+	"errors"
+	"sfss/util"
+	"strconv"
+)
+
+// 通讯加密结构
+type cryptor struct {
+	iv       []byte            // AES-CBC加密向量
+	key      []byte            // 默认密钥，请求未指定keyid时使用
+	keys     map[string][]byte // AES-GCM密钥，按密钥编号索引
+	allowCBC bool              // 是否允许旧版AES-CBC加密
+}
+
+// 创建通讯加密接口并检测密钥，允许AES-CBC时检测加密向量长度
+func newCryptor(iv, key []byte, keys map[string][]byte, allowCBC bool) (*cryptor, error) {
+	if err := checkAesKey(key); err != nil {
+		return nil, errors.New("serverKEY Error: " + err.Error())
+	}
+	if allowCBC && len(iv) != aes.BlockSize {
+		return nil, errors.New("serverIV Error: should be " + strconv.Itoa(aes.BlockSize) + " bytes for AES-CBC")
+	}
+	for keyid, k := range keys {
+		if err := checkAesKey(k); err != nil {
+			return nil, errors.New("keys " + keyid + " Error: " + err.Error())
+		}
+	}
+	c := new(cryptor)
+	c.iv = iv
+	c.key = key
+	c.keys = keys
+	c.allowCBC = allowCBC
+	return c, nil
+}
+
+// 检测AES密钥长度
+func checkAesKey(key []byte) error {
+	_, err := aes.NewCipher(key)
+	return err
+}
+
+// 获取密钥，keyid为空时使用默认密钥
+func (c *cryptor) getKey(keyid string) ([]byte, error) {
+	if keyid == "" {
+		return c.key, nil
+	}
+	key, ok := c.keys[keyid]
+	if !ok {
+		return nil, errors.New("keyid " + keyid + " not found")
+	}
+	return key, nil
+}
+
+// 解密请求数据
+func (c *cryptor) open(receive *util.ReceiveData) ([]byte, error) {
+	if receive.Version >= util.PROTOCOL_V4 {
+		key, err := c.getKey(receive.Keyid)
+		if err != nil {
+			return nil, err
+		}
+		return util.GcmDecrypt([]byte(receive.Data), []byte(receive.Nonce), key)
+	}
+	if !c.allowCBC {
+		return nil, errors.New("AES-CBC is disabled, protocol version " + strconv.Itoa(util.PROTOCOL_V4) + " required")
+	}
+	return util.AesDecrypt([]byte(receive.Data), c.iv, c.key)
+}
+
+// 加密响应数据，使用与请求相同的加密方式和密钥
+func (c *cryptor) seal(data []byte, envelope *util.ReceiveData) error {
+	if envelope.Version >= util.PROTOCOL_V4 {
+		key, err := c.getKey(envelope.Keyid)
+		if err != nil {
+			return err
+		}
+		data, nonce, err := util.GcmEncrypt(data, key)
+		if err != nil {
+			return err
+		}
+		envelope.Data = string(data)
+		envelope.Nonce = string(nonce)
+		return nil
+	}
+	if !c.allowCBC {
+		return errors.New("AES-CBC is disabled")
+	}
+	data, err := util.AesEncrypt(data, c.iv, c.key)
+	if err != nil {
+		return err
+	}
+	envelope.Data = string(data)
+	return nil
+}
@@ -0,0 +1,20 @@
+// Copyright (c) 2013 Beijing CmsTop Technology Co.,Ltd. (http://www.cmstop.com)
+
+package server
+
+import (
+	"testing"
+)
+
+func TestNewCryptor1(t *testing.T) {
+	key := []byte("1234567890123456")
+	if _, err := newCryptor([]byte("short"), key, nil, true); err == nil {
+		t.Error("short serverIV should be rejected when AES-CBC is allowed")
+	}
+	if _, err := newCryptor([]byte("short"), key, nil, false); err != nil {
+		t.Error("serverIV should not be checked when AES-CBC is disabled: ", err.Error())
+	}
+	if _, err := newCryptor([]byte("1234567890123456"), key, map[string][]byte{"k1": []byte("bad")}, true); err == nil {
+		t.Error("bad gcm key should be rejected")
+	}
+}
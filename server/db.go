@@ -1,36 +1,51 @@
 // Copyright (c) 2013 Beijing CmsTop Technology Co.,Ltd. (http://www.cmstop.com)
 
 // Provides db management
+/*
+数据库管理
+添加已经存在的数据库时返回成功，与添加已经存在的站点一致。
+MySQL错误按错误号转换为状态码：数据库已存在为CODE_EXISTS，数据库或帐号不存在为CODE_NOT_FOUND，
+帐号操作冲突为CODE_CONFLICT，禁止使用的数据库名称为CODE_VALIDATION，
+连接失败等其他错误为CODE_UNAVAILABLE，控制端可以稍后重试。
+*/
 
 package server
 
 import (
+	"context"
 	"errors"
 	"sfss/util"
+	"sync"
 )
 
-// 数据库操作数据字段：创建
-var fieldDbCreate = [4]string{
-	"name",     // 数据库名称
-	"user",     // 数据库帐号
-	"host",     // 数据库帐号主机
-	"password", // 数据库帐号密码
+// 数据库操作参数：创建、更新
+type dbParams struct {
+	Name     string `json:"name" check:"required,name"`          // 数据库名称
+	User     string `json:"user" check:"required,name,len=1-32"` // 数据库帐号
+	Host     string `json:"host" check:"required,host"`          // 数据库帐号主机
+	Password string `json:"password" check:"required,password"`  // 数据库帐号密码
 }
 
-// 数据库操作数据字段：更新
-var fieldDbUpdate = fieldDbCreate
-
-// 数据库操作数据字段：暂停
-var fieldDbPause = [1]string{"user"}
+// 数据库操作参数：暂停
+type dbUserParams struct {
+	User string `json:"user" check:"required,name,len=1-32"` // 数据库帐号
+}
 
-// 数据库操作数据字段：开启
-var fieldDbStart = [2]string{"user", "password"}
+// 数据库操作参数：开启
+type dbStartParams struct {
+	User     string `json:"user" check:"required,name,len=1-32"` // 数据库帐号
+	Password string `json:"password" check:"required,password"`  // 数据库帐号密码
+}
 
-// 数据库操作数据字段：删除
-var fieldDbDelete = [2]string{"name", "user"}
+// 数据库操作参数：删除
+type dbDeleteParams struct {
+	Name string `json:"name" check:"required,name"`          // 数据库名称
+	User string `json:"user" check:"required,name,len=1-32"` // 数据库帐号
+}
 
 type db struct {
 	main      *util.SFSS    // 系统接口
+	lock      sync.RWMutex  // 配置锁，热加载时替换连接
 	mysqlHost string        // MySQL服务主机
 	mysqlPort string        // MySQL服务端口
 	mysqlUser string        // MySQL管理帐号
@@ -52,6 +67,7 @@ func initDb(s *util.SFSS) (*db, error) {
 	if err != nil {
 		return nil, errors.New("mysql Check Error: " + err.Error())
 	}
+	conn.Observe = mysqlObserver(s.Metrics)
 	db.conn = conn
 	return db, nil
 }
@@ -97,146 +113,215 @@ func (s *db) checkConfig() error {
 	return nil
 }
 
-// 添加数据库
-func (s *db) Create(data map[string]string) (msg string, err error) {
-	var ok bool
-	var k, v string
-	// 开始处理配置文件
-	for _, k = range fieldDbCreate {
-		if v, ok = data[k]; !ok || v == "" {
-			return "", errors.New(k + " is empty")
+// 当前的数据库连接
+func (s *db) getConn() *util.DbMySQL {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.conn
+}
+
+// 使用新配置的连接替换当前连接，正在执行的业务操作继续使用原连接
+func (s *db) setConf(n *db) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.mysqlHost = n.mysqlHost
+	s.mysqlPort = n.mysqlPort
+	s.mysqlUser = n.mysqlUser
+	s.mysqlPass = n.mysqlPass
+	s.backupDir = n.backupDir
+	s.conn = n.conn
+}
+
+// 注册数据库业务方法，服务器类型不含db时s为nil，方法只记录名称
+func (s *db) register(r *registry) error {
+	methods := []*Method{
+		{Name: "db_create", Desc: "创建数据库", ServerType: SERVER_TYPE_DB, Params: newDbParams, Handle: s.Create, Undo: s.undoCreate},
+		{Name: "db_update", Desc: "更新数据库", ServerType: SERVER_TYPE_DB, Params: newDbParams, Handle: s.Update},
+		{Name: "db_pause", Desc: "暂停数据库", ServerType: SERVER_TYPE_DB, Params: newDbUserParams, Handle: s.Pause},
+		{Name: "db_start", Desc: "开启数据库", ServerType: SERVER_TYPE_DB, Params: newDbStartParams, Handle: s.Start, Undo: s.undoStart},
+		{Name: "db_delete", Desc: "删除数据库", ServerType: SERVER_TYPE_DB, Params: newDbDeleteParams, Handle: s.Delete},
+	}
+	for _, m := range methods {
+		if err := r.register(m); err != nil {
+			return err
 		}
 	}
+	return nil
+}
+
+func newDbParams() interface{}       { return new(dbParams) }
+func newDbUserParams() interface{}   { return new(dbUserParams) }
+func newDbStartParams() interface{}  { return new(dbStartParams) }
+func newDbDeleteParams() interface{} { return new(dbDeleteParams) }
+
+// 添加数据库
+func (s *db) Create(ctx context.Context, params interface{}) (msg string, err error) {
+	p := params.(*dbParams)
+	conn := s.getConn()
 	// 创建数据库
-	err = s.conn.CreateDb(data["name"])
+	err = conn.CreateDb(p.Name)
 	if err != nil {
-		return "", errors.New("create database error:" + err.Error())
+		return "", dbError("create database error", err)
 	}
 
 	// 创建用户
-	err = s.conn.CreateUser(data["name"], data["user"], data["host"], data["password"])
+	err = conn.CreateUser(p.Name, p.User, p.Host, p.Password)
 	if err != nil {
-		return "", errors.New("create db user error:" + err.Error())
+		return "", dbError("create db user error", err)
 	}
 
 	// 刷新权限
-	err = s.conn.Flush()
+	err = conn.Flush()
 	if err != nil {
-		return "", errors.New("db flush error:" + err.Error())
+		return "", dbError("db flush error", err)
 	}
 
 	return "db create ok", nil
 }
 
 // 更新数据库
-func (s *db) Update(data map[string]string) (msg string, err error) {
-	var ok bool
-	var k, v string
-	// 开始处理配置文件
-	for _, k = range fieldDbUpdate {
-		if v, ok = data[k]; !ok || v == "" {
-			return "", errors.New(k + " is empty")
-		}
-	}
+func (s *db) Update(ctx context.Context, params interface{}) (msg string, err error) {
+	p := params.(*dbParams)
+	conn := s.getConn()
 	// 创建数据库
-	err = s.conn.CreateDb(data["name"])
+	err = conn.CreateDb(p.Name)
 	if err != nil {
-		return "", errors.New("create database error:" + err.Error())
+		return "", dbError("create database error", err)
 	}
 
 	// 创建用户
-	err = s.conn.CreateUser(data["name"], data["user"], data["host"], data["password"])
+	err = conn.CreateUser(p.Name, p.User, p.Host, p.Password)
 	if err != nil {
-		return "", errors.New("create db user error:" + err.Error())
+		return "", dbError("create db user error", err)
 	}
 
 	// 刷新权限
-	err = s.conn.Flush()
+	err = conn.Flush()
 	if err != nil {
-		return "", errors.New("db flush error:" + err.Error())
+		return "", dbError("db flush error", err)
 	}
 
 	return "db update ok", nil
 }
 
 // 暂停数据库
-func (s *db) Pause(data map[string]string) (msg string, err error) {
-	var ok bool
-	var k, v string
-	// 开始处理配置文件
-	for _, k = range fieldDbPause {
-		if v, ok = data[k]; !ok || v == "" {
-			return "", errors.New(k + " is empty")
-		}
-	}
+func (s *db) Pause(ctx context.Context, params interface{}) (msg string, err error) {
+	p := params.(*dbUserParams)
+	conn := s.getConn()
 	// 修改密码
 	pass := util.RandString(15)
-	err = s.conn.Password(data["user"], pass)
+	err = conn.Password(p.User, pass)
 	if err != nil {
-		return "", errors.New("stop user error:" + err.Error())
+		return "", dbError("stop user error", err)
 	}
 
 	// 刷新权限
-	err = s.conn.Flush()
+	err = conn.Flush()
 	if err != nil {
-		return "", errors.New("db flush error:" + err.Error())
+		return "", dbError("db flush error", err)
 	}
 
 	return "db pause ok", nil
 }
 
 // 开启数据库
-func (s *db) Start(data map[string]string) (msg string, err error) {
-	var ok bool
-	var k, v string
-	// 开始处理配置文件
-	for _, k = range fieldDbPause {
-		if v, ok = data[k]; !ok || v == "" {
-			return "", errors.New(k + " is empty")
-		}
-	}
+func (s *db) Start(ctx context.Context, params interface{}) (msg string, err error) {
+	p := params.(*dbStartParams)
+	conn := s.getConn()
 	// 修改密码
-	err = s.conn.Password(data["user"], data["password"])
+	err = conn.Password(p.User, p.Password)
 	if err != nil {
-		return "", errors.New("start user error:" + err.Error())
+		return "", dbError("start user error", err)
 	}
 
 	// 刷新权限
-	err = s.conn.Flush()
+	err = conn.Flush()
 	if err != nil {
-		return "", errors.New("db flush error:" + err.Error())
+		return "", dbError("db flush error", err)
 	}
 
 	return "db start ok", nil
 }
 
 // 删除数据库
-func (s *db) Delete(data map[string]string) (msg string, err error) {
-	var ok bool
-	var k, v string
-	// 开始处理配置文件
-	for _, k = range fieldDbPause {
-		if v, ok = data[k]; !ok || v == "" {
-			return "", errors.New(k + " is empty")
-		}
-	}
+func (s *db) Delete(ctx context.Context, params interface{}) (msg string, err error) {
+	p := params.(*dbDeleteParams)
+	conn := s.getConn()
 	// 删除用户
-	err = s.conn.DeleteUser(data["user"])
+	err = conn.DeleteUser(p.User)
 	if err != nil {
-		return "", errors.New("delete user error:" + err.Error())
+		return "", dbError("delete user error", err)
 	}
 
 	// 删除数据库
-	err = s.conn.DeleteDb(data["name"])
+	err = conn.DeleteDb(p.Name)
 	if err != nil {
-		return "", errors.New("delete db error:" + err.Error())
+		return "", dbError("delete db error", err)
 	}
 
 	// 刷新权限
-	err = s.conn.Flush()
+	err = conn.Flush()
 	if err != nil {
-		return "", errors.New("db flush error:" + err.Error())
+		return "", dbError("db flush error", err)
 	}
 
 	return "db delete ok", nil
 }
+
+// 转换MySQL错误为带状态码的错误
+func dbError(msg string, err error) *util.Error {
+	code := util.CODE_UNAVAILABLE
+	switch err {
+	case util.ErrDbNameDeny:
+		code = util.CODE_VALIDATION
+	case util.ErrDbUserNotFound:
+		code = util.CODE_NOT_FOUND
+	}
+	switch util.MySQLErrorNumber(err) {
+	case util.MYSQL_ER_DB_CREATE_EXISTS:
+		code = util.CODE_EXISTS
+	case util.MYSQL_ER_DB_DROP_EXISTS, util.MYSQL_ER_BAD_DB, util.MYSQL_ER_PASSWORD_NO_MATCH:
+		code = util.CODE_NOT_FOUND
+	case util.MYSQL_ER_CANNOT_USER:
+		code = util.CODE_CONFLICT
+	}
+	return util.WrapError(code, msg, err)
+}
+
+// 回滚准备：添加数据库，只删除本次新建的数据库和帐号
+// 更新、暂停和删除数据库无法回滚：原密码和数据无法恢复
+func (s *db) undoCreate(params interface{}) (func() error, error) {
+	p := params.(*dbParams)
+	conn := s.getConn()
+	dbExist, err := conn.DbExists(p.Name)
+	if err != nil {
+		return nil, dbError("check database error", err)
+	}
+	userExist, err := conn.UserExists(p.User)
+	if err != nil {
+		return nil, dbError("check db user error", err)
+	}
+	name, user := p.Name, p.User
+	return func() error {
+		if !userExist {
+			if err := conn.DeleteUser(user); err != nil {
+				return dbError("delete user error", err)
+			}
+		}
+		if !dbExist {
+			if err := conn.DeleteDb(name); err != nil {
+				return dbError("delete db error", err)
+			}
+		}
+		return conn.Flush()
+	}, nil
+}
+
+// 回滚准备：开启数据库
+func (s *db) undoStart(params interface{}) (func() error, error) {
+	user := params.(*dbStartParams).User
+	return func() error {
+		_, err := s.Pause(context.Background(), &dbUserParams{User: user})
+		return err
+	}, nil
+}
@@ -3,9 +3,31 @@
 package server
 
 import (
+	"errors"
+	"github.com/go-sql-driver/mysql"
+	"sfss/util"
 	"testing"
 )
 
 func TestDbCreate(t *testing.T) {
 
 }
+
+func TestDbError1(t *testing.T) {
+	cases := []struct {
+		err  error
+		code int
+	}{
+		{&mysql.MySQLError{Number: 1007, Message: "Can't create database 'a'; database exists"}, util.CODE_EXISTS},
+		{&mysql.MySQLError{Number: 1008, Message: "Can't drop database 'a'; database doesn't exist"}, util.CODE_NOT_FOUND},
+		{&mysql.MySQLError{Number: 1396, Message: "Operation DROP USER failed for 'a'@'%'"}, util.CODE_CONFLICT},
+		{util.ErrDbUserNotFound, util.CODE_NOT_FOUND},
+		{util.ErrDbNameDeny, util.CODE_VALIDATION},
+		{errors.New("dial tcp 127.0.0.1:3306: connection refused"), util.CODE_UNAVAILABLE},
+	}
+	for _, c := range cases {
+		if e := dbError("db error", c.err); e.Code != c.code {
+			t.Error("dbError code mismatch: ", c.err.Error(), e.Code)
+		}
+	}
+}
@@ -0,0 +1,222 @@
+// Copyright (c) 2013 Beijing CmsTop Technology Co.,Ltd. (http://www.cmstop.com)
+
+// Provides HTTP API gateway
+/*
+HTTP接口
+与TCP接口共用业务方法和认证，请求体为与TCP相同的ReceiveData结构（JSON），
+业务方法由路径决定，响应为SendData结构，并使用对应的HTTP状态码：
+	POST   /sites                  site_create
+	PUT    /sites/{domain}         site_update
+	POST   /sites/{domain}/pause   site_pause
+	POST   /sites/{domain}/start   site_start
+	DELETE /sites/{domain}         site_delete
+	POST   /dbs                    db_create
+	PUT    /dbs/{name}             db_update
+	POST   /dbs/{name}/pause       db_pause
+	POST   /dbs/{name}/start       db_start
+	DELETE /dbs/{name}             db_delete
+	POST   /methods/{method}       调用任意已注册的方法，包括init_test和batch
+路径中的资源名称会写入业务数据，与请求中的数据不一致时拒绝请求。
+HTTP状态码由响应状态码决定：参数错误400，未授权403，不存在404，已存在或冲突409，不支持501，后端不可用503。
+*/
+
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sfss/util"
+	"strings"
+	"time"
+)
+
+const (
+	DEF_HTTP_HOST = "0.0.0.0" // 默认HTTP接口服务地址
+	DEF_HTTP_PORT = "9468"    // 默认HTTP接口服务端口号
+)
+
+// HTTP接口资源，路径名称对应的业务方法前缀和资源名称字段
+var httpResources = map[string][2]string{
+	"sites": {"site", "domain"},
+	"dbs":   {"db", "name"},
+}
+
+// HTTP接口
+type httpGateway struct {
+	server *Serve       // 服务器
+	listen net.Listener // 服务监听接口
+	tcp    net.Listener // 未封装TLS的监听，平滑重启时传给新进程
+	srv    *http.Server // HTTP服务
+}
+
+// 创建HTTP接口，未开启时返回nil
+func newHttpGateway(s *Serve) (*httpGateway, error) {
+	enable, _ := s.main.Conf.GetBool("http", "enable")
+	if !enable {
+		return nil, nil
+	}
+	host, _ := s.main.Conf.GetString("http", "listen")
+	port, _ := s.main.Conf.GetString("http", "port")
+	if host == "" {
+		host = DEF_HTTP_HOST
+	}
+	if port == "" {
+		port = DEF_HTTP_PORT
+	}
+	tcp, err := listen(LISTEN_HTTP, "tcp4", host+":"+port)
+	if err != nil {
+		return nil, err
+	}
+	listener := tcp
+	if s.tlsConfig != nil {
+		listener = tls.NewListener(tcp, s.tlsConfig)
+	}
+	g := new(httpGateway)
+	g.server = s
+	g.listen = listener
+	g.tcp = tcp
+	g.srv = &http.Server{Handler: g, ReadTimeout: DEF_READ_TIMEOUT * time.Second}
+	return g, nil
+}
+
+// 开始服务
+func (g *httpGateway) serve() {
+	g.server.main.Logger.Println("SFSS http gateway begin serve.")
+	err := g.srv.Serve(g.listen)
+	if err != nil && err != http.ErrServerClosed {
+		g.server.main.Logger.Println("SFSS http gateway Error: " + err.Error())
+	}
+}
+
+// 停止服务：停止接收新连接，等待正在处理的请求结束，ctx到期时强制关闭连接
+func (g *httpGateway) close(ctx context.Context) {
+	err := g.srv.Shutdown(ctx)
+	if err != nil {
+		g.srv.Close()
+	}
+}
+
+// 解析路径对应的业务方法，以及路径中的资源名称字段和值
+func httpRoute(method, path string) (order, field, value string, ok bool) {
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	if parts[0] == "methods" {
+		if len(parts) == 2 && method == "POST" {
+			return parts[1], "", "", true
+		}
+		return "", "", "", false
+	}
+	res, ok := httpResources[parts[0]]
+	if !ok {
+		return "", "", "", false
+	}
+	switch {
+	case len(parts) == 1 && method == "POST":
+		return res[0] + "_create", "", "", true
+	case len(parts) == 2 && method == "PUT":
+		return res[0] + "_update", res[1], parts[1], true
+	case len(parts) == 2 && method == "DELETE":
+		return res[0] + "_delete", res[1], parts[1], true
+	case len(parts) == 3 && method == "POST":
+		return res[0] + "_" + parts[2], res[1], parts[1], true
+	}
+	return "", "", "", false
+}
+
+// HTTP状态码
+func httpStatus(code int) int {
+	switch code {
+	case util.CODE_OK:
+		return http.StatusOK
+	case util.CODE_ERROR, util.CODE_VALIDATION:
+		return http.StatusBadRequest
+	case util.CODE_AUTH:
+		return http.StatusForbidden
+	case util.CODE_NOT_FOUND:
+		return http.StatusNotFound
+	case util.CODE_REPLAY, util.CODE_EXISTS, util.CODE_CONFLICT:
+		return http.StatusConflict
+	case util.CODE_UNSUPPORTED:
+		return http.StatusNotImplemented
+	case util.CODE_UNAVAILABLE:
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
+
+// 处理HTTP请求
+func (g *httpGateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s := g.server
+	s.main.ConnBegin()     // 每启动一个处理，连接数+1
+	defer s.main.ConnEnd() // 每结束一个处理，连接数-1
+	method, field, value, ok := httpRoute(r.Method, r.URL.Path)
+	if !ok {
+		g.write(w, nil, util.CODE_NOT_FOUND, "route "+r.Method+" "+r.URL.Path+" undefined")
+		return
+	}
+	if method != "init_test" && method != METHOD_BATCH {
+		if _, err := s.method(method); err != nil {
+			g.write(w, nil, util.ErrorCode(err), err.Error())
+			return
+		}
+	}
+	// 解析请求
+	data, err := ioutil.ReadAll(io.LimitReader(r.Body, util.MAX_PACKET_SIZE))
+	if err != nil {
+		g.write(w, nil, util.CODE_ERROR, "Request body read Error: "+err.Error())
+		return
+	}
+	receive := new(util.ReceiveData)
+	err = json.Unmarshal(data, receive)
+	if err != nil {
+		g.write(w, nil, util.CODE_ERROR, "ReceiveData json decode Error: "+err.Error())
+		return
+	}
+	from := &origin{remote: r.RemoteAddr, cert: peerCertificate(r.TLS)}
+	order, code, err := s.orderOpen(receive, from, method)
+	if err != nil {
+		g.write(w, receive, code, err.Error())
+		return
+	}
+	// 路径中的资源名称
+	if field != "" {
+		if order.Data == nil {
+			order.Data = make(map[string]interface{})
+		}
+		if v, ok := order.Data[field]; ok && v != "" && v != value {
+			g.write(w, receive, util.CODE_VALIDATION, field+" mismatch with path")
+			return
+		}
+		order.Data[field] = value
+	}
+	if method == "init_test" {
+		g.send(w, http.StatusOK, receive, s.initTest())
+		return
+	}
+	send := s.orderExec(s.ctx, s.newCaller(receive, from), order)
+	g.send(w, httpStatus(send.Code), receive, send)
+}
+
+// 响应客户端信息，HTTP状态码由响应状态码决定
+func (g *httpGateway) write(w http.ResponseWriter, receive *util.ReceiveData, code int, msg string) {
+	send := new(util.SendData)
+	send.Code = code
+	send.Message = msg
+	g.send(w, httpStatus(code), receive, send)
+}
+
+// 按请求的协议版本加密并发送响应
+func (g *httpGateway) send(w http.ResponseWriter, status int, receive *util.ReceiveData, send interface{}) {
+	version := util.PROTOCOL_V1
+	if receive != nil {
+		version = receive.Version
+	}
+	data, _ := json.Marshal(g.server.seal(receive, version, send))
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	w.Write(data)
+}
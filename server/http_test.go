@@ -0,0 +1,28 @@
+// Copyright (c) 2013 Beijing CmsTop Technology Co.,Ltd. (http://www.cmstop.com)
+
+package server
+
+import (
+	"testing"
+)
+
+func TestHttpRoute1(t *testing.T) {
+	tests := []struct {
+		method, path, order, field, value string
+	}{
+		{"POST", "/sites", "site_create", "", ""},
+		{"PUT", "/sites/a.9466.cn", "site_update", "domain", "a.9466.cn"},
+		{"POST", "/sites/a.9466.cn/pause", "site_pause", "domain", "a.9466.cn"},
+		{"DELETE", "/dbs/fy_dongman", "db_delete", "name", "fy_dongman"},
+		{"POST", "/methods/init_test", "init_test", "", ""},
+	}
+	for _, v := range tests {
+		order, field, value, ok := httpRoute(v.method, v.path)
+		if !ok || order != v.order || field != v.field || value != v.value {
+			t.Error("route error: ", v.method, v.path, order, field, value)
+		}
+	}
+	if _, _, _, ok := httpRoute("GET", "/sites"); ok {
+		t.Error("GET /sites should not be routed")
+	}
+}
@@ -0,0 +1,475 @@
+// Copyright (c) 2013 Beijing CmsTop Technology Co.,Ltd. (http://www.cmstop.com)
+
+// Provides asynchronous jobs
+/*
+异步任务
+耗时较长的业务方法（Method.Async），或请求中指定async的业务操作，作为异步任务执行：
+请求立即返回任务编号，任务在固定数量的工作协程中排队执行，
+控制端通过job_status查询进度和结果，通过job_list分页列出任务（不含完整结果），
+通过job_cancel取消任务。
+任务记录提交的控制端（JobData.Owner），控制端只能查看和取消自己提交的任务，
+本地管理接口可以查看和取消所有任务。
+任务状态保存在文件中，服务重启后已结束任务的结果不会丢失，重启前未结束的任务标记为失败。
+平滑重启时新进程先只在内存中记录任务，父进程关闭状态文件后通过attach加载父进程的任务并保存。
+*/
+
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"sfss/util"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	DEF_JOB_WORKERS = 4     // 默认执行任务的工作协程数
+	DEF_JOB_QUEUE   = 100   // 默认排队任务的最大数量
+	DEF_JOB_KEEP    = 86400 // 默认已结束任务的保留时间，单位秒
+	DEF_JOB_LIST    = 20    // job_list默认返回的任务数
+	MAX_JOB_LIST    = 100   // job_list最多返回的任务数，避免响应超过数据包大小限制
+)
+
+// 业务执行函数
+type jobRunner func(ctx context.Context, order *util.OrderData) *util.SendData
+
+// 任务结束时的回调，order为任务的业务数据，c为提交任务的调用者
+type jobHook func(info *util.JobData, order *util.OrderData, c *caller, start time.Time)
+
+// 进度回调在context中的键
+type jobProgressKey struct{}
+
+// 任务操作参数：查询、取消
+type jobIdParams struct {
+	Id string `json:"id" check:"required,len=1-64"` // 任务编号
+}
+
+// 任务操作参数：列出
+type jobListParams struct {
+	Status string `json:"status" check:"enum=queued|running|done|failed|canceled"` // 任务状态
+	Method string `json:"method" check:"len=1-64"`                                 // 业务操作类型
+	Offset int    `json:"offset" check:"range=0-"`                                 // 跳过的任务数，用于分页
+	Limit  int    `json:"limit" check:"range=0-100"`                               // 返回的任务数，默认20
+}
+
+func newJobIdParams() interface{}   { return new(jobIdParams) }
+func newJobListParams() interface{} { return new(jobListParams) }
+
+// 异步任务
+type job struct {
+	info   util.JobData       // 任务状态
+	order  *util.OrderData    // 业务数据，只在内存中保存
+	caller *caller            // 提交任务的调用者，只在内存中保存
+	start  time.Time          // 开始执行的时间，用于计算耗时
+	cancel context.CancelFunc // 取消正在执行的任务
+}
+
+// 异步任务管理
+type jobManager struct {
+	ctx    context.Context // 任务的父Context，停止服务排空超时后取消
+	logger *log.Logger     // 日志接口
+	run    jobRunner       // 业务执行函数
+	finish jobHook         // 任务结束时的回调，用于记录审计日志，可以为nil
+	file   string          // 任务状态文件，为空时只在内存中记录
+	keep   time.Duration   // 已结束任务的保留时间
+	lock   sync.Mutex      // 任务表锁
+	jobs   map[string]*job // 任务表
+	queue  chan *job       // 排队的任务
+	closed bool            // 是否已停止接收任务
+	wg     sync.WaitGroup  // 工作协程
+}
+
+// 初始化异步任务管理，加载上次保存的任务状态并启动工作协程
+func newJobManager(ctx context.Context, file string, workers, queue int, keep time.Duration, run jobRunner, logger *log.Logger) (*jobManager, error) {
+	m := new(jobManager)
+	m.ctx = ctx
+	m.logger = logger
+	m.run = run
+	m.file = file
+	m.keep = keep
+	m.jobs = make(map[string]*job)
+	m.queue = make(chan *job, queue)
+	err := m.load()
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < workers; i++ {
+		m.wg.Add(1)
+		go m.worker()
+	}
+	return m, nil
+}
+
+// 注册任务查询方法
+func (m *jobManager) register(r *registry) error {
+	methods := []*Method{
+		{Name: "job_status", Desc: "查询任务状态", Params: newJobIdParams, Exec: m.execStatus, Query: true},
+		{Name: "job_list", Desc: "列出任务", Params: newJobListParams, Exec: m.execList, Query: true},
+		{Name: "job_cancel", Desc: "取消任务", Params: newJobIdParams, Exec: m.execCancel},
+	}
+	for _, mt := range methods {
+		if err := r.register(mt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 提交任务，c为提交任务的调用者
+func (m *jobManager) submit(order *util.OrderData, c *caller) (*util.JobData, error) {
+	id, err := newJobId()
+	if err != nil {
+		return nil, err
+	}
+	j := new(job)
+	j.order = order
+	j.caller = c
+	j.info.Id = id
+	j.info.Method = order.Method
+	j.info.Owner = c.scope
+	j.info.Status = util.JOB_QUEUED
+	j.info.Created = time.Now().Unix()
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.closed {
+		return nil, util.NewError(util.CODE_UNAVAILABLE, "job submit Error: server is shutting down")
+	}
+	select {
+	case m.queue <- j:
+	default:
+		return nil, util.NewError(util.CODE_UNAVAILABLE, "job submit Error: job queue is full")
+	}
+	m.jobs[id] = j
+	m.save()
+	info := j.info
+	m.logger.Println("job " + id + " " + order.Method + " queued")
+	return &info, nil
+}
+
+// 工作协程：依次执行排队的任务
+func (m *jobManager) worker() {
+	defer m.wg.Done()
+	for j := range m.queue {
+		m.execute(j)
+	}
+}
+
+// 执行一个任务
+func (m *jobManager) execute(j *job) {
+	m.lock.Lock()
+	if j.info.Status != util.JOB_QUEUED {
+		m.lock.Unlock()
+		return // 排队时已取消
+	}
+	ctx, cancel := context.WithCancel(m.ctx)
+	j.cancel = cancel
+	j.start = time.Now()
+	j.info.Status = util.JOB_RUNNING
+	j.info.Started = j.start.Unix()
+	m.save()
+	m.lock.Unlock()
+	m.logger.Println("job " + j.info.Id + " " + j.info.Method + " started")
+
+	ctx = context.WithValue(ctx, jobProgressKey{}, func(percent int, msg string) {
+		m.lock.Lock()
+		j.info.Progress = percent
+		j.info.Message = msg
+		m.lock.Unlock()
+	})
+	send := m.run(ctx, j.order)
+	canceled := ctx.Err() != nil
+	cancel()
+
+	m.lock.Lock()
+	order := j.order
+	j.cancel = nil
+	j.order = nil
+	j.info.Result = send
+	j.info.Finished = time.Now().Unix()
+	// 按业务结果决定状态，取消时业务已经完成的仍然是done，只有未完成的才是canceled
+	switch {
+	case send.Code == util.CODE_OK:
+		j.info.Status = util.JOB_DONE
+		j.info.Progress = 100
+	case canceled:
+		j.info.Status = util.JOB_CANCELED
+	default:
+		j.info.Status = util.JOB_FAILED
+	}
+	m.save()
+	info := j.info
+	m.lock.Unlock()
+	m.logger.Println("job " + info.Id + " " + info.Method + " " + info.Status + ": " + send.Message)
+	m.finished(&info, order, j)
+}
+
+// 任务结束，调用结束回调，order为nil时（任务未结束）忽略
+func (m *jobManager) finished(info *util.JobData, order *util.OrderData, j *job) {
+	if m.finish != nil && order != nil {
+		m.finish(info, order, j.caller, j.start)
+	}
+}
+
+// 获取owner可以访问的任务，调用时需持有m.lock
+// 其他控制端的任务按不存在处理，不泄露任务是否存在
+func (m *jobManager) get(id, owner string) (*job, error) {
+	j, ok := m.jobs[id]
+	if !ok || !j.visible(owner) {
+		return nil, util.NewError(util.CODE_NOT_FOUND, "job "+id+" not found")
+	}
+	return j, nil
+}
+
+// 判断owner是否可以访问任务，本地管理接口可以访问所有任务
+func (j *job) visible(owner string) bool {
+	return owner == CALLER_ADMIN || owner == j.info.Owner
+}
+
+// 查询任务
+func (m *jobManager) status(id, owner string) (*util.JobData, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	j, err := m.get(id, owner)
+	if err != nil {
+		return nil, err
+	}
+	info := j.info
+	return &info, nil
+}
+
+// 按提交时间倒序列出owner可以访问的任务，status和method为空时不过滤
+// 跳过前offset个任务，最多返回limit个，limit为0时使用默认值
+// 列表中不包含完整的执行结果，message为结果信息，完整结果通过job_status查询
+func (m *jobManager) list(owner, status, method string, offset, limit int) []util.JobData {
+	m.lock.Lock()
+	list := make([]util.JobData, 0, len(m.jobs))
+	for _, j := range m.jobs {
+		if !j.visible(owner) {
+			continue
+		}
+		if (status == "" || j.info.Status == status) && (method == "" || j.info.Method == method) {
+			info := j.info
+			if info.Result != nil {
+				info.Message = info.Result.Message
+				info.Result = nil
+			}
+			list = append(list, info)
+		}
+	}
+	m.lock.Unlock()
+	sort.Slice(list, func(a, b int) bool {
+		if list[a].Created != list[b].Created {
+			return list[a].Created > list[b].Created
+		}
+		return list[a].Id > list[b].Id
+	})
+	if limit <= 0 {
+		limit = DEF_JOB_LIST
+	}
+	if limit > MAX_JOB_LIST {
+		limit = MAX_JOB_LIST
+	}
+	if offset > len(list) {
+		offset = len(list)
+	}
+	list = list[offset:]
+	if len(list) > limit {
+		list = list[:limit]
+	}
+	return list
+}
+
+// 取消任务：排队的任务直接取消，正在执行的任务通知业务方法停止
+func (m *jobManager) cancel(id, owner string) (*util.JobData, error) {
+	m.lock.Lock()
+	j, err := m.get(id, owner)
+	if err != nil {
+		m.lock.Unlock()
+		return nil, err
+	}
+	var order *util.OrderData // 排队时取消的任务，释放m.lock后调用结束回调
+	switch j.info.Status {
+	case util.JOB_QUEUED:
+		order = j.order
+		j.order = nil
+		j.info.Status = util.JOB_CANCELED
+		j.info.Finished = time.Now().Unix()
+		m.save()
+	case util.JOB_RUNNING:
+		j.cancel()
+		j.info.Message = "canceling"
+	default:
+		m.lock.Unlock()
+		return nil, util.NewError(util.CODE_CONFLICT, "job "+id+" is already "+j.info.Status)
+	}
+	info := j.info
+	m.lock.Unlock()
+	m.logger.Println("job " + id + " " + info.Method + " cancel")
+	m.finished(&info, order, j)
+	return &info, nil
+}
+
+// 停止接收任务，排队的任务标记为失败，等待正在执行的任务结束
+func (m *jobManager) close() {
+	m.lock.Lock()
+	if m.closed {
+		m.lock.Unlock()
+		return
+	}
+	m.closed = true
+	now := time.Now().Unix()
+	failed := make([]*job, 0)
+	orders := make([]*util.OrderData, 0)
+	for _, j := range m.jobs {
+		if j.info.Status == util.JOB_QUEUED {
+			failed = append(failed, j)
+			orders = append(orders, j.order)
+			j.order = nil
+			j.info.Status = util.JOB_FAILED
+			j.info.Message = "server shutdown"
+			j.info.Finished = now
+		}
+	}
+	m.save()
+	close(m.queue)
+	m.lock.Unlock()
+	for i, j := range failed {
+		info := j.info
+		m.finished(&info, orders[i], j)
+	}
+	m.wg.Wait()
+}
+
+// 开始使用任务状态文件，加载文件中的任务与内存中的任务合并后保存
+func (m *jobManager) attach(file string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.file = file
+	err := m.load()
+	if err != nil {
+		return err
+	}
+	m.save()
+	return nil
+}
+
+// 加载任务状态文件，上次未结束的任务标记为失败，内存中已有的任务不覆盖
+func (m *jobManager) load() error {
+	if m.file == "" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(m.file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return errors.New("Job file read Error: " + err.Error())
+	}
+	list := make([]util.JobData, 0)
+	err = json.Unmarshal(data, &list)
+	if err != nil {
+		return errors.New("Job file json decode Error: " + err.Error())
+	}
+	now := time.Now().Unix()
+	for _, info := range list {
+		if info.Status == util.JOB_QUEUED || info.Status == util.JOB_RUNNING {
+			info.Status = util.JOB_FAILED
+			info.Message = "interrupted by server restart"
+			info.Finished = now
+		}
+		if _, ok := m.jobs[info.Id]; ok {
+			continue
+		}
+		j := new(job)
+		j.info = info
+		m.jobs[info.Id] = j
+	}
+	return nil
+}
+
+// 保存任务状态，清理超过保留时间的已结束任务，调用时需持有m.lock
+func (m *jobManager) save() {
+	expire := time.Now().Add(-m.keep).Unix()
+	list := make([]util.JobData, 0, len(m.jobs))
+	for id, j := range m.jobs {
+		if j.info.Finished > 0 && j.info.Finished < expire {
+			delete(m.jobs, id)
+			continue
+		}
+		list = append(list, j.info)
+	}
+	if m.file == "" {
+		return
+	}
+	data, err := json.Marshal(list)
+	if err == nil {
+		// 先写临时文件再改名，避免写入中断时损坏状态文件
+		err = ioutil.WriteFile(m.file+".tmp", data, 0600)
+	}
+	if err == nil {
+		err = os.Rename(m.file+".tmp", m.file)
+	}
+	if err != nil {
+		m.logger.Println("Job file save Error: " + err.Error())
+	}
+}
+
+// job_status：查询任务状态和结果
+func (m *jobManager) execStatus(ctx context.Context, params interface{}) *util.SendData {
+	send := new(util.SendData)
+	info, err := m.status(params.(*jobIdParams).Id, callerFrom(ctx).scope)
+	if err != nil {
+		return util.ErrorSend(err)
+	}
+	send.Message = info.Status
+	send.Job = info
+	return send
+}
+
+// job_list：分页列出调用者可以访问的任务，可按status和method过滤
+func (m *jobManager) execList(ctx context.Context, params interface{}) *util.SendData {
+	p := params.(*jobListParams)
+	send := new(util.SendData)
+	send.Jobs = m.list(callerFrom(ctx).scope, p.Status, p.Method, p.Offset, p.Limit)
+	send.Message = "job list ok"
+	return send
+}
+
+// job_cancel：取消任务
+func (m *jobManager) execCancel(ctx context.Context, params interface{}) *util.SendData {
+	send := new(util.SendData)
+	info, err := m.cancel(params.(*jobIdParams).Id, callerFrom(ctx).scope)
+	if err != nil {
+		return util.ErrorSend(err)
+	}
+	send.Message = "job cancel ok"
+	send.Job = info
+	return send
+}
+
+// 报告异步任务的执行进度，percent为0-100，不是异步任务时忽略
+// 供耗时较长的业务方法使用
+func JobProgress(ctx context.Context, percent int, msg string) {
+	if f, ok := ctx.Value(jobProgressKey{}).(func(int, string)); ok {
+		f(percent, msg)
+	}
+}
+
+// 生成任务编号
+func newJobId() (string, error) {
+	b := make([]byte, 8)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,131 @@
+// Copyright (c) 2013 Beijing CmsTop Technology Co.,Ltd. (http://www.cmstop.com)
+
+package server
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sfss/util"
+	"testing"
+	"time"
+)
+
+func TestJobCancel1(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "sfss")
+	defer os.RemoveAll(dir)
+	file := dir + "/jobs.json"
+	started := make(chan bool)
+	run := func(ctx context.Context, order *util.OrderData) *util.SendData {
+		started <- true
+		<-ctx.Done()
+		return &util.SendData{Code: util.CODE_ERROR, Message: "canceled"}
+	}
+	logger := log.New(ioutil.Discard, "", 0)
+	m, err := newJobManager(context.Background(), file, 1, 10, time.Hour, run, logger)
+	if err != nil {
+		t.Fatal("newJobManager failed: ", err.Error())
+	}
+	finished := make(chan string, 1)
+	m.finish = func(info *util.JobData, order *util.OrderData, c *caller, start time.Time) {
+		finished <- info.Status + " " + order.Method + " " + c.controller
+	}
+	info, err := m.submit(&util.OrderData{Method: "site_create"}, &caller{scope: "1", controller: "1"})
+	if err != nil || info.Status != util.JOB_QUEUED {
+		t.Fatal("submit failed: ", err)
+	}
+	<-started
+	if _, err = m.cancel(info.Id, "2"); err == nil {
+		t.Error("other controller should not cancel the job")
+	}
+	if _, err = m.cancel(info.Id, "1"); err != nil {
+		t.Error("cancel failed: ", err.Error())
+	}
+	m.close()
+	select {
+	case s := <-finished:
+		if s != util.JOB_CANCELED+" site_create 1" {
+			t.Error("finish hook error: ", s)
+		}
+	default:
+		t.Error("finish hook should be called when the job ends")
+	}
+	info, _ = m.status(info.Id, "1")
+	if info.Status != util.JOB_CANCELED || info.Result == nil {
+		t.Error("job status error: ", info.Status)
+	}
+
+	// 重启后结果不丢失
+	m, err = newJobManager(context.Background(), file, 1, 10, time.Hour, run, logger)
+	if err != nil {
+		t.Fatal("reload failed: ", err.Error())
+	}
+	defer m.close()
+	if list := m.list(CALLER_ADMIN, util.JOB_CANCELED, "", 0, 0); len(list) != 1 || list[0].Id != info.Id {
+		t.Error("job not persisted: ", list)
+	}
+	if _, err = m.status(info.Id, "2"); util.ErrorCode(err) != util.CODE_NOT_FOUND {
+		t.Error("other controller should not see the job: ", err)
+	}
+	if list := m.list("2", "", "", 0, 0); len(list) != 0 {
+		t.Error("other controller should not list the job: ", list)
+	}
+}
+
+func TestJobCancel2(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "sfss")
+	defer os.RemoveAll(dir)
+	started := make(chan bool)
+	run := func(ctx context.Context, order *util.OrderData) *util.SendData {
+		started <- true
+		<-ctx.Done()
+		return &util.SendData{Message: "done anyway"} // 取消时业务已经完成
+	}
+	m, err := newJobManager(context.Background(), dir+"/jobs.json", 1, 10, time.Hour, run, log.New(ioutil.Discard, "", 0))
+	if err != nil {
+		t.Fatal("newJobManager failed: ", err.Error())
+	}
+	info, _ := m.submit(&util.OrderData{Method: "site_create"}, &caller{scope: "1"})
+	<-started
+	m.cancel(info.Id, "1")
+	m.close()
+	info, _ = m.status(info.Id, "1")
+	if info.Status != util.JOB_DONE {
+		t.Error("completed job should be done even if canceled: ", info.Status)
+	}
+}
+
+func TestJobList1(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "sfss")
+	defer os.RemoveAll(dir)
+	m := new(jobManager)
+	m.file = dir + "/jobs.json"
+	m.keep = time.Hour
+	m.logger = log.New(ioutil.Discard, "", 0)
+	m.jobs = make(map[string]*job)
+	for i := 0; i < 30; i++ {
+		j := new(job)
+		j.info.Id = fmt.Sprintf("j%02d", i)
+		j.info.Owner = "1"
+		j.info.Created = int64(i)
+		j.info.Status = util.JOB_DONE
+		j.info.Result = &util.SendData{Message: "ok", Steps: make([]util.StepResult, 10)}
+		m.jobs[j.info.Id] = j
+	}
+	list := m.list("1", "", "", 0, 0)
+	if len(list) != DEF_JOB_LIST || list[0].Id != "j29" {
+		t.Fatal("default limit error: ", len(list))
+	}
+	if list[0].Result != nil || list[0].Message != "ok" {
+		t.Error("list should not include full result: ", list[0])
+	}
+	list = m.list("1", "", "", 25, 10)
+	if len(list) != 5 || list[0].Id != "j04" {
+		t.Error("offset error: ", list)
+	}
+	if list = m.list("1", "", "", 40, 10); len(list) != 0 {
+		t.Error("offset beyond list should be empty: ", list)
+	}
+}
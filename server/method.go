@@ -0,0 +1,143 @@
+// Copyright (c) 2013 Beijing CmsTop Technology Co.,Ltd. (http://www.cmstop.com)
+
+// Provides method registry
+/*
+业务方法注册表
+各子系统（site、db、monitor等）将自己的业务方法注册到服务器，
+clientHandle根据order.Method统一分发，新增业务时不需要修改服务核心代码。
+注册表按服务器类型（节点角色）过滤：当前角色不支持的方法只记录名称，
+调用时返回CODE_UNSUPPORTED，与未定义的方法区分。
+*/
+
+package server
+
+import (
+	"context"
+	"errors"
+	"sfss/util"
+	"sort"
+)
+
+const (
+	SERVER_TYPE_WEB = 1                                // 服务器类型：web服务器
+	SERVER_TYPE_DB  = 2                                // 服务器类型：数据库服务器
+	SERVER_TYPE_ALL = SERVER_TYPE_WEB | SERVER_TYPE_DB // 服务器类型：同时含有web和数据库
+)
+
+// 业务处理函数，ctx在任务被取消或服务停止时取消
+// params为Method.Params返回的参数结构体，已完成校验；方法未声明参数结构体时为map[string]string
+type MethodHandle func(ctx context.Context, params interface{}) (string, error)
+
+// 返回完整响应的处理函数，用于任务查询等需要返回结构化数据的方法
+type MethodExec func(ctx context.Context, params interface{}) *util.SendData
+
+// 回滚准备函数，在业务方法执行前调用，记录执行前的状态
+// 返回的函数用于在批量操作失败时撤销该方法已做的修改
+type MethodUndo func(params interface{}) (func() error, error)
+
+// 业务方法描述
+type Method struct {
+	Name       string             // 方法名称，对应order.Method
+	Fields     []string           // 业务操作数据字段，声明了Params时由参数结构体生成
+	Desc       string             // 方法说明
+	ServerType int                // 方法需要的服务器类型，0表示不限
+	Params     func() interface{} // 返回新的参数结构体指针，字段规则见params.go，为nil时使用字符串map
+	Handle     MethodHandle       // 处理函数
+	Exec       MethodExec         // 完整响应的处理函数，设置时代替Handle，不能用于批量操作
+	Undo       MethodUndo         // 回滚准备函数，为nil表示无法回滚
+	Async      bool               // 是否耗时较长的方法，始终作为异步任务执行
+	Query      bool               // 是否只读的查询方法，不记录审计日志
+}
+
+// 判断指定的服务器类型是否支持该方法
+func (m *Method) supported(serverType int) bool {
+	return m.ServerType == 0 || serverType&m.ServerType == m.ServerType
+}
+
+// 服务器类型对应的角色名称
+var serverRoles = []struct {
+	serverType int
+	name       string
+}{
+	{SERVER_TYPE_WEB, "web"},
+	{SERVER_TYPE_DB, "db"},
+}
+
+// 服务器类型包含的角色名称
+func roleNames(serverType int) []string {
+	names := make([]string, 0, len(serverRoles))
+	for _, r := range serverRoles {
+		if serverType&r.serverType != 0 {
+			names = append(names, r.name)
+		}
+	}
+	return names
+}
+
+// 方法注册表
+type registry struct {
+	serverType  int                // 服务器类型，只注册支持的方法
+	methods     map[string]*Method // 已注册的方法
+	unsupported map[string]int     // 当前服务器类型不支持的方法，及其需要的服务器类型
+}
+
+// 创建一个空的注册表，默认支持全部服务器类型
+func newRegistry() *registry {
+	r := new(registry)
+	r.serverType = SERVER_TYPE_ALL
+	r.methods = make(map[string]*Method)
+	r.unsupported = make(map[string]int)
+	return r
+}
+
+// 注册一个业务方法，同名方法不允许重复注册
+// 当前服务器类型不支持的方法不注册，只记录名称
+func (r *registry) register(m *Method) error {
+	if m == nil || m.Name == "" {
+		return errors.New("method name is empty")
+	}
+	if m.Handle == nil && m.Exec == nil {
+		return errors.New("method " + m.Name + " handle is nil")
+	}
+	if _, ok := r.methods[m.Name]; ok {
+		return errors.New("method " + m.Name + " already registered")
+	}
+	if _, ok := r.unsupported[m.Name]; ok {
+		return errors.New("method " + m.Name + " already registered")
+	}
+	if !m.supported(r.serverType) {
+		r.unsupported[m.Name] = m.ServerType
+		return nil
+	}
+	if m.Params != nil && m.Fields == nil {
+		m.Fields = paramFields(m.Params())
+	}
+	r.methods[m.Name] = m
+	return nil
+}
+
+// 获取一个业务方法
+func (r *registry) get(name string) (*Method, bool) {
+	m, ok := r.methods[name]
+	return m, ok
+}
+
+// 判断是否当前服务器类型不支持的方法，返回方法需要的服务器类型
+func (r *registry) role(name string) (int, bool) {
+	serverType, ok := r.unsupported[name]
+	return serverType, ok
+}
+
+// 按名称顺序返回所有已注册的方法
+func (r *registry) list() []*Method {
+	names := make([]string, 0, len(r.methods))
+	for name := range r.methods {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	list := make([]*Method, 0, len(names))
+	for _, name := range names {
+		list = append(list, r.methods[name])
+	}
+	return list
+}
@@ -0,0 +1,60 @@
+// Copyright (c) 2013 Beijing CmsTop Technology Co.,Ltd. (http://www.cmstop.com)
+
+package server
+
+import (
+	"sfss/util"
+	"strings"
+	"testing"
+)
+
+func TestRegistry1(t *testing.T) {
+	r := newRegistry()
+	m := &Method{Name: "empty", ServerType: SERVER_TYPE_WEB, Handle: new(Serve).empty}
+	if err := r.register(m); err != nil {
+		t.Error("register failed: ", err.Error())
+	}
+	if err := r.register(m); err == nil {
+		t.Error("duplicate register should fail")
+	}
+	if _, ok := r.get("empty"); !ok {
+		t.Error("method empty not found")
+	}
+	if len(r.list()) != 1 {
+		t.Error("registry list error!")
+	}
+}
+
+func TestMethodSupported1(t *testing.T) {
+	m := &Method{Name: "db_create", ServerType: SERVER_TYPE_DB}
+	if m.supported(SERVER_TYPE_WEB) {
+		t.Error("db method should not be supported on web server")
+	}
+	if !m.supported(SERVER_TYPE_ALL) {
+		t.Error("db method should be supported on web & db server")
+	}
+}
+
+func TestRegistryRole1(t *testing.T) {
+	s := testServe()
+	s.serverType = SERVER_TYPE_WEB
+	s.methods.serverType = SERVER_TYPE_WEB
+	var d *db
+	if err := d.register(s.methods); err != nil {
+		t.Fatal("register failed: ", err.Error())
+	}
+	if _, ok := s.methods.get("db_create"); ok {
+		t.Error("db method should not be registered on web server")
+	}
+	_, err := s.method("db_create")
+	if util.ErrorCode(err) != util.CODE_UNSUPPORTED || !strings.Contains(err.Error(), "node role") {
+		t.Error("db method should be unsupported on web server: ", err)
+	}
+	if _, err = s.method("no_such_method"); util.ErrorCode(err) != util.CODE_NOT_FOUND {
+		t.Error("undefined method should be not found: ", err)
+	}
+	roles := s.initTest().Data["roles"].([]string)
+	if len(roles) != 1 || roles[0] != "web" {
+		t.Error("init_test roles mismatch: ", roles)
+	}
+}
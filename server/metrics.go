@@ -0,0 +1,158 @@
+// Copyright (c) 2013 Beijing CmsTop Technology Co.,Ltd. (http://www.cmstop.com)
+
+// Provides metrics endpoint
+/*
+监控指标接口
+开启[metrics]后在单独的HTTP端口提供 GET /metrics，输出Prometheus文本格式的指标：
+	nfss_requests_total                    每个方法的请求数
+	nfss_request_errors_total              每个方法按状态码统计的失败请求数
+	nfss_request_duration_seconds          每个方法的处理耗时
+	nfss_nginx_reloads_total               Nginx重载次数
+	nfss_nginx_reload_failures_total       Nginx重载失败次数
+	nfss_nginx_reload_duration_seconds     Nginx重载耗时
+	nfss_mysql_duration_seconds            每种MySQL调用的耗时
+	nfss_connections_active                正在处理的连接数
+	nfss_sites                             管理的站点数，即Nginx配置目录中的站点配置文件数
+	nfss_databases                         管理的数据库数，不包括系统数据库
+未注册的方法统计为unknown，避免任意方法名产生大量指标。
+接口不加密也不认证，应当只监听内网地址。
+*/
+
+package server
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"path/filepath"
+	"sfss/util"
+	"strconv"
+	"time"
+)
+
+const (
+	DEF_METRICS_HOST = "127.0.0.1" // 默认监控指标接口地址
+	DEF_METRICS_PORT = "9469"      // 默认监控指标接口端口号
+	METRICS_PATH     = "/metrics"  // 监控指标路径
+)
+
+// 监控指标接口
+type metricsServer struct {
+	metrics *util.Metrics // 监控指标
+	listen  net.Listener  // 服务监听接口，平滑重启时传给新进程
+	srv     *http.Server  // HTTP服务
+}
+
+// 创建监控指标接口，未开启时返回nil
+// 开启后设置SFSS.Metrics，各组件开始记录指标
+func newMetricsServer(s *util.SFSS) (*metricsServer, error) {
+	enable, _ := s.Conf.GetBool("metrics", "enable")
+	if !enable {
+		return nil, nil
+	}
+	host, _ := s.Conf.GetString("metrics", "listen")
+	port, _ := s.Conf.GetString("metrics", "port")
+	if host == "" {
+		host = DEF_METRICS_HOST
+	}
+	if port == "" {
+		port = DEF_METRICS_PORT
+	}
+	listener, err := listen(LISTEN_METRICS, "tcp4", host+":"+port)
+	if err != nil {
+		return nil, err
+	}
+	m := new(metricsServer)
+	m.metrics = util.NewMetrics()
+	m.listen = listener
+	mux := http.NewServeMux()
+	mux.Handle(METRICS_PATH, m)
+	m.srv = &http.Server{Handler: mux, ReadTimeout: DEF_READ_TIMEOUT * time.Second}
+	s.Metrics = m.metrics
+	return m, nil
+}
+
+// 开始服务
+func (m *metricsServer) serve(logger *util.Logger) {
+	logger.Info("SFSS metrics begin serve.")
+	err := m.srv.Serve(m.listen)
+	if err != nil && err != http.ErrServerClosed {
+		logger.Error("SFSS metrics Error: " + err.Error())
+	}
+}
+
+// 停止服务
+func (m *metricsServer) close(ctx context.Context) {
+	err := m.srv.Shutdown(ctx)
+	if err != nil {
+		m.srv.Close()
+	}
+}
+
+func (m *metricsServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.metrics.Write(w)
+}
+
+// 注册采集时计算的指标
+func (s *Serve) metricsGauges() {
+	metrics := s.main.Metrics
+	metrics.GaugeFunc("nfss_connections_active", "Number of connections being served.", func() (float64, error) {
+		return float64(s.main.ConnNum()), nil
+	})
+	if s.site != nil {
+		metrics.GaugeFunc("nfss_sites", "Number of sites managed.", func() (float64, error) {
+			files, err := filepath.Glob(s.site.getConf().nginxConfDir + "*.conf")
+			return float64(len(files)), err
+		})
+	}
+	if s.db != nil {
+		metrics.GaugeFunc("nfss_databases", "Number of databases managed.", func() (float64, error) {
+			n, err := s.db.getConn().CountDbs()
+			return float64(n), err
+		})
+	}
+}
+
+// 记录业务请求的指标
+func (s *Serve) orderMetrics(order *util.OrderData, send *util.SendData, d time.Duration) {
+	metrics := s.main.Metrics
+	if metrics == nil {
+		return
+	}
+	method := order.Method
+	if _, ok := s.methods.get(method); !ok && method != METHOD_BATCH {
+		method = "unknown"
+	}
+	metrics.Counter("nfss_requests_total", "Total requests by method.", "method").Inc(method)
+	if send.Code != util.CODE_OK {
+		metrics.Counter("nfss_request_errors_total", "Failed requests by method and code.", "method", "code").
+			Inc(method, strconv.Itoa(send.Code))
+	}
+	metrics.Histogram("nfss_request_duration_seconds", "Request latency by method.", nil, "method").
+		Observe(d.Seconds(), method)
+}
+
+// 记录Nginx重载的指标
+func nginxMetrics(metrics *util.Metrics, err error, d time.Duration) {
+	metrics.Counter("nfss_nginx_reloads_total", "Total nginx reloads.").Inc()
+	if err != nil {
+		metrics.Counter("nfss_nginx_reload_failures_total", "Failed nginx reloads.").Inc()
+	}
+	metrics.Histogram("nfss_nginx_reload_duration_seconds", "Nginx reload latency.", nil).Observe(d.Seconds())
+}
+
+// MySQL调用耗时的回调
+func mysqlObserver(metrics *util.Metrics) func(op string, d time.Duration) {
+	if metrics == nil {
+		return nil
+	}
+	h := metrics.Histogram("nfss_mysql_duration_seconds", "MySQL call latency by operation.", nil, "op")
+	return func(op string, d time.Duration) {
+		h.Observe(d.Seconds(), op)
+	}
+}
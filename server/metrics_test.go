@@ -0,0 +1,29 @@
+// Copyright (c) 2013 Beijing CmsTop Technology Co.,Ltd. (http://www.cmstop.com)
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"sfss/util"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestOrderMetrics1(t *testing.T) {
+	s := testServe()
+	s.main.Metrics = util.NewMetrics()
+	s.methods.register(&Method{Name: "site_pause", Exec: func(ctx context.Context, params interface{}) *util.SendData { return nil }})
+	s.orderMetrics(&util.OrderData{Method: "site_pause"}, &util.SendData{Code: util.CODE_NOT_FOUND}, time.Millisecond)
+	s.orderMetrics(&util.OrderData{Method: "no_such_method"}, &util.SendData{Code: util.CODE_NOT_FOUND}, time.Millisecond)
+	var b bytes.Buffer
+	s.main.Metrics.Write(&b)
+	out := b.String()
+	if !strings.Contains(out, `nfss_request_errors_total{method="site_pause",code="5"} 1`) {
+		t.Error("error counter mismatch: ", out)
+	}
+	if !strings.Contains(out, `nfss_requests_total{method="unknown"} 1`) {
+		t.Error("undefined method should be counted as unknown: ", out)
+	}
+}
@@ -0,0 +1,323 @@
+// Copyright (c) 2013 Beijing CmsTop Technology Co.,Ltd. (http://www.cmstop.com)
+
+// Provides order processing
+/*
+业务请求处理
+与传输方式无关的请求处理流程：认证控制端、解密、重放检测、权限检测、执行业务方法，
+以及按协议版本加密响应。TCP和HTTP接口共用这些处理。
+*/
+
+package server
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"sfss/util"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 请求来源
+type origin struct {
+	remote string            // 客户端地址
+	cert   *x509.Certificate // TLS客户端证书，没有时为nil
+}
+
+const (
+	CALLER_ADMIN = "admin" // 本地管理接口的调用者，可以查看和取消所有控制端的任务
+)
+
+// 调用者在context中的键
+type callerKey struct{}
+
+// 请求的调用者
+type caller struct {
+	scope      string // 幂等键的作用范围，控制端编号，本地管理接口为admin
+	controller string // 控制端标识，用于审计日志
+	remote     string // 请求来源，用于审计日志
+	auditAll   bool   // 是否可以查询所有控制端的审计记录
+}
+
+// 控制端请求的调用者
+func (s *Serve) newCaller(receive *util.ReceiveData, from *origin) *caller {
+	c := new(caller)
+	c.scope = strconv.Itoa(receive.Serverid)
+	c.controller = c.scope
+	if ctrl, err := s.getCtrls().get(receive.Serverid); err == nil {
+		c.controller = ctrl.String()
+		c.auditAll = ctrl.explicit(PERM_AUDIT_ALL)
+	}
+	c.remote = from.String()
+	return c
+}
+
+// 获取context中的调用者，没有时返回空的调用者
+func callerFrom(ctx context.Context) *caller {
+	if c, ok := ctx.Value(callerKey{}).(*caller); ok {
+		return c
+	}
+	return new(caller)
+}
+
+// 请求来源标识，用于日志
+func (o *origin) String() string {
+	if o.cert == nil {
+		return o.remote
+	}
+	return o.remote + " [" + o.cert.Subject.String() + "]"
+}
+
+// 认证并解析请求，from为请求来源
+// method不为空时请求只能调用该方法，请求未指定方法时使用该方法
+// 失败时返回响应状态码和错误信息，错误已记录日志
+// 被拒绝的请求记录审计日志，见auditReject
+func (s *Serve) orderOpen(receive *util.ReceiveData, from *origin, method string) (_ *util.OrderData, code int, err error) {
+	var order *util.OrderData // 解密后的请求，解密失败时为nil
+	defer func() {
+		if err != nil {
+			s.auditReject(receive, from, order, method, code, err)
+		}
+	}()
+	var err2 string
+	logger := s.main.Log.With(util.LogFields{"serverid": receive.Serverid, "remote": from.String()})
+	// 查找控制端
+	ctrl, err := s.getCtrls().get(receive.Serverid)
+	if err != nil {
+		err2 = "ReceiveData auth Error: " + err.Error() + ", from " + from.String()
+		logger.Warn(err2)
+		return nil, util.CODE_AUTH, errors.New(err2)
+	}
+	// 检测客户端证书与控制端是否一致
+	if !ctrl.verify(from.cert) {
+		err2 = "ReceiveData auth Error: client certificate mismatch controller " + ctrl.String() + ", from " + from.String()
+		logger.Warn(err2)
+		return nil, util.CODE_AUTH, errors.New(err2)
+	}
+	// 解密数据
+	data, err := ctrl.crypt.open(receive)
+	if err != nil {
+		err2 = "ReceiveData AES decrypt Error: " + err.Error()
+		logger.Warn(err2)
+		return nil, util.CODE_ERROR, errors.New(err2)
+	}
+	order = new(util.OrderData)
+	err = json.Unmarshal(data, order)
+	if err != nil {
+		err2 = "OrderData json decode Error: " + err.Error()
+		logger.Warn(err2)
+		return nil, util.CODE_ERROR, errors.New(err2)
+	}
+	if method != "" {
+		if order.Method == "" {
+			order.Method = method
+		} else if order.Method != method {
+			err2 = "OrderData method " + order.Method + " mismatch " + method
+			logger.Warn(err2)
+			return nil, util.CODE_ERROR, errors.New(err2)
+		}
+	}
+	// 重放检测
+	if s.replay != nil {
+		err = s.replay.Check(order.Nonce, order.Time)
+		if err != nil {
+			err2 = "OrderData replay check Error: " + err.Error()
+			logger.Warn(err2)
+			if err == util.ErrReplayFull {
+				return nil, util.CODE_UNAVAILABLE, errors.New(err2) // 稍后重试
+			}
+			return nil, util.CODE_REPLAY, errors.New(err2)
+		}
+	}
+	// 记录控制端并检测方法权限
+	logger.Info("order "+order.Method+" from controller "+ctrl.String()+", "+from.String(), util.LogFields{"method": order.Method})
+	if !ctrl.allowed(order.Method) {
+		err2 = "method " + order.Method + " not allowed for controller " + ctrl.String()
+		logger.Warn(err2)
+		return nil, util.CODE_AUTH, errors.New(err2)
+	}
+	// 批量操作的每个子操作都需要权限
+	for _, sub := range order.Orders {
+		if sub.Method == METHOD_BATCH || !ctrl.allowed(sub.Method) {
+			err2 = "batch method " + sub.Method + " not allowed for controller " + ctrl.String()
+			logger.Warn(err2)
+			return nil, util.CODE_AUTH, errors.New(err2)
+		}
+	}
+	return order, util.CODE_OK, nil
+}
+
+// 执行业务方法，耗时较长的方法和指定async的请求作为异步任务提交
+// 幂等键的作用范围为c.scope，不同控制端的幂等键互不影响
+// 执行结果记录日志和监控指标，控制操作同时记录审计日志
+func (s *Serve) orderExec(ctx context.Context, c *caller, order *util.OrderData) (send *util.SendData) {
+	start := time.Now()
+	defer func() {
+		s.orderLog(c.scope, order, send, time.Since(start))
+		s.orderMetrics(order, send, time.Since(start))
+		s.auditRecord(c, order, send, start)
+	}()
+	var key string
+	if s.idem != nil && order.IdempotencyKey != "" && s.mutating(order) {
+		key = c.scope + ":" + order.IdempotencyKey
+		send, err := s.idem.Begin(key, util.OrderDigest(order))
+		if err != nil {
+			s.main.Logger.Println("order " + order.Method + " idempotency Error: " + err.Error())
+			code := util.CODE_CONFLICT
+			if err == util.ErrIdemKeyIllegal {
+				code = util.CODE_VALIDATION
+			}
+			return util.ErrorSend(util.NewError(code, "idempotency Error: "+err.Error()))
+		}
+		if send != nil {
+			s.main.Logger.Println("order " + order.Method + " idempotency key " + order.IdempotencyKey + " retried, return recorded result")
+			return send
+		}
+	}
+	ctx = context.WithValue(ctx, callerKey{}, c)
+	if s.jobs != nil && s.async(order) {
+		info, err := s.jobs.submit(order, c)
+		if err != nil {
+			s.main.Logger.Println("job submit Error: " + err.Error())
+			if key != "" {
+				s.idem.Abort(key) // 任务未提交，允许重试
+			}
+			return util.ErrorSend(err)
+		}
+		send = new(util.SendData)
+		send.Message = "job queued"
+		send.Job = info
+	} else {
+		send = s.orderRun(ctx, order)
+	}
+	if key != "" {
+		if util.Retryable(send.Code) {
+			s.idem.Abort(key) // 临时错误不记录结果，允许使用同一个幂等键重试
+			return send
+		}
+		err := s.idem.Finish(key, send)
+		if err != nil {
+			s.main.Log.Error("idempotency finish Error: " + err.Error())
+		}
+	}
+	return send
+}
+
+// 记录业务请求的执行结果，失败的请求按错误类型记为warn或error
+func (s *Serve) orderLog(scope string, order *util.OrderData, send *util.SendData, d time.Duration) {
+	fields := util.LogFields{
+		"method":      order.Method,
+		"serverid":    scope,
+		"code":        send.Code,
+		"duration_ms": int64(d / time.Millisecond),
+	}
+	for _, key := range []string{"domain", "name"} {
+		if v, ok := order.Data[key]; ok {
+			fields[key] = v
+		}
+	}
+	if send.Job != nil {
+		fields["job"] = send.Job.Id
+	}
+	level := util.LOG_INFO
+	switch send.Code {
+	case util.CODE_OK:
+	case util.CODE_INTERNAL, util.CODE_UNAVAILABLE:
+		level = util.LOG_ERROR
+	default:
+		level = util.LOG_WARN
+	}
+	s.main.Log.Output(level, "order "+order.Method+": "+send.Message, fields)
+}
+
+// 判断是否修改数据的业务方法，查询方法不记录幂等键
+func (s *Serve) mutating(order *util.OrderData) bool {
+	if order.Method == METHOD_BATCH {
+		return true
+	}
+	m, ok := s.methods.get(order.Method)
+	return ok && m.Exec == nil
+}
+
+// 判断请求是否作为异步任务执行
+func (s *Serve) async(order *util.OrderData) bool {
+	if order.Method == METHOD_BATCH {
+		return order.Async
+	}
+	m, ok := s.methods.get(order.Method)
+	if !ok || m.Exec != nil {
+		return false
+	}
+	return order.Async || m.Async
+}
+
+// 同步执行业务方法
+func (s *Serve) orderRun(ctx context.Context, order *util.OrderData) *util.SendData {
+	if order.Method == METHOD_BATCH {
+		return s.batchExec(ctx, order)
+	}
+	var params interface{}
+	m, err := s.method(order.Method)
+	if err == nil {
+		params, err = decodeParams(m, order.Data)
+	}
+	if err == nil && m.Exec != nil {
+		return m.Exec(ctx, params)
+	}
+	var result string
+	if err == nil {
+		result, err = m.Handle(ctx, params)
+	}
+	if err != nil {
+		s.main.Log.Debug("handel method "+order.Method+" Error: "+err.Error(), util.LogFields{"method": order.Method})
+		return util.ErrorSend(err)
+	}
+	send := new(util.SendData)
+	send.Message = result
+	return send
+}
+
+// 查找当前服务器支持的业务方法
+func (s *Serve) method(name string) (*Method, error) {
+	m, ok := s.methods.get(name)
+	if ok {
+		return m, nil
+	}
+	if serverType, ok := s.methods.role(name); ok {
+		return nil, util.NewError(util.CODE_UNSUPPORTED, "method "+name+" not supported on this node role, requires "+
+			strings.Join(roleNames(serverType), "+")+" role, enabled roles: "+strings.Join(roleNames(s.serverType), "+"))
+	}
+	return nil, util.NewError(util.CODE_NOT_FOUND, "method "+name+" undefined")
+}
+
+// 按协议版本加密响应，格式与请求相同
+// receive为nil表示请求无法解析，使用默认控制端的密钥；无法加密时返回原响应
+func (s *Serve) seal(receive *util.ReceiveData, version int, send interface{}) interface{} {
+	if version < util.PROTOCOL_V3 {
+		return send
+	}
+	ctrls := s.getCtrls()
+	ctrl := ctrls.def
+	envelope := new(util.ReceiveData)
+	if receive != nil {
+		ctrl, _ = ctrls.get(receive.Serverid)
+		envelope.Serverid = receive.Serverid
+		envelope.Id = receive.Id
+		envelope.Keyid = receive.Keyid
+	}
+	envelope.Version = version
+	if ctrl == nil {
+		return send // 未知的控制端，无法加密
+	}
+	data, err := json.Marshal(send)
+	if err == nil {
+		err = ctrl.crypt.seal(data, envelope)
+	}
+	if err != nil {
+		s.main.Log.Error("SendData AES encrypt Error: " + err.Error())
+		return send
+	}
+	return envelope
+}
@@ -0,0 +1,40 @@
+// Copyright (c) 2013 Beijing CmsTop Technology Co.,Ltd. (http://www.cmstop.com)
+
+package server
+
+import (
+	"context"
+	"sfss/util"
+	"testing"
+	"time"
+)
+
+func TestOrderIdem1(t *testing.T) {
+	s := testServe()
+	s.idem, _ = util.NewIdemCache("", time.Hour)
+	calls := 0
+	s.Register(&Method{
+		Name:   "fake_create",
+		Params: func() interface{} { return new(fakeParams) },
+		Handle: func(ctx context.Context, params interface{}) (string, error) {
+			calls++
+			if calls == 1 {
+				return "", util.NewError(util.CODE_UNAVAILABLE, "mysql gone away")
+			}
+			return "ok", nil
+		},
+	})
+	order := &util.OrderData{Method: "fake_create", Data: map[string]interface{}{"name": "a"}, IdempotencyKey: "k1"}
+	c := &caller{scope: "1"}
+	// 临时错误不记录结果，重试时重新执行
+	if send := s.orderExec(context.Background(), c, order); send.Code != util.CODE_UNAVAILABLE {
+		t.Fatal("first call should fail: ", send)
+	}
+	if send := s.orderExec(context.Background(), c, order); send.Code != util.CODE_OK {
+		t.Fatal("retry should be executed: ", send)
+	}
+	// 最终结果记录后不再执行
+	if send := s.orderExec(context.Background(), c, order); send.Code != util.CODE_OK || calls != 2 {
+		t.Error("retry should return recorded result: ", send, calls)
+	}
+}
@@ -0,0 +1,331 @@
+// Copyright (c) 2013 Beijing CmsTop Technology Co.,Ltd. (http://www.cmstop.com)
+
+// Provides typed order params
+/*
+业务参数
+每个业务方法声明自己的参数结构体（Method.Params），字段使用json标签指定名称，check标签指定校验规则：
+	required       必填，不能为空
+	domain         域名，允许通配符开头，如*.9466.cn
+	name           数据库名称或帐号，只能包含字母、数字和下划线
+	host           数据库帐号主机，如localhost、%、192.168.1.%
+	path           相对路径，不能以/开头，不能包含..
+	password       密码，不能包含空白、引号和反斜线
+	range=min-max  数字范围，min或max可以省略
+	len=min-max    字符串长度范围，min或max可以省略
+	enum=a|b|c     枚举值
+字段类型支持string、int、int64、bool和[]string，列表字段的规则对每个元素校验。
+为兼容旧版控制端，所有字段都接受字符串：数字字段接受"100"，布尔字段接受"true"、"1"，
+列表字段接受逗号或空格分隔的字符串。业务数据中未声明的字段忽略。
+校验失败时返回CODE_VALIDATION错误，details.fields包含每个字段的错误信息。
+*/
+
+package server
+
+import (
+	"reflect"
+	"regexp"
+	"sfss/util"
+	"strconv"
+	"strings"
+)
+
+var (
+	regDomain   = regexp.MustCompile(`^(\*\.)?([a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?\.)+[a-z][a-z0-9-]{0,62}$`)
+	regName     = regexp.MustCompile(`^[A-Za-z0-9_]{1,64}$`)
+	regHost     = regexp.MustCompile(`^[A-Za-z0-9.%_:-]{1,60}$`)
+	regPath     = regexp.MustCompile(`^[A-Za-z0-9._-]+(/[A-Za-z0-9._-]+)*$`)
+	regPassword = regexp.MustCompile(`^[\x21-\x7e]{1,64}$`)
+)
+
+// 解析业务参数：方法声明了参数结构体时解码并校验，否则转换为旧版的字符串map
+func decodeParams(m *Method, data map[string]interface{}) (interface{}, error) {
+	if m.Params == nil {
+		return legacyData(data), nil
+	}
+	p := m.Params()
+	err := decodeStruct(data, p)
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// 将业务数据解码到参数结构体v（指针），并按check标签校验
+func decodeStruct(data map[string]interface{}, v interface{}) error {
+	fields := make([]util.FieldError, 0)
+	rv := reflect.ValueOf(v).Elem()
+	rt := rv.Type()
+	for i := 0; i < rt.NumField(); i++ {
+		sf := rt.Field(i)
+		name := paramName(sf)
+		if name == "" {
+			continue
+		}
+		rules := strings.Split(sf.Tag.Get("check"), ",")
+		raw, present := data[name]
+		if s, ok := raw.(string); raw == nil || ok && strings.TrimSpace(s) == "" {
+			present = false
+		}
+		if !present {
+			if hasRule(rules, "required") {
+				fields = append(fields, util.FieldError{Field: name, Message: "is empty"})
+			}
+			continue
+		}
+		msg := setField(rv.Field(i), raw)
+		if msg == "" {
+			msg = checkField(rv.Field(i), rules)
+		}
+		if msg != "" {
+			fields = append(fields, util.FieldError{Field: name, Message: msg})
+		}
+	}
+	if len(fields) == 0 {
+		return nil
+	}
+	msgs := make([]string, 0, len(fields))
+	for _, f := range fields {
+		msgs = append(msgs, f.Field+" "+f.Message)
+	}
+	e := util.NewError(util.CODE_VALIDATION, "params Error: "+strings.Join(msgs, "; "))
+	e.Details = &util.ErrorDetails{Fields: fields}
+	return e
+}
+
+// 参数字段名称，取json标签，没有时为小写的字段名
+func paramName(sf reflect.StructField) string {
+	if sf.PkgPath != "" && !sf.Anonymous {
+		return "" // 未导出的字段
+	}
+	name := strings.Split(sf.Tag.Get("json"), ",")[0]
+	if name == "-" {
+		return ""
+	}
+	if name == "" {
+		name = strings.ToLower(sf.Name)
+	}
+	return name
+}
+
+// 判断规则列表中是否有指定规则
+func hasRule(rules []string, rule string) bool {
+	for _, r := range rules {
+		if r == rule {
+			return true
+		}
+	}
+	return false
+}
+
+// 按字段类型设置字段值，失败时返回错误信息
+func setField(f reflect.Value, raw interface{}) string {
+	switch f.Kind() {
+	case reflect.String:
+		switch v := raw.(type) {
+		case string:
+			f.SetString(strings.TrimSpace(v))
+		case float64:
+			f.SetString(strconv.FormatFloat(v, 'f', -1, 64))
+		case bool:
+			f.SetString(strconv.FormatBool(v))
+		default:
+			return "should be a string"
+		}
+	case reflect.Int, reflect.Int64:
+		var n int64
+		switch v := raw.(type) {
+		case float64:
+			if v != float64(int64(v)) {
+				return "should be an integer"
+			}
+			n = int64(v)
+		case string:
+			var err error
+			n, err = strconv.ParseInt(strings.TrimSpace(v), 10, 64)
+			if err != nil {
+				return "should be an integer"
+			}
+		default:
+			return "should be an integer"
+		}
+		f.SetInt(n)
+	case reflect.Bool:
+		switch v := raw.(type) {
+		case bool:
+			f.SetBool(v)
+		case string:
+			b, err := strconv.ParseBool(strings.TrimSpace(v))
+			if err != nil {
+				return "should be a boolean"
+			}
+			f.SetBool(b)
+		default:
+			return "should be a boolean"
+		}
+	case reflect.Slice:
+		list := make([]string, 0)
+		switch v := raw.(type) {
+		case string:
+			list = strings.FieldsFunc(v, func(r rune) bool {
+				return r == ',' || r == ' ' || r == '\t'
+			})
+		case []interface{}:
+			for _, item := range v {
+				s, ok := item.(string)
+				if !ok {
+					return "should be a list of strings"
+				}
+				list = append(list, strings.TrimSpace(s))
+			}
+		default:
+			return "should be a list of strings"
+		}
+		f.Set(reflect.ValueOf(list))
+	default:
+		return "unsupported field type " + f.Kind().String()
+	}
+	return ""
+}
+
+// 按规则校验字段值，失败时返回错误信息
+func checkField(f reflect.Value, rules []string) string {
+	if f.Kind() == reflect.Slice {
+		for i := 0; i < f.Len(); i++ {
+			if msg := checkValue(f.Index(i), rules); msg != "" {
+				return "item " + strconv.Itoa(i+1) + " " + msg
+			}
+		}
+		return ""
+	}
+	return checkValue(f, rules)
+}
+
+// 校验一个值
+func checkValue(f reflect.Value, rules []string) string {
+	for _, rule := range rules {
+		arg := ""
+		if i := strings.Index(rule, "="); i >= 0 {
+			rule, arg = rule[:i], rule[i+1:]
+		}
+		switch rule {
+		case "domain":
+			if v := f.String(); len(v) > 253 || !regDomain.MatchString(strings.ToLower(v)) {
+				return "is not a valid domain"
+			}
+		case "name":
+			if !regName.MatchString(f.String()) {
+				return "should only contain letters, digits and underscore"
+			}
+		case "host":
+			if !regHost.MatchString(f.String()) {
+				return "is not a valid host"
+			}
+		case "path":
+			if v := f.String(); !regPath.MatchString(v) || strings.Contains("/"+v+"/", "/../") || strings.Contains("/"+v+"/", "/./") {
+				return "is not a valid relative path"
+			}
+		case "password":
+			if v := f.String(); !regPassword.MatchString(v) || strings.ContainsAny(v, "'\"`\\") {
+				return "should be 1-64 printable characters without quotes or backslash"
+			}
+		case "range":
+			if !inRange(f.Int(), arg) {
+				return "should be in range " + arg
+			}
+		case "len":
+			if !inRange(int64(len(f.String())), arg) {
+				return "length should be in range " + arg
+			}
+		case "enum":
+			if !hasRule(strings.Split(arg, "|"), f.String()) {
+				return "should be one of " + arg
+			}
+		}
+	}
+	return ""
+}
+
+// 判断数字是否在min-max范围内
+func inRange(n int64, arg string) bool {
+	bounds := strings.SplitN(arg, "-", 2)
+	if bounds[0] != "" {
+		min, err := strconv.ParseInt(bounds[0], 10, 64)
+		if err == nil && n < min {
+			return false
+		}
+	}
+	if len(bounds) == 2 && bounds[1] != "" {
+		max, err := strconv.ParseInt(bounds[1], 10, 64)
+		if err == nil && n > max {
+			return false
+		}
+	}
+	return true
+}
+
+// 参数结构体的字段名称列表
+func paramFields(p interface{}) []string {
+	rt := reflect.TypeOf(p).Elem()
+	fields := make([]string, 0, rt.NumField())
+	for i := 0; i < rt.NumField(); i++ {
+		if name := paramName(rt.Field(i)); name != "" {
+			fields = append(fields, name)
+		}
+	}
+	return fields
+}
+
+// 参数结构体的字段说明，用于init_test
+func paramSchema(p interface{}) []map[string]string {
+	rt := reflect.TypeOf(p).Elem()
+	schema := make([]map[string]string, 0, rt.NumField())
+	for i := 0; i < rt.NumField(); i++ {
+		sf := rt.Field(i)
+		name := paramName(sf)
+		if name == "" {
+			continue
+		}
+		typ := "string"
+		switch sf.Type.Kind() {
+		case reflect.Int, reflect.Int64:
+			typ = "int"
+		case reflect.Bool:
+			typ = "bool"
+		case reflect.Slice:
+			typ = "list"
+		}
+		schema = append(schema, map[string]string{"name": name, "type": typ, "check": sf.Tag.Get("check")})
+	}
+	return schema
+}
+
+// 将业务数据转换为旧版的字符串map，列表以逗号连接
+func legacyData(data map[string]interface{}) map[string]string {
+	m := make(map[string]string, len(data))
+	for k, v := range data {
+		list, ok := v.([]interface{})
+		if !ok {
+			m[k] = legacyValue(v)
+			continue
+		}
+		items := make([]string, 0, len(list))
+		for _, item := range list {
+			items = append(items, legacyValue(item))
+		}
+		m[k] = strings.Join(items, ",")
+	}
+	return m
+}
+
+// 将单个值转换为字符串
+func legacyValue(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(v)
+	}
+	return ""
+}
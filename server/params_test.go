@@ -0,0 +1,64 @@
+// Copyright (c) 2013 Beijing CmsTop Technology Co.,Ltd. (http://www.cmstop.com)
+
+package server
+
+import (
+	"encoding/json"
+	"sfss/util"
+	"testing"
+)
+
+func TestDecodeParams1(t *testing.T) {
+	// 旧版控制端的字符串数据
+	data := map[string]interface{}{
+		"siteid": "1", "domain": "a.9466.cn", "alias": "b.9466.cn,c.9466.cn",
+		"root": "a.9466.cn", "connections": "100", "bandwidth": "1024",
+	}
+	p := new(siteParams)
+	if err := decodeStruct(data, p); err != nil {
+		t.Fatal("legacy data decode failed: ", err.Error())
+	}
+	if p.Siteid != 1 || p.Connections != 100 || len(p.Alias) != 2 || p.Alias[1] != "c.9466.cn" {
+		t.Error("legacy data decode error: ", p)
+	}
+
+	// 带类型的数据
+	err := json.Unmarshal([]byte(`{"siteid":2,"domain":"a.9466.cn","alias":["b.9466.cn"],"root":"a","connections":10,"bandwidth":10}`), &data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p = new(siteParams)
+	if err = decodeStruct(data, p); err != nil || p.Siteid != 2 || p.Alias[0] != "b.9466.cn" {
+		t.Error("typed data decode error: ", err)
+	}
+}
+
+func TestDecodeParams2(t *testing.T) {
+	data := map[string]interface{}{
+		"siteid": "x", "domain": "a b.cn", "alias": "", "root": "../etc", "connections": "0",
+	}
+	err := decodeStruct(data, new(siteParams))
+	perr, ok := err.(*util.Error)
+	if !ok || perr.Code != util.CODE_VALIDATION || perr.Details == nil {
+		t.Fatal("should return validation Error with details")
+	}
+	fields := make(map[string]bool)
+	for _, f := range perr.Details.Fields {
+		fields[f.Field] = true
+	}
+	for _, name := range []string{"siteid", "domain", "root", "connections", "bandwidth"} {
+		if !fields[name] {
+			t.Error("field " + name + " should be rejected")
+		}
+	}
+	if fields["alias"] {
+		t.Error("empty alias should be accepted")
+	}
+}
+
+func TestLegacyData1(t *testing.T) {
+	m := legacyData(map[string]interface{}{"a": "x", "b": float64(100), "c": []interface{}{"d", "e"}, "f": true})
+	if m["a"] != "x" || m["b"] != "100" || m["c"] != "d,e" || m["f"] != "true" {
+		t.Error("legacy data convert error: ", m)
+	}
+}
@@ -0,0 +1,186 @@
+// Copyright (c) 2013 Beijing CmsTop Technology Co.,Ltd. (http://www.cmstop.com)
+
+// Provides configuration hot reload
+/*
+配置热加载
+收到SIGUSR1信号或调用config_reload方法时，重新读取sfss.conf和nginx.tpl，
+配置文件按启动时相同的规则合并环境变量和命令行参数，见util.LoadConfig。
+新配置先执行与启动时相同的检测（见Check），全部通过后才替换到各组件，
+任意一项检测失败时保持原配置不变，错误详情中列出每个失败的检测项。
+立即生效的配置：通讯密钥和控制端密钥表、站点配置和模板、MySQL连接配置，
+控制端密钥表文件每次热加载都重新读取。
+其他配置（如监听地址和端口、TLS、HTTP接口）只报告为需要重启，重启后才生效，见Restart。
+正在执行的业务操作继续使用开始时的配置。
+*/
+
+package server
+
+import (
+	"context"
+	"github.com/9466/goconfig"
+	"os"
+	"sfss/util"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	DEF_DB_CLOSE_DELAY = 60 // 热加载后关闭原MySQL连接的延迟，等待正在执行的操作结束，单位秒
+)
+
+// 可以热加载的配置项，section.option，或section表示整个section
+var reloadOptions = []string{
+	"server.serverIV",
+	"server.serverKEY",
+	"server.allowCBC",
+	"server.controllers",
+	"keys",
+	"site",
+	"db",
+}
+
+// 判断配置项是否可以热加载
+func reloadable(key string) bool {
+	for _, opt := range reloadOptions {
+		if key == opt || strings.HasPrefix(key, opt+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// 比较两个配置，返回值不同的配置项列表，section.option格式
+func confDiff(a, b *goconfig.ConfigFile) []string {
+	keys := make(map[string]bool)
+	for _, c := range []*goconfig.ConfigFile{a, b} {
+		for _, section := range c.GetSections() {
+			options, _ := c.GetOptions(section)
+			for _, option := range options {
+				keys[section+"."+option] = true
+			}
+		}
+	}
+	diff := make([]string, 0)
+	for key := range keys {
+		i := strings.Index(key, ".")
+		v1, _ := a.GetRawString(key[:i], key[i+1:])
+		v2, _ := b.GetRawString(key[:i], key[i+1:])
+		if v1 != v2 {
+			diff = append(diff, key)
+		}
+	}
+	sort.Strings(diff)
+	return diff
+}
+
+// 当前的控制端密钥表
+func (s *Serve) getCtrls() *controllerTable {
+	s.confLock.RLock()
+	defer s.confLock.RUnlock()
+	return s.ctrls
+}
+
+// 重新加载配置，返回已经生效和需要重启才能生效的配置项
+func (s *Serve) Reload() (*util.ReloadData, error) {
+	s.reloadLock.Lock()
+	defer s.reloadLock.Unlock()
+	conf, err := util.LoadConfig(s.main.ConfFile, os.Environ(), s.main.ConfSets)
+	if err != nil {
+		return nil, util.WrapError(util.CODE_VALIDATION, "LoadConfig Error", err)
+	}
+	// 使用临时实例校验新配置，不影响正在运行的组件
+	main := new(util.SFSS)
+	main.Conf = conf
+	main.Logger = s.main.Logger
+	main.Log = s.main.Log
+	main.Metrics = s.main.Metrics
+	main.ConfFile = s.main.ConfFile
+	main.ConfSets = s.main.ConfSets
+	err = CheckError(Check(main))
+	if err != nil {
+		return nil, err
+	}
+	n := new(Serve)
+	n.main = main
+	err = n.checkConfig()
+	if err != nil {
+		return nil, util.WrapError(util.CODE_VALIDATION, "server config Error", err)
+	}
+	last := s.main.Conf
+	start := s.startConf
+	if start == nil {
+		start = last
+	}
+	result := new(util.ReloadData)
+	result.Applied = make([]string, 0)
+	result.Restart = make([]string, 0)
+	dbChanged := false
+	for _, key := range confDiff(last, conf) {
+		if reloadable(key) {
+			result.Applied = append(result.Applied, key)
+			dbChanged = dbChanged || strings.HasPrefix(key, "db.")
+		}
+	}
+	// 与启动时的配置比较，重启前一直报告
+	for _, key := range confDiff(start, conf) {
+		if !reloadable(key) {
+			result.Restart = append(result.Restart, key)
+		}
+	}
+	var sc *siteConf
+	if s.site != nil {
+		sc, err = loadSiteConf(conf)
+		if err != nil {
+			return nil, util.WrapError(util.CODE_VALIDATION, "site config Error", err)
+		}
+		if sc.siteTpl != s.site.getConf().siteTpl {
+			result.Applied = append(result.Applied, "nginx.tpl")
+		}
+	}
+	var nd *db
+	if s.db != nil && dbChanged {
+		nd, err = initDb(main)
+		if err == nil {
+			_, err = nd.getConn().Version() // 检测新的帐号密码
+		}
+		if err != nil {
+			return nil, util.WrapError(util.CODE_UNAVAILABLE, "db config Error", err)
+		}
+	}
+
+	// 全部校验通过后替换
+	s.confLock.Lock()
+	s.ctrls = n.ctrls
+	s.confLock.Unlock()
+	if sc != nil {
+		s.site.setConf(sc)
+	}
+	if nd != nil {
+		old := s.db.getConn()
+		s.db.setConf(nd)
+		time.AfterFunc(DEF_DB_CLOSE_DELAY*time.Second, func() {
+			old.Conn.Close()
+		})
+	}
+	s.main.Conf = conf
+	s.main.Logger.Println("SFSS config reloaded, applied: [" + strings.Join(result.Applied, " ") +
+		"], restart required: [" + strings.Join(result.Restart, " ") + "]")
+	return result, nil
+}
+
+// config_reload：重新加载配置
+func (s *Serve) execReload(ctx context.Context, params interface{}) *util.SendData {
+	result, err := s.Reload()
+	if err != nil {
+		s.main.Logger.Println("SFSS config reload Error: " + err.Error())
+		return util.ErrorSend(err)
+	}
+	send := new(util.SendData)
+	send.Message = "config reload ok"
+	if len(result.Restart) > 0 {
+		send.Message = "config reload ok, restart required for " + strings.Join(result.Restart, ", ")
+	}
+	send.Reload = result
+	return send
+}
@@ -0,0 +1,20 @@
+// Copyright (c) 2013 Beijing CmsTop Technology Co.,Ltd. (http://www.cmstop.com)
+
+package server
+
+import (
+	"testing"
+)
+
+func TestReloadable1(t *testing.T) {
+	for _, key := range []string{"site.siteDir", "db.mysqlPass", "keys.k2", "server.controllers", "server.serverKEY"} {
+		if !reloadable(key) {
+			t.Error(key + " should be reloadable")
+		}
+	}
+	for _, key := range []string{"server.port", "server.listen", "server.serverType", "tls.cert", "http.enable", "sites.x", "dbx"} {
+		if reloadable(key) {
+			t.Error(key + " should require restart")
+		}
+	}
+}
@@ -0,0 +1,290 @@
+// Copyright (c) 2013 Beijing CmsTop Technology Co.,Ltd. (http://www.cmstop.com)
+
+// Provides zero-downtime restart
+/*
+平滑重启
+收到SIGHUP时，当前进程把TCP、HTTP、本地管理接口和监控指标接口的监听socket作为继承的文件传给新进程，
+新进程直接使用这些socket开始服务，不需要重新监听，重启期间控制端不会连接失败。
+任务状态、重放检测、幂等键和审计日志文件同时只能由一个进程使用，重启分两步交接：
+	1. 新进程完成初始化后通过ready管道通知父进程并立即开始服务，这之前启动失败时父进程终止新进程并继续服务；
+	   这时状态只记录在内存中：重放检测和幂等键只包含新进程处理的请求，审计记录暂存在内存中，
+	   job_status、job_list暂时查不到父进程的任务；
+	2. 父进程停止接收新连接，等待正在处理的请求和任务结束，保存并关闭这些文件后，
+	   通过handoff管道通知新进程，新进程加载这些文件与内存中的状态合并，之后写入文件。
+重启期间控制端的请求不需要等待父进程排空。
+继承的socket名称列表由环境变量SFSS_LISTEN_FDS传递，依次对应文件描述符3、4……
+*/
+
+package server
+
+import (
+	"errors"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ENV_LISTEN_FDS      = "SFSS_LISTEN_FDS" // 继承的监听socket名称列表，逗号分隔
+	ENV_READY_FD        = "SFSS_READY_FD"   // 通知父进程启动完成的管道文件描述符
+	ENV_HANDOFF_FD      = "SFSS_HANDOFF_FD" // 父进程关闭状态文件后通知新进程的管道文件描述符
+	DEF_RESTART_TIMEOUT = 30                // 默认等待新进程启动完成的时间，单位秒
+)
+
+// 监听socket名称
+const (
+	LISTEN_TCP     = "tcp"     // TCP接口
+	LISTEN_HTTP    = "http"    // HTTP接口
+	LISTEN_ADMIN   = "admin"   // 本地管理接口
+	LISTEN_METRICS = "metrics" // 监控指标接口
+)
+
+// 可以导出文件描述符的监听
+type fileListener interface {
+	File() (*os.File, error)
+}
+
+var (
+	inheritOnce sync.Once               // 只解析一次继承的socket
+	inherited   map[string]net.Listener // 继承自父进程的监听，取出后删除
+	inheritErr  error                   // 解析继承的socket的错误
+)
+
+// 解析父进程传递的监听socket
+func loadInherited() {
+	inherited = make(map[string]net.Listener)
+	names := os.Getenv(ENV_LISTEN_FDS)
+	os.Unsetenv(ENV_LISTEN_FDS) // 不再传给其他子进程，如Nginx
+	if names == "" {
+		return
+	}
+	for i, name := range strings.Split(names, ",") {
+		f := os.NewFile(uintptr(3+i), name)
+		l, err := net.FileListener(f)
+		f.Close() // FileListener复制了描述符
+		if err != nil {
+			inheritErr = errors.New("inherit listener " + name + " Error: " + err.Error())
+			return
+		}
+		inherited[name] = l
+	}
+}
+
+// 取出继承的监听，没有时返回nil
+func inheritListener(name string) (net.Listener, error) {
+	inheritOnce.Do(loadInherited)
+	if inheritErr != nil {
+		return nil, inheritErr
+	}
+	l := inherited[name]
+	delete(inherited, name)
+	return l, nil
+}
+
+// 关闭未使用的继承监听，如新配置中关闭了HTTP接口
+func closeInherited() {
+	inheritOnce.Do(loadInherited)
+	for name, l := range inherited {
+		l.Close()
+		delete(inherited, name)
+	}
+}
+
+// 监听地址，有继承的监听时直接使用
+func listen(name, network, addr string) (net.Listener, error) {
+	l, err := inheritListener(name)
+	if l != nil || err != nil {
+		return l, err
+	}
+	return net.Listen(network, addr)
+}
+
+// 通知父进程已经完成初始化，不是平滑重启启动时忽略
+func notifyReady() {
+	fd := os.Getenv(ENV_READY_FD)
+	os.Unsetenv(ENV_READY_FD)
+	if fd == "" {
+		return
+	}
+	n, err := strconv.Atoi(fd)
+	if err != nil {
+		return
+	}
+	f := os.NewFile(uintptr(n), "ready")
+	f.Write([]byte("1"))
+	f.Close()
+}
+
+// 平滑重启时延迟加载的状态文件，初始化时记录文件路径，父进程交接后加载
+type pendingState struct {
+	pipe   *os.File  // 等待父进程交接的管道
+	replay string    // 重放检测缓存文件
+	idem   string    // 幂等键缓存文件
+	jobs   string    // 任务状态文件
+	done   chan bool // 加载完成后关闭
+}
+
+// 平滑重启启动时返回等待父进程交接状态文件的管道，不是平滑重启时返回nil
+func handoffPending() *pendingState {
+	fd := os.Getenv(ENV_HANDOFF_FD)
+	os.Unsetenv(ENV_HANDOFF_FD)
+	if fd == "" {
+		return nil
+	}
+	n, err := strconv.Atoi(fd)
+	if err != nil {
+		return nil
+	}
+	p := new(pendingState)
+	p.pipe = os.NewFile(uintptr(n), "handoff")
+	p.done = make(chan bool)
+	return p
+}
+
+// 等待父进程关闭状态文件后加载，与交接前内存中的状态合并
+// 父进程退出时管道读取返回EOF，同样开始加载；加载失败时继续只在内存中记录
+func (s *Serve) attachState() {
+	p := s.pending
+	defer close(p.done)
+	s.main.Logger.Println("SFSS waiting for parent process to release state files...")
+	b := make([]byte, 1)
+	p.pipe.Read(b)
+	p.pipe.Close()
+	var err error
+	if s.replay != nil && p.replay != "" {
+		if err = s.replay.Attach(p.replay); err != nil {
+			s.main.Logger.Println("ReplayCache attach Error: " + err.Error())
+		}
+	}
+	if s.idem != nil && p.idem != "" {
+		if err = s.idem.Attach(p.idem); err != nil {
+			s.main.Logger.Println("IdemCache attach Error: " + err.Error())
+		}
+	}
+	if s.audit != nil {
+		if err = s.audit.Attach(); err != nil {
+			s.main.Logger.Println("AuditLog attach Error: " + err.Error())
+		}
+	}
+	if s.jobs != nil && p.jobs != "" {
+		if err = s.jobs.attach(p.jobs); err != nil {
+			s.main.Logger.Println("Jobs attach Error: " + err.Error())
+		}
+	}
+	s.main.Logger.Println("SFSS state files attached")
+}
+
+// 通知新进程状态文件已经关闭，可以加载，不是平滑重启时忽略
+func (s *Serve) handoffState() {
+	if s.handoff == nil {
+		return
+	}
+	s.handoff.Write([]byte("1"))
+	s.handoff.Close()
+	s.handoff = nil
+	s.main.Logger.Println("SFSS state files handed off to restart process")
+}
+
+// 平滑重启：启动新进程并传递监听socket，等待新进程完成初始化
+// 返回nil时新进程已经开始服务，调用者应当停止当前进程的服务，停止服务关闭状态文件后由handoffState通知新进程加载
+// 返回错误时新进程已终止，当前进程继续服务
+func (s *Serve) Restart() error {
+	names := make([]string, 0, 4)
+	files := make([]*os.File, 0, 5)
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	add := func(name string, l net.Listener) error {
+		fl, ok := l.(fileListener)
+		if !ok {
+			return errors.New("listener " + name + " can not be passed")
+		}
+		f, err := fl.File()
+		if err != nil {
+			return errors.New("listener " + name + " file Error: " + err.Error())
+		}
+		names = append(names, name)
+		files = append(files, f)
+		return nil
+	}
+	if err := add(LISTEN_TCP, s.tcp); err != nil {
+		return err
+	}
+	if s.http != nil {
+		if err := add(LISTEN_HTTP, s.http.tcp); err != nil {
+			return err
+		}
+	}
+	if s.admin != nil {
+		if err := add(LISTEN_ADMIN, s.admin); err != nil {
+			return err
+		}
+	}
+	if s.metrics != nil {
+		if err := add(LISTEN_METRICS, s.metrics.listen); err != nil {
+			return err
+		}
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		return errors.New("ready pipe Error: " + err.Error())
+	}
+	defer r.Close()
+	files = append(files, w)
+	hr, hw, err := os.Pipe()
+	if err != nil {
+		return errors.New("handoff pipe Error: " + err.Error())
+	}
+	files = append(files, hr)
+
+	cmd := exec.Command(os.Args[0], os.Args[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = files
+	cmd.Env = append(os.Environ(),
+		ENV_LISTEN_FDS+"="+strings.Join(names, ","),
+		ENV_READY_FD+"="+strconv.Itoa(3+len(names)),
+		ENV_HANDOFF_FD+"="+strconv.Itoa(4+len(names)),
+	)
+	err = cmd.Start()
+	if err != nil {
+		hw.Close()
+		return errors.New("restart process start Error: " + err.Error())
+	}
+	w.Close() // 新进程退出时管道读取返回EOF
+	hr.Close()
+	files = files[:len(files)-2]
+
+	// 等待新进程通知，新进程退出或超时则认为启动失败
+	ready := make(chan error, 1)
+	go func() {
+		b := make([]byte, 1)
+		_, err := r.Read(b)
+		ready <- err
+	}()
+	select {
+	case err = <-ready:
+	case <-time.After(DEF_RESTART_TIMEOUT * time.Second):
+		err = errors.New("timed out")
+	}
+	if err != nil {
+		hw.Close()
+		cmd.Process.Kill()
+		cmd.Wait()
+		return errors.New("restart process not ready: " + err.Error())
+	}
+	// 新进程已经在同一个socket上服务，关闭时不能删除本地管理接口的socket文件
+	if ul, ok := s.admin.(*net.UnixListener); ok {
+		ul.SetUnlinkOnClose(false)
+	}
+	s.main.Logger.Println("SFSS restart process", cmd.Process.Pid, "ready, serving")
+	cmd.Process.Release()
+	s.handoff = hw
+	return nil
+}
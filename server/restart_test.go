@@ -0,0 +1,113 @@
+// Copyright (c) 2013 Beijing CmsTop Technology Co.,Ltd. (http://www.cmstop.com)
+
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"sfss/util"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestNotifyReady1(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer r.Close()
+	fd, err := syscall.Dup(int(w.Fd()))
+	w.Close()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	os.Setenv(ENV_READY_FD, strconv.Itoa(fd))
+	notifyReady() // 写入后关闭管道
+	b := make([]byte, 2)
+	n, _ := r.Read(b)
+	if n != 1 || b[0] != '1' {
+		t.Error("ready not notified: ", string(b[:n]))
+	}
+	if os.Getenv(ENV_READY_FD) != "" {
+		t.Error("ready fd env should be cleared")
+	}
+}
+
+// 测试用的管道，返回父进程使用的一端和传给新进程的文件描述符
+func testPipe(t *testing.T, parentRead bool) (*os.File, int) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	parent, child := w, r
+	if parentRead {
+		parent, child = r, w
+	}
+	fd, err := syscall.Dup(int(child.Fd()))
+	child.Close()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return parent, fd
+}
+
+func TestAttachState1(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sfss")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	handoff, handoffFd := testPipe(t, false)
+	os.Setenv(ENV_HANDOFF_FD, strconv.Itoa(handoffFd))
+	s := testServe()
+	s.pending = handoffPending()
+	if s.pending == nil {
+		t.Fatal("pending state should be created on restart")
+	}
+	// 父进程的重放检测文件中已有nonce a，交接前新进程只在内存中检测
+	file := dir + "/replay.dat"
+	now := time.Now().Unix()
+	ioutil.WriteFile(file, []byte("a "+strconv.FormatInt(now, 10)+"\n"), 0600)
+	s.pending.replay = file
+	s.replay, _ = util.NewReplayCache("", time.Minute, 10)
+	if err = s.replay.Check("b", now); err != nil {
+		t.Fatal("check before handoff failed: ", err.Error())
+	}
+	go s.attachState()
+	select {
+	case <-s.pending.done:
+		t.Fatal("should wait for handoff")
+	case <-time.After(50 * time.Millisecond):
+	}
+	parent := testServe()
+	parent.handoff = handoff
+	parent.handoffState()
+	select {
+	case <-s.pending.done:
+	case <-time.After(time.Second):
+		t.Fatal("handoff not received")
+	}
+	if err = s.replay.Check("a", now); err != util.ErrReplay {
+		t.Error("nonce of parent process should be loaded: ", err)
+	}
+	s.replay.Close()
+	data, _ := ioutil.ReadFile(file)
+	if !strings.Contains(string(data), "b ") {
+		t.Error("nonce checked before handoff should be saved: ", string(data))
+	}
+}
+
+func TestListen1(t *testing.T) {
+	// 没有继承的socket时重新监听
+	l, err := listen(LISTEN_HTTP, "tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("listen failed: ", err.Error())
+	}
+	defer l.Close()
+	if _, ok := l.(fileListener); !ok {
+		t.Error("listener should be able to pass to new process")
+	}
+}
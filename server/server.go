@@ -2,63 +2,184 @@
 
 /*
 Package server provides site & db management method.
-It's a TCP Socket Server.
+It's a TCP Socket Server, with an optional HTTP gateway.
 */
 package server
 
 import (
+	"context"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
+	"github.com/9466/goconfig"
+	"io"
 	"net"
+	"os"
 	"sfss/util"
+	"strings"
+	"sync"
 	"time"
 )
 
 const (
-	DEF_SERVER_HOST = "0.0.0.0" // 默认服务地址
-	DEF_SERVER_PORT = "9467"    // 默认服务端口号
+	DEF_SERVER_HOST   = "0.0.0.0" // 默认服务地址
+	DEF_SERVER_PORT   = "9467"    // 默认服务端口号
+	DEF_READ_TIMEOUT  = 30        // 默认读取请求超时时间，单位秒
+	DEF_IDLE_TIMEOUT  = 60        // 默认持久连接空闲超时时间，单位秒
+	DEF_MAX_INFLIGHT  = 16        // 默认持久连接同时处理的最大请求数
+	DEF_REPLAY_WINDOW = 300       // 默认请求签发时间允许误差，单位秒
+	DEF_REPLAY_SIZE   = 100000    // 默认nonce缓存最大条数
+	DEF_IDEM_WINDOW   = 86400     // 默认幂等键执行结果保留时间，单位秒
+	DEF_DRAIN_TIMEOUT = 30        // 默认停止服务时等待请求和任务处理完成的时间，单位秒
+	DEF_CANCEL_WAIT   = 5         // 排空超时取消业务操作后，等待其结束的时间，单位秒
 )
 
 // 服务器数据结构
 type Serve struct {
-	main       *util.SFSS       // 系统接口
-	listen     *net.TCPListener // 服务监听接口
-	host       string           // 服务地址
-	port       string           // 服务端口
-	serverIV   []byte           // 加密向量
-	serverKEY  []byte           // 加密密钥
-	serverType int              // 服务器服务类型
-	site       *site            // 站点控制接口
-	db         *db              // 数据库控制接口
+	main       *util.SFSS           // 系统接口
+	listen     net.Listener         // 服务监听接口，开启TLS时为TLS监听
+	tcp        net.Listener         // 未封装TLS的TCP监听，平滑重启时传给新进程
+	tlsConfig  *tls.Config          // TLS配置，未开启时为nil
+	host       string               // 服务地址
+	port       string               // 服务端口
+	ctrls      *controllerTable     // 控制端密钥表，热加载时替换，使用getCtrls读取
+	confLock   sync.RWMutex         // 控制端密钥表锁
+	reloadLock sync.Mutex           // 热加载锁，同时只执行一次热加载
+	startConf  *goconfig.ConfigFile // 启动时的配置，热加载后s.main.Conf为新配置，与它比较报告需要重启的配置项
+	replay     *util.ReplayCache    // 请求重放检测，未开启时为nil
+	idem       *util.IdemCache      // 幂等键执行结果，未开启时为nil
+	audit      *util.AuditLog       // 审计日志，未开启时为nil
+	metrics    *metricsServer       // 监控指标接口，未开启时为nil
+	serverType int                  // 服务器服务类型
+	idleTime   time.Duration        // 持久连接空闲超时时间
+	inflight   int                  // 持久连接同时处理的最大请求数
+	site       *site                // 站点控制接口，服务器类型不含web时为nil
+	db         *db                  // 数据库控制接口，服务器类型不含db时为nil
+	methods    *registry            // 业务方法注册表
+	http       *httpGateway         // HTTP接口，未开启时为nil
+	admin      net.Listener         // 本地管理接口监听，未开启时为nil
+	jobs       *jobManager          // 异步任务管理
+	ctx        context.Context      // 业务操作的Context，停止服务排空超时后取消
+	cancel     context.CancelFunc   // 取消正在执行的业务操作
+	drainTime  time.Duration        // 停止服务时等待请求和任务处理完成的时间
+	closeOnce  sync.Once            // 停止服务只执行一次
+	connLock   sync.Mutex           // 连接表锁
+	conns      map[net.Conn]bool    // 正在处理的TCP和本地管理接口连接
+	handoff    *os.File             // 平滑重启时通知新进程的管道，关闭状态文件后写入，见Restart
+	pending    *pendingState        // 平滑重启启动时等待父进程交接的状态文件，不是平滑重启时为nil
 }
 
 // 创建一个新的服务器实例
 func NewServer(s *util.SFSS) (*Serve, error) {
+	// 启动自检，与-check模式相同
+	failed := make([]string, 0)
+	for _, r := range Check(s) {
+		if r.Err != nil {
+			s.Logger.Println("config check " + r.Item + " Error: " + r.Err.Error())
+			failed = append(failed, r.Item)
+		}
+	}
+	if len(failed) > 0 {
+		return nil, errors.New("config check failed: " + strings.Join(failed, ", "))
+	}
 	server := new(Serve)
 	server.main = s
+	server.startConf = s.Conf
+	server.methods = newRegistry()
+	server.ctx, server.cancel = context.WithCancel(context.Background())
+	server.conns = make(map[net.Conn]bool)
 	err := server.checkConfig()
 	if err != nil {
 		return nil, err
 	}
-	addr, err := net.ResolveTCPAddr("tcp4", server.host+":"+server.port)
+	server.methods.serverType = server.serverType
+	listener, err := listen(LISTEN_TCP, "tcp4", server.host+":"+server.port)
 	if err != nil {
 		return nil, err
 	}
-	listener, err := net.ListenTCP("tcp4", addr)
+	server.tcp = listener
+	server.listen = listener
+	server.tlsConfig, err = loadTLSConfig(s.Conf)
 	if err != nil {
 		return nil, err
 	}
-	server.listen = listener
-	server.site, err = initSite(s)
+	if server.tlsConfig != nil {
+		server.listen = tls.NewListener(listener, server.tlsConfig)
+	}
+	server.metrics, err = newMetricsServer(s)
+	if err != nil {
+		return nil, err
+	}
+	// 按服务器类型初始化站点和数据库子系统，未开启的角色为nil
+	if server.serverType&SERVER_TYPE_WEB != 0 {
+		server.site, err = initSite(s)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if server.serverType&SERVER_TYPE_DB != 0 {
+		server.db, err = initDb(s)
+		if err != nil {
+			return nil, err
+		}
+	}
+	server.metricsGauges()
+	server.http, err = newHttpGateway(server)
+	if err != nil {
+		return nil, err
+	}
+	server.admin, err = listenAdmin(s.Conf)
+	if err != nil {
+		return nil, err
+	}
+	// 平滑重启时状态先只记录在内存中，父进程保存并关闭状态文件后再加载，避免两个进程同时写入
+	server.pending = handoffPending()
+	server.replay, err = server.initReplay()
+	if err != nil {
+		return nil, err
+	}
+	server.idem, err = server.initIdem()
+	if err != nil {
+		return nil, err
+	}
+	server.audit, err = server.initAudit()
+	if err != nil {
+		return nil, err
+	}
+	server.jobs, err = server.initJobs()
+	if err != nil {
+		return nil, err
+	}
+	// 注册各子系统的业务方法，未开启的角色的方法只记录名称，site或db为nil时不会被调用
+	err = server.site.register(server.methods)
+	if err != nil {
+		return nil, err
+	}
+	err = server.db.register(server.methods)
+	if err != nil {
+		return nil, err
+	}
+	err = server.jobs.register(server.methods)
+	if err != nil {
+		return nil, err
+	}
+	err = server.methods.register(&Method{Name: "config_reload", Desc: "重新加载配置", Exec: server.execReload})
 	if err != nil {
 		return nil, err
 	}
-	server.db, err = initDb(s)
+	err = server.methods.register(&Method{Name: "audit_query", Desc: "查询审计记录", Params: newAuditQueryParams, Exec: server.execAuditQuery, Query: true})
 	if err != nil {
 		return nil, err
 	}
+	closeInherited()
 	return server, nil
 }
 
+// 注册一个业务方法，供其他子系统扩展服务器功能
+func (s *Serve) Register(m *Method) error {
+	return s.methods.register(m)
+}
+
 // 检测配置文件
 func (s *Serve) checkConfig() error {
 	host, _ := s.main.Conf.GetString("server", "listen")
@@ -81,151 +202,462 @@ func (s *Serve) checkConfig() error {
 	if err != nil {
 		return err
 	}
+	allowCBC, err := s.main.Conf.GetBool("server", "allowCBC")
+	if err != nil {
+		allowCBC = true // 未配置时兼容旧版控制端
+	}
+	// 加载AES-GCM密钥
+	keys := make(map[string][]byte)
+	keyids, _ := s.main.Conf.GetOptions("keys")
+	for _, keyid := range keyids {
+		key, err := s.main.Conf.GetString("keys", keyid)
+		if err != nil {
+			return err
+		}
+		keys[keyid] = []byte(key)
+	}
+	ctrls := new(controllerTable)
+	ctrls.def = new(controller)
+	ctrls.def.crypt, err = newCryptor([]byte(serverIV), []byte(serverKEY), keys, allowCBC)
+	if err != nil {
+		return err
+	}
+	// 加载控制端密钥表
+	ctrlFile, _ := s.main.Conf.GetString("server", "controllers")
+	if ctrlFile != "" {
+		ctrlFile, err = util.GetPath(ctrlFile)
+		if err != nil {
+			return err
+		}
+		ctrls.table, err = loadControllers(ctrlFile, allowCBC)
+		if err != nil {
+			return errors.New("Load controllers Error: " + err.Error())
+		}
+	}
 	s.host = host
 	s.port = port
-	s.serverIV = []byte(serverIV)
-	s.serverKEY = []byte(serverKEY)
+	s.ctrls = ctrls
+	idleTimeout, _ := s.main.Conf.GetInt("server", "idleTimeout")
+	if idleTimeout <= 0 {
+		idleTimeout = DEF_IDLE_TIMEOUT
+	}
+	maxInflight, _ := s.main.Conf.GetInt("server", "maxInflight")
+	if maxInflight <= 0 {
+		maxInflight = DEF_MAX_INFLIGHT
+	}
+	drainTimeout, _ := s.main.Conf.GetInt("server", "drainTimeout")
+	if drainTimeout <= 0 {
+		drainTimeout = DEF_DRAIN_TIMEOUT
+	}
 	s.serverType = serverType
+	s.idleTime = time.Duration(idleTimeout) * time.Second
+	s.inflight = maxInflight
+	s.drainTime = time.Duration(drainTimeout) * time.Second
 	return nil
 }
 
-// 使服务器开始服务
+// 初始化请求重放检测
+func (s *Serve) initReplay() (*util.ReplayCache, error) {
+	enable, _ := s.main.Conf.GetBool("replay", "enable")
+	if !enable {
+		return nil, nil
+	}
+	window, _ := s.main.Conf.GetInt("replay", "window")
+	if window <= 0 {
+		window = DEF_REPLAY_WINDOW
+	}
+	size, _ := s.main.Conf.GetInt("replay", "size")
+	if size <= 0 {
+		size = DEF_REPLAY_SIZE
+	}
+	file, _ := s.main.Conf.GetString("replay", "file")
+	file, err := util.GetPath(file)
+	if err != nil {
+		return nil, err
+	}
+	if s.pending != nil {
+		s.pending.replay, file = file, ""
+	}
+	replay, err := util.NewReplayCache(file, time.Duration(window)*time.Second, size)
+	if err != nil {
+		return nil, errors.New("ReplayCache init Error: " + err.Error())
+	}
+	return replay, nil
+}
+
+// 初始化幂等键缓存
+func (s *Serve) initIdem() (*util.IdemCache, error) {
+	enable, _ := s.main.Conf.GetBool("idempotency", "enable")
+	if !enable {
+		return nil, nil
+	}
+	window, _ := s.main.Conf.GetInt("idempotency", "window")
+	if window <= 0 {
+		window = DEF_IDEM_WINDOW
+	}
+	file, _ := s.main.Conf.GetString("idempotency", "file")
+	file, err := util.GetPath(file)
+	if err != nil {
+		return nil, err
+	}
+	if s.pending != nil {
+		s.pending.idem, file = file, ""
+	}
+	idem, err := util.NewIdemCache(file, time.Duration(window)*time.Second)
+	if err != nil {
+		return nil, errors.New("IdemCache init Error: " + err.Error())
+	}
+	return idem, nil
+}
+
+// 初始化异步任务管理
+func (s *Serve) initJobs() (*jobManager, error) {
+	workers, _ := s.main.Conf.GetInt("jobs", "workers")
+	if workers <= 0 {
+		workers = DEF_JOB_WORKERS
+	}
+	queue, _ := s.main.Conf.GetInt("jobs", "queue")
+	if queue <= 0 {
+		queue = DEF_JOB_QUEUE
+	}
+	keep, _ := s.main.Conf.GetInt("jobs", "keep")
+	if keep <= 0 {
+		keep = DEF_JOB_KEEP
+	}
+	file, _ := s.main.Conf.GetString("jobs", "file")
+	if file == "" {
+		file = "log/jobs.json"
+	}
+	file, err := util.GetPath(file)
+	if err != nil {
+		return nil, err
+	}
+	if s.pending != nil {
+		s.pending.jobs, file = file, ""
+	}
+	jobs, err := newJobManager(s.ctx, file, workers, queue, time.Duration(keep)*time.Second, s.orderRun, s.main.Logger)
+	if err != nil {
+		return nil, errors.New("Jobs init Error: " + err.Error())
+	}
+	jobs.finish = s.auditJob // 任务结束时记录最终结果的审计日志
+	return jobs, nil
+}
+
+// 使服务器开始服务，进程生命周期结束后停止接收新连接，
+// 等待正在处理的请求和任务结束后退出，见drain
 func (s *Serve) Accept() {
 	s.main.Logger.Println("SFSS server begin serve.")
+	if s.http != nil {
+		go s.http.serve()
+	}
+	if s.metrics != nil {
+		go s.metrics.serve(s.main.Log)
+	}
+	if s.admin != nil {
+		go s.adminAccept()
+	}
+	go func() {
+		<-s.main.Context().Done()
+		s.Close()
+	}()
+	notifyReady() // 平滑重启时通知父进程停止服务，新进程不等待父进程排空
+	if s.pending != nil {
+		go s.attachState()
+	}
 	for {
-		if s.main.Shutdown == true {
-			if s.main.ConnNum == 0 {
-				s.main.Logger.Println("active connections serve done, now beginning shutdown...")
-				break
-			} else {
-				s.main.Logger.Println("SFSS server has", s.main.ConnNum, "actvie connections, serve continue...")
-			}
-			time.Sleep(1 * time.Second) // 如果还在处理，等待1000毫秒继续
-			continue
-		}
-		s.main.Logger.Println("SFSS server new accept...")
-		conn, err := s.listen.AcceptTCP()
+		conn, err := s.listen.Accept()
 		if err != nil {
-			if oerr, ok := err.(*net.OpError); ok && oerr.Err.Error() == "use of closed network connection" {
-				/* this hack happens because the error is returned when the
-				 * network socket is closing and instead of returning a
-				 * io.EOF it returns this error.New(...) struct.
-				 */
-				continue // 这是listener被关闭，不记录日志
+			if s.main.IsShutdown() {
+				break // listener被关闭，停止服务
 			}
 			s.main.Logger.Println(err.Error())
 			continue // 输出异常，继续提供服务
 		}
-		s.main.ConnNum++ // 每启动一个处理，连接数+1
-		go s.clientHandle(conn)
+		s.main.ConnBegin() // 每启动一个处理，连接数+1
+		go s.clientHandle(conn, false)
+	}
+	s.main.Logger.Println("SFSS server stop accepting,", s.main.ConnNum(), "active connections, waiting...")
+	s.drain()
+	if s.pending != nil {
+		<-s.pending.done // 等待加载父进程交接的状态文件，之后才能关闭
+	}
+	if s.replay != nil {
+		s.replay.Close()
+	}
+	if s.idem != nil {
+		s.idem.Close()
+	}
+	if s.audit != nil {
+		s.audit.Close()
+	}
+	s.handoffState() // 状态文件已经关闭，平滑重启的新进程加载状态文件
+	if s.metrics != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), DEF_CANCEL_WAIT*time.Second)
+		s.metrics.close(ctx)
+		cancel()
 	}
 	s.main.Logger.Println("SFSS server has been shutdown.")
 	s.main.Chs <- 1 // 程序终止，写入Channel数据
 }
 
-// 处理客户端请求
-func (s *Serve) clientHandle(conn *net.TCPConn) {
+// 等待正在处理的连接、HTTP请求和异步任务结束
+// 超过drainTimeout时取消正在执行的业务操作，取消后仍未结束的连接强制关闭
+func (s *Serve) drain() {
+	ctx, cancel := context.WithTimeout(context.Background(), s.drainTime)
+	defer cancel()
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		s.main.ConnWait()
+	}()
+	go func() {
+		defer wg.Done()
+		s.jobs.close()
+	}()
+	if s.http != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.http.close(ctx)
+		}()
+	}
+	done := make(chan bool)
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		s.main.Logger.Println("active connections serve done, now beginning shutdown...")
+		return
+	case <-ctx.Done():
+	}
+	s.main.Logger.Println("SFSS server drain timeout,", s.main.ConnNum(), "active connections, cancel running operations...")
+	s.cancel()
+	select {
+	case <-done:
+	case <-time.After(DEF_CANCEL_WAIT * time.Second):
+		s.main.Logger.Println("SFSS server", s.main.ConnNum(), "connections not finished after cancel, force close")
+		s.connClose()
+	}
+}
+
+// 记录或移除正在处理的连接，停止服务后加入的连接不再读取新请求
+func (s *Serve) connTrack(conn net.Conn, add bool) {
+	s.connLock.Lock()
+	defer s.connLock.Unlock()
+	if !add {
+		delete(s.conns, conn)
+		return
+	}
+	s.conns[conn] = true
+	if s.main.IsShutdown() {
+		conn.SetReadDeadline(time.Now())
+	}
+}
+
+// 中断所有连接上等待中的读取，正在处理的请求仍然可以响应
+func (s *Serve) connWake() {
+	s.connLock.Lock()
+	defer s.connLock.Unlock()
+	for conn := range s.conns {
+		conn.SetReadDeadline(time.Now())
+	}
+}
+
+// 强制关闭所有连接
+func (s *Serve) connClose() {
+	s.connLock.Lock()
+	defer s.connLock.Unlock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+}
+
+// 处理客户端连接，admin为是否本地管理接口的连接
+func (s *Serve) clientHandle(conn net.Conn, admin bool) {
+	sess := newSession(conn, s.inflight)
+	if admin {
+		sess.admin = true
+		sess.from.remote = "admin socket"
+		sess.version = util.PROTOCOL_V2 // 本地管理接口始终使用长度前缀封装
+	}
+	s.connTrack(conn, true)
 	defer func() {
 		conn.Close()
-		s.main.ConnNum-- // 每结束一个处理，连接数-1
+		s.connTrack(conn, false)
+		s.main.ConnEnd() // 每结束一个处理，连接数-1
 	}()
+	// TLS握手，获取客户端证书
+	if tc, ok := conn.(*tls.Conn); ok {
+		tc.SetDeadline(time.Now().Add(DEF_READ_TIMEOUT * time.Second))
+		err := tc.Handshake()
+		if err != nil {
+			s.main.Logger.Println("TLS handshake Error: " + err.Error() + ", from " + conn.RemoteAddr().String())
+			return
+		}
+		// 清除握手超时，之后由每次读取设置读超时，不影响耗时较长的请求写入响应
+		tc.SetDeadline(time.Time{})
+		state := tc.ConnectionState()
+		sess.from.cert = peerCertificate(&state)
+	}
+	// 接收第一个请求，由它决定连接模式
+	receive, err := s.clientRead(sess, DEF_READ_TIMEOUT*time.Second)
+	if err != nil || receive == nil {
+		return
+	}
+	if receive.Version > sess.version {
+		sess.version = receive.Version
+	}
+	if !receive.Keepalive {
+		s.requestHandle(sess, receive)
+		return
+	}
+	// 持久连接：持续读取请求并发处理，直到空闲超时、客户端关闭或服务停止
+	sess.keep = true
+	for err == nil && !s.main.IsShutdown() {
+		if receive != nil {
+			r := receive
+			sess.dispatch(func() { s.requestHandle(sess, r) })
+		}
+		receive, err = s.clientRead(sess, s.idleTime)
+	}
+	sess.wg.Wait()
+}
+
+// 读取并解析一个请求数据包
+// 读取失败时返回error，连接应当关闭；数据包解析失败时已响应客户端，返回的请求为nil
+func (s *Serve) clientRead(sess *session, timeout time.Duration) (*util.ReceiveData, error) {
 	var err2 string
-	// 接收数据
-	data, err := util.TCPConnRead(conn)
+	data, err := util.ConnRead(sess.conn, timeout)
 	if err != nil {
+		if err == io.EOF {
+			return nil, err // 客户端关闭连接
+		}
+		if nerr, ok := err.(net.Error); ok && nerr.Timeout() && (sess.keep || s.main.IsShutdown()) {
+			return nil, err // 持久连接空闲超时，或停止服务时中断读取
+		}
 		err2 = "TCPConnRead Data Error: " + err.Error()
 		s.main.Logger.Println(err2)
-		s.clientWrite(conn, []byte(err2), 1)
-		return
+		s.clientWrite(sess, nil, []byte(err2), util.CODE_ERROR)
+		return nil, err
 	}
-	// 处理接收结构
 	receive := new(util.ReceiveData)
 	err = json.Unmarshal(data, receive)
 	if err != nil {
 		err2 = "ReceiveData json decode Error: " + err.Error()
 		s.main.Logger.Println(err2)
-		s.clientWrite(conn, []byte(err2), 1)
-		return
+		s.clientWrite(sess, nil, []byte(err2), util.CODE_ERROR)
+		return nil, nil
 	}
-	// 解密数据
-	data, err = util.AesDecrypt([]byte(receive.Data), s.serverIV, s.serverKEY)
-	if err != nil {
-		err2 = "ReceiveData AES decrypt Error: " + err.Error()
-		s.main.Logger.Println(err2)
-		s.clientWrite(conn, []byte(err2), 1)
-		return
+	return receive, nil
+}
+
+// 处理客户端请求
+func (s *Serve) requestHandle(sess *session, receive *util.ReceiveData) {
+	var order *util.OrderData
+	var code int
+	var err error
+	if sess.admin {
+		receive.Version = util.PROTOCOL_V2 // 本地管理接口响应不加密
+		order, code, err = s.adminOpen(receive, &sess.from)
+	} else {
+		order, code, err = s.orderOpen(receive, &sess.from, "")
 	}
-	// 判断method进行处理
-	order := new(util.OrderData)
-	err = json.Unmarshal(data, order)
 	if err != nil {
-		err2 = "OrderData json decode Error: " + err.Error()
-		s.main.Logger.Println(err2)
-		s.clientWrite(conn, []byte(err2), 1)
+		s.clientWrite(sess, receive, []byte(err.Error()), code)
 		return
 	}
-	var result string
-	var code int
-	switch order.Method {
-	case "init_test":
-		s.initTest(conn)
+	if order.Method == "init_test" {
+		send := s.initTest()
+		send.Id = receive.Id
+		s.clientSend(sess, receive, send)
 		return
-	case "site_create":
-		result, err = s.site.Create(order.Data)
-	case "site_update":
-		result, err = s.site.Update(order.Data)
-	case "site_pause":
-		result, err = s.site.Pause(order.Data)
-	case "site_start":
-		result, err = s.site.Start(order.Data)
-	case "site_delete":
-		result, err = s.site.Delete(order.Data)
-	case "db_create":
-		result, err = s.db.Create(order.Data)
-	case "db_update":
-		result, err = s.db.Update(order.Data)
-	case "db_pause":
-		result, err = s.db.Pause(order.Data)
-	case "db_start":
-		result, err = s.db.Start(order.Data)
-	case "db_delete":
-		result, err = s.db.Delete(order.Data)
-	default:
-		result = "method undefined"
-		code = 1
-	}
-	if err != nil {
-		s.main.Logger.Println(err.Error())
-		result = "handel method " + order.Method + " Error: " + err.Error()
-		code = 1
-	}
-	s.clientWrite(conn, []byte(result), code)
+	}
+	c := s.newCaller(receive, &sess.from)
+	if sess.admin {
+		c.scope = CALLER_ADMIN
+		c.controller = CALLER_ADMIN
+	}
+	send := s.orderExec(s.ctx, c, order)
+	send.Id = receive.Id
+	s.clientSend(sess, receive, send)
 }
 
 // 响应客户端信息
-func (s *Serve) clientWrite(conn *net.TCPConn, msg []byte, code int) {
+func (s *Serve) clientWrite(sess *session, receive *util.ReceiveData, msg []byte, code int) {
 	send := new(util.SendData)
+	if receive != nil {
+		send.Id = receive.Id
+	}
 	send.Code = code
 	send.Message = string(msg)
-	json, _ := json.Marshal(send)
-	conn.Write(json)
+	s.clientSend(sess, receive, send)
 }
 
-// 停止服务
+// 按请求的协议版本封装并发送响应
+// receive为nil表示请求无法解析，使用连接协商的协议版本
+func (s *Serve) clientSend(sess *session, receive *util.ReceiveData, send interface{}) {
+	version := sess.version
+	if receive != nil {
+		version = receive.Version
+	}
+	framed := sess.keep || version >= util.PROTOCOL_V2
+	err := sess.write(s.seal(receive, version, send), framed)
+	if err == util.ErrPacketTooLarge {
+		// 响应超过数据包大小限制，改为发送简短的错误响应，避免客户端一直等待到超时
+		s.main.Logger.Println("SendData write Error: response too large")
+		short := new(util.SendData)
+		if receive != nil {
+			short.Id = receive.Id
+		}
+		short.Code = util.CODE_INTERNAL
+		short.Message = "response too large"
+		err = sess.write(s.seal(receive, version, short), framed)
+	}
+	if err != nil {
+		s.main.Logger.Println("SendData write Error: " + err.Error())
+	}
+}
+
+// 停止服务：结束进程生命周期，停止接收新连接，已接收的连接不再读取新请求
+// 正在处理的请求由Accept等待结束，可以重复调用
 func (s *Serve) Close() {
-	s.listen.Close()
+	s.main.Shutdown()
+	s.closeOnce.Do(func() {
+		s.listen.Close()
+		if s.admin != nil {
+			s.admin.Close()
+		}
+		s.connWake()
+	})
 }
 
 // 测试数据方法
-func (s *Serve) initTest(conn *net.TCPConn) {
+func (s *Serve) initTest() *util.InitTestData {
 	send := new(util.InitTestData)
 	send.Data = make(map[string]interface{})
 	send.Data["serverType"] = s.serverType
-	json, _ := json.Marshal(send)
-	conn.Write(json)
+	send.Data["roles"] = roleNames(s.serverType)
+	// 列出当前服务器支持的业务方法
+	methods := make([]map[string]interface{}, 0)
+	for _, m := range s.methods.list() {
+		method := map[string]interface{}{
+			"name":   m.Name,
+			"fields": m.Fields,
+			"desc":   m.Desc,
+		}
+		if m.Params != nil {
+			method["params"] = paramSchema(m.Params())
+		}
+		methods = append(methods, method)
+	}
+	send.Data["methods"] = methods
+	return send
 }
 
 // 测试：空方法
-func (s *Serve) empty(data map[string]string) (string, error) {
+func (s *Serve) empty(ctx context.Context, params interface{}) (string, error) {
 	return "i am empty", nil
 }
@@ -3,9 +3,67 @@
 package server
 
 import (
+	"context"
+	"io/ioutil"
+	"log"
+	"os"
 	"testing"
+	"time"
 )
 
 func TestServer1(t *testing.T) {
 
 }
+
+func TestDrain1(t *testing.T) {
+	s := testServe()
+	s.drainTime = 50 * time.Millisecond
+	dir, err := ioutil.TempDir("", "sfss")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	s.jobs, err = newJobManager(s.ctx, dir+"/jobs.json", 1, 10, time.Hour, s.orderRun, log.New(ioutil.Discard, "", 0))
+	if err != nil {
+		t.Fatal("newJobManager failed: ", err.Error())
+	}
+	// 模拟一个卡住的请求，只有取消时才结束
+	s.main.ConnBegin()
+	go func() {
+		<-s.ctx.Done()
+		s.main.ConnEnd()
+	}()
+	done := make(chan bool)
+	go func() {
+		s.drain()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("drain not returned after deadline")
+	}
+	if s.ctx.Err() != context.Canceled || s.main.ConnNum() != 0 {
+		t.Error("stuck operation should be canceled: ", s.main.ConnNum())
+	}
+}
+
+func TestDrain2(t *testing.T) {
+	s := testServe()
+	s.drainTime = time.Minute
+	dir, err := ioutil.TempDir("", "sfss")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	s.jobs, err = newJobManager(s.ctx, dir+"/jobs.json", 1, 10, time.Hour, s.orderRun, log.New(ioutil.Discard, "", 0))
+	if err != nil {
+		t.Fatal("newJobManager failed: ", err.Error())
+	}
+	// 没有正在处理的请求时立即结束，不取消业务操作
+	start := time.Now()
+	s.drain()
+	if time.Since(start) > time.Second || s.ctx.Err() != nil {
+		t.Error("idle drain should return immediately without cancel")
+	}
+}
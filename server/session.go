@@ -0,0 +1,72 @@
+// Copyright (c) 2013 Beijing CmsTop Technology Co.,Ltd. (http://www.cmstop.com)
+
+// Provides client connection
+/*
+客户端连接
+默认每个连接只处理一个请求，响应后关闭连接。
+如果连接的第一个请求设置了keepalive，连接进入持久模式：
+客户端可以在同一连接上连续发送多个带请求编号的数据包，服务器并发处理，
+响应同样使用长度前缀封装并带上请求编号，由客户端按编号匹配。
+响应格式由请求的协议版本决定，见util.PROTOCOL_V1等。
+*/
+
+package server
+
+import (
+	"encoding/json"
+	"net"
+	"sfss/util"
+	"sync"
+)
+
+// 客户端连接
+type session struct {
+	conn     net.Conn       // 客户端连接
+	from     origin         // 请求来源
+	admin    bool           // 是否本地管理接口的连接，请求不加密
+	keep     bool           // 是否为持久连接
+	version  int            // 连接第一个请求的协议版本，用于无法解析请求时的响应
+	wlock    sync.Mutex     // 写锁，持久连接中的请求并发响应
+	inflight chan bool      // 持久连接中正在处理的请求数限制
+	wg       sync.WaitGroup // 等待持久连接中的请求处理完成
+}
+
+// 创建一个客户端连接
+func newSession(conn net.Conn, maxInflight int) *session {
+	sess := new(session)
+	sess.conn = conn
+	if addr := conn.RemoteAddr(); addr != nil {
+		sess.from.remote = addr.String()
+	}
+	sess.inflight = make(chan bool, maxInflight)
+	sess.version = util.PROTOCOL_V1
+	return sess
+}
+
+// 向客户端写入一个响应，framed为是否使用长度前缀封装
+func (s *session) write(v interface{}, framed bool) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	s.wlock.Lock()
+	defer s.wlock.Unlock()
+	if framed {
+		return util.ConnWrite(s.conn, data)
+	}
+	_, err = s.conn.Write(data)
+	return err
+}
+
+// 在持久连接中并发处理一个请求，正在处理的请求数达到上限时阻塞
+func (s *session) dispatch(handle func()) {
+	s.inflight <- true
+	s.wg.Add(1)
+	go func() {
+		defer func() {
+			<-s.inflight
+			s.wg.Done()
+		}()
+		handle()
+	}()
+}
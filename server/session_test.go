@@ -0,0 +1,115 @@
+// Copyright (c) 2013 Beijing CmsTop Technology Co.,Ltd. (http://www.cmstop.com)
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net"
+	"sfss/util"
+	"testing"
+	"time"
+)
+
+func TestClientSendV3(t *testing.T) {
+	client, conn := net.Pipe()
+	defer client.Close()
+	defer conn.Close()
+	s := testServe()
+	sess := newSession(conn, 1)
+	receive := &util.ReceiveData{Id: 7, Version: util.PROTOCOL_V3}
+	go s.clientWrite(sess, receive, []byte("ok"), 0)
+
+	data, err := util.ConnRead(client, time.Second)
+	if err != nil {
+		t.Fatal("ConnRead failed: ", err.Error())
+	}
+	envelope := new(util.ReceiveData)
+	if err = json.Unmarshal(data, envelope); err != nil {
+		t.Fatal("envelope decode failed: ", err.Error())
+	}
+	data, err = s.ctrls.def.crypt.open(envelope)
+	if err != nil {
+		t.Fatal("decrypt failed: ", err.Error())
+	}
+	send := new(util.SendData)
+	json.Unmarshal(data, send)
+	if send.Id != 7 || send.Message != "ok" {
+		t.Error("data check error!")
+	}
+}
+
+func TestClientSendV4(t *testing.T) {
+	client, conn := net.Pipe()
+	defer client.Close()
+	defer conn.Close()
+	s := testServe()
+	sess := newSession(conn, 1)
+	receive := &util.ReceiveData{Id: 8, Version: util.PROTOCOL_V4, Keyid: "k1"}
+	go s.clientWrite(sess, receive, []byte("ok"), 0)
+
+	data, err := util.ConnRead(client, time.Second)
+	if err != nil {
+		t.Fatal("ConnRead failed: ", err.Error())
+	}
+	envelope := new(util.ReceiveData)
+	json.Unmarshal(data, envelope)
+	if envelope.Keyid != "k1" || envelope.Nonce == "" {
+		t.Fatal("envelope check error!")
+	}
+	data, err = util.GcmDecrypt([]byte(envelope.Data), []byte(envelope.Nonce), s.ctrls.def.crypt.keys["k1"])
+	if err != nil {
+		t.Fatal("decrypt failed: ", err.Error())
+	}
+	send := new(util.SendData)
+	json.Unmarshal(data, send)
+	if send.Id != 8 || send.Message != "ok" {
+		t.Error("data check error!")
+	}
+}
+
+func TestClientSendLarge1(t *testing.T) {
+	client, conn := net.Pipe()
+	defer client.Close()
+	defer conn.Close()
+	s := testServe()
+	sess := newSession(conn, 1)
+	receive := &util.ReceiveData{Id: 9, Version: util.PROTOCOL_V2}
+	send := &util.SendData{Message: string(make([]byte, util.MAX_PACKET_SIZE))}
+	go s.clientSend(sess, receive, send)
+
+	data, err := util.ConnRead(client, time.Second)
+	if err != nil {
+		t.Fatal("ConnRead failed: ", err.Error())
+	}
+	send = new(util.SendData)
+	json.Unmarshal(data, send)
+	if send.Id != 9 || send.Code != util.CODE_INTERNAL || send.Message != "response too large" {
+		t.Error("too large response should be replaced: ", send.Code, send.Message)
+	}
+}
+
+func testServe() *Serve {
+	s := new(Serve)
+	s.main = new(util.SFSS)
+	s.main.Logger = log.New(ioutil.Discard, "", 0)
+	s.methods = newRegistry()
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	s.conns = make(map[net.Conn]bool)
+	s.serverType = SERVER_TYPE_ALL
+	s.inflight = 1
+	s.ctrls = new(controllerTable)
+	s.ctrls.def = &controller{crypt: testCryptor()}
+	return s
+}
+
+func testCryptor() *cryptor {
+	c := new(cryptor)
+	c.iv = []byte("1234567890123456")
+	c.key = []byte("1234567890123456")
+	c.keys = map[string][]byte{"k1": []byte("12345678901234567890123456789012")}
+	c.allowCBC = true
+	return c
+}
@@ -4,58 +4,83 @@
 /*
 站点管理
 开站模板nginx.tpl中一共有四个变量，分别是：[DOMAIN] [ALIAS] [ROOT] [LOG]
+修改站点配置时先写入临时文件再原子替换，之后执行nginxTest检测配置并重载Nginx，
+检测或重载失败时恢复原配置文件（新建的配置文件则删除），返回的错误详情中包含Nginx的错误输出，
+避免一个错误的站点配置导致之后所有的重载失败。
+写入、检测、重载和恢复整个过程持有站点修改锁，并发的站点操作（包括批量操作的回滚）依次执行，
+一个操作的恢复不会覆盖另一个操作已经生效的配置，Nginx检测的也总是当前操作写入的配置。
 */
 
 package server
 
 import (
-	"bufio"
+	"context"
 	"errors"
-	"io"
+	"github.com/9466/goconfig"
 	"io/ioutil"
 	"os"
 	"os/exec"
 	"sfss/util"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
-// 站点操作数据字段：创建
-var fieldSiteCreate = [6]string{
-	"siteid",      // 站点编号
-	"domain",      // 站点主域名
-	"alias",       // 站点别名
-	"root",        // 站点目录
-	"connections", // 站点连接数
-	"bandwidth",   // 站点带宽限制
+// 站点操作参数：创建、更新
+type siteParams struct {
+	Siteid      int      `json:"siteid" check:"required,range=1-"`            // 站点编号
+	Domain      string   `json:"domain" check:"required,domain"`              // 站点主域名
+	Alias       []string `json:"alias" check:"domain"`                        // 站点别名
+	Root        string   `json:"root" check:"required,path"`                  // 站点目录
+	Connections int      `json:"connections" check:"required,range=1-100000"` // 站点连接数
+	Bandwidth   int      `json:"bandwidth" check:"required,range=1-10485760"` // 站点带宽限制，单位KB
 }
 
-// 站点操作数据字段：更新
-var fieldSiteUpdate = fieldSiteCreate
-
-// 站点操作数据字段：暂停
-var fieldSitePause = [1]string{"domain"}
+// 站点操作参数：暂停、开启
+type siteDomainParams struct {
+	Domain string `json:"domain" check:"required,domain"` // 站点主域名
+}
 
-// 站点操作数据字段：开启
-var fieldSiteStart = fieldSitePause
+// 站点操作参数：删除
+type siteDeleteParams struct {
+	Domain string `json:"domain" check:"required,domain"` // 站点主域名
+	Root   string `json:"root" check:"required,path"`     // 站点目录
+}
 
-// 站点操作数据字段：删除
-var fieldSiteDelete = [2]string{"domain", "root"}
+// 站点配置，热加载时整体替换
+type siteConf struct {
+	nginxBin     string // Nginx执行程序
+	nginxTest    string // Nginx配置检测命令，默认为nginxBin的程序加-t
+	nginxConfDir string // Nginx配置文件路径
+	siteTpl      string // 站点配置模板
+	siteDir      string // 站点存储根路径
+	logDir       string // 站点日志存储根路径
+}
 
 type site struct {
-	main         *util.SFSS // 系统接口
-	nginxBin     string     // Nginx执行程序
-	nginxConfDir string     // Nginx配置文件路径
-	siteTpl      string     // 站点配置模板
-	siteDir      string     // 站点存储根路径
-	logDir       string     // 站点日志存储根路径
-
+	main   *util.SFSS   // 系统接口
+	lock   sync.RWMutex // 配置锁
+	conf   *siteConf    // 站点配置，每个业务操作开始时取一次，操作过程中不受热加载影响
+	change sync.Mutex   // 站点修改锁，串行执行配置文件的写入、检测、重载和恢复
 }
 
 // 初始化
 func initSite(s *util.SFSS) (*site, error) {
 	site := new(site)
 	site.main = s
-	err := site.checkConfig()
+	conf, err := loadSiteConf(s.Conf)
+	if err != nil {
+		return nil, err
+	}
+	site.conf = conf
+	return site, nil
+}
+
+// 读取并检测站点配置，加载站点模板
+func loadSiteConf(conf *goconfig.ConfigFile) (*siteConf, error) {
+	c := new(siteConf)
+	err := c.checkConfig(conf)
 	if err != nil {
 		return nil, errors.New("checkConfig Error: " + err.Error())
 	}
@@ -69,343 +94,429 @@ func initSite(s *util.SFSS) (*site, error) {
 	if err != nil {
 		return nil, errors.New("Read SiteTpl Error: " + err.Error())
 	}
-	site.siteTpl = string(tpl)
-	return site, nil
+	c.siteTpl = string(tpl)
+	return c, nil
 }
 
 // 检测配置文件
-func (s *site) checkConfig() error {
-	nginxBin, err := s.main.Conf.GetString("site", "nginxBin")
+func (s *siteConf) checkConfig(conf *goconfig.ConfigFile) error {
+	nginxBin, err := conf.GetString("site", "nginxBin")
 	if err != nil {
 		return err
 	}
-	nginxConfDir, err := s.main.Conf.GetString("site", "nginxConfDir")
+	nginxConfDir, err := conf.GetString("site", "nginxConfDir")
 	if err != nil {
 		return err
 	}
-	siteDir, err := s.main.Conf.GetString("site", "siteDir")
+	siteDir, err := conf.GetString("site", "siteDir")
 	if err != nil {
 		return err
 	}
-	logDir, err := s.main.Conf.GetString("site", "logDir")
+	logDir, err := conf.GetString("site", "logDir")
 	if err != nil {
 		return err
 	}
+	nginxTest, _ := conf.GetString("site", "nginxTest")
 	s.nginxBin = nginxBin
+	s.nginxTest = nginxTest
 	s.nginxConfDir = nginxConfDir
 	s.siteDir = siteDir
 	s.logDir = logDir
 	return nil
 }
 
-// 添加站点
-func (s *site) Create(data map[string]string) (msg string, err error) {
-	var ok bool
-	var k, v, config, configFile string
+// 当前的站点配置
+func (s *site) getConf() *siteConf {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.conf
+}
 
-	// 判断站点是否已经存在
-	if v, ok = data["domain"]; !ok || v == "" {
-		return "", errors.New("domain is empty")
-	}
-	configFile = s.nginxConfDir + data["domain"] + ".conf"
-	ok, err = util.IsExist(configFile)
-	// 如果已经存在，直接返回成功
-	if ok == true {
-		return "site is already exists!", nil
-	}
+// 替换站点配置，正在执行的业务操作继续使用原配置
+func (s *site) setConf(c *siteConf) {
+	s.lock.Lock()
+	s.conf = c
+	s.lock.Unlock()
+}
 
-	// 开始处理站点配置文件
-	config = s.siteTpl
-	for _, k = range fieldSiteCreate {
-		if v, ok = data[k]; !ok || v == "" {
-			if k == "alias" {
-				data[k] = ""
-			} else {
-				return "", errors.New(k + " is empty")
-			}
+// 注册站点业务方法，服务器类型不含web时s为nil，方法只记录名称
+func (s *site) register(r *registry) error {
+	methods := []*Method{
+		{Name: "site_create", Desc: "创建站点", ServerType: SERVER_TYPE_WEB, Params: newSiteParams, Handle: s.Create, Undo: s.undoCreate},
+		{Name: "site_update", Desc: "更新站点", ServerType: SERVER_TYPE_WEB, Params: newSiteParams, Handle: s.Update, Undo: s.undoUpdate},
+		{Name: "site_pause", Desc: "暂停站点", ServerType: SERVER_TYPE_WEB, Params: newSiteDomainParams, Handle: s.Pause, Undo: s.undoPause},
+		{Name: "site_start", Desc: "开启站点", ServerType: SERVER_TYPE_WEB, Params: newSiteDomainParams, Handle: s.Start, Undo: s.undoStart},
+		{Name: "site_delete", Desc: "删除站点", ServerType: SERVER_TYPE_WEB, Params: newSiteDeleteParams, Handle: s.Delete, Undo: s.undoDelete},
+	}
+	for _, m := range methods {
+		if err := r.register(m); err != nil {
+			return err
 		}
-		if k == "root" {
-			data[k] = s.siteDir + data[k]
+	}
+	return nil
+}
+
+func newSiteParams() interface{}       { return new(siteParams) }
+func newSiteDomainParams() interface{} { return new(siteDomainParams) }
+func newSiteDeleteParams() interface{} { return new(siteDeleteParams) }
+
+// 按站点模板生成Nginx配置
+func (s *siteConf) config(p *siteParams) string {
+	r := strings.NewReplacer(
+		"[SITEID]", strconv.Itoa(p.Siteid),
+		"[DOMAIN]", p.Domain,
+		"[ALIAS]", strings.Join(p.Alias, " "),
+		"[ROOT]", s.siteDir+p.Root,
+		"[CONNECTIONS]", strconv.Itoa(p.Connections),
+		"[BANDWIDTH]", strconv.Itoa(p.Bandwidth),
+		"[LOG]", s.logDir+p.Domain+"_access.log",
+	)
+	return r.Replace(s.siteTpl)
+}
+
+// 重载Nginx使配置变更生效，ctx取消时终止Nginx进程
+// nginxBin可以带参数，如 "/usr/local/nginx/sbin/nginx -s reload"
+func (s *siteConf) reload(ctx context.Context) error {
+	argv := strings.Fields(s.nginxBin)
+	if len(argv) == 0 {
+		return util.NewError(util.CODE_UNAVAILABLE, "Nginx reload Error! nginxBin is empty")
+	}
+	cmd := exec.CommandContext(ctx, argv[0], argv[1:]...)
+	_, err := cmd.Output()
+	if err != nil {
+		e := util.WrapError(util.CODE_UNAVAILABLE, "Nginx reload Error!", err)
+		if ee, ok := err.(*exec.ExitError); ok {
+			e.Details.Output = strings.TrimSpace(string(ee.Stderr))
 		}
-		config = strings.Replace(config, "["+strings.ToUpper(k)+"]", data[k], 1)
+		return e
 	}
-	// 日志单独处理
-	log := s.logDir + data["domain"] + "_access.log"
-	config = strings.Replace(config, "[LOG]", log, 1)
+	return nil
+}
 
-	// 写入配置文件
-	err = ioutil.WriteFile(configFile, []byte(config), 0664)
+// 检测Nginx配置，失败时错误详情中包含Nginx的输出
+// 未配置nginxTest时执行nginxBin的程序加-t，如 "/usr/local/nginx/sbin/nginx -t"
+func (s *siteConf) test(ctx context.Context) error {
+	argv := strings.Fields(s.nginxTest)
+	if len(argv) == 0 {
+		argv = strings.Fields(s.nginxBin)
+		if len(argv) == 0 {
+			return util.NewError(util.CODE_UNAVAILABLE, "Nginx config test Error! nginxBin is empty")
+		}
+		argv = []string{argv[0], "-t"}
+	}
+	bin, err := exec.LookPath(argv[0])
 	if err != nil {
-		return "", errors.New("Nginx Config Write Error!" + err.Error())
+		return util.WrapError(util.CODE_UNAVAILABLE, "Nginx config test Error!", err)
+	}
+	output, err := exec.CommandContext(ctx, bin, argv[1:]...).CombinedOutput()
+	if err != nil {
+		e := util.WrapError(util.CODE_UNAVAILABLE, "Nginx config test failed!", err)
+		e.Details.Output = strings.TrimSpace(string(output))
+		return e
+	}
+	return nil
+}
+
+// 使用配置c重载Nginx，并记录监控指标
+func (s *site) reload(ctx context.Context, c *siteConf) error {
+	start := time.Now()
+	err := c.reload(ctx)
+	nginxMetrics(s.main.Metrics, err, time.Since(start))
+	return err
+}
+
+// 添加站点
+func (s *site) Create(ctx context.Context, params interface{}) (msg string, err error) {
+	c := s.getConf()
+	p := params.(*siteParams)
+
+	// 判断站点是否已经存在
+	configFile := c.nginxConfDir + p.Domain + ".conf"
+	ok, err := util.IsExist(configFile)
+	// 如果已经存在，直接返回成功
+	if ok == true {
+		return "site is already exists!", nil
 	}
 
 	// 创建站点目录
-	err = os.Mkdir(data["root"], 0755)
+	root := c.siteDir + p.Root
+	err = os.Mkdir(root, 0755)
 	if err != nil {
-		return "", errors.New("Site dir create failed!" + err.Error())
+		code := util.CODE_INTERNAL
+		if os.IsExist(err) {
+			code = util.CODE_EXISTS
+		}
+		return "", util.WrapError(code, "Site dir create failed!", err)
 	}
 	// 设置站点目录权限
 
-	// 重截Nginx使配置变更生效
-	var argv []string
-	if strings.Index(s.nginxBin, " ") >= 0 {
-		argv = strings.Split(s.nginxBin, " ")
-		s.nginxBin = argv[0]
-		argv = argv[1:]
-	} else {
-		argv = make([]string, 0)
-	}
-	cmd := exec.Command(s.nginxBin, argv...)
-	_, err = cmd.Output()
+	// 写入配置文件并重载Nginx使配置变更生效
+	JobProgress(ctx, 50, "nginx reload")
+	err = s.apply(ctx, c, configFile, []byte(c.config(p)))
 	if err != nil {
-		return "", errors.New("Nginx reload Error!" + err.Error())
+		os.Remove(root) // 只删除刚创建的空目录
+		return "", err
 	}
 
 	return "site create ok", nil
 }
 
 // 更新站点
-func (s *site) Update(data map[string]string) (msg string, err error) {
-	var ok bool
-	var k, v, config, configFile string
-
-	// 开始处理站点配置文件
-	config = s.siteTpl
-	for _, k = range fieldSiteUpdate {
-		if v, ok = data[k]; !ok || v == "" {
-			if k == "alias" {
-				data[k] = ""
-			} else {
-				return "", errors.New(k + " is empty")
-			}
-		}
-		if k == "root" {
-			data[k] = s.siteDir + data[k]
-		}
-		config = strings.Replace(config, "["+strings.ToUpper(k)+"]", data[k], 1)
-	}
-	// 日志单独处理
-	log := s.logDir + data["domain"] + "_access.log"
-	config = strings.Replace(config, "[LOG]", log, 1)
-
-	// 写入配置文件
-	configFile = s.nginxConfDir + data["domain"] + ".conf"
-	err = ioutil.WriteFile(configFile, []byte(config), 0664)
-	if err != nil {
-		return "", errors.New("Nginx Config Write Error!" + err.Error())
-	}
+func (s *site) Update(ctx context.Context, params interface{}) (msg string, err error) {
+	c := s.getConf()
+	p := params.(*siteParams)
 
 	// 创建站点目录
-	ok, _ = util.IsExist(data["root"])
+	root := c.siteDir + p.Root
+	ok, _ := util.IsExist(root)
 	if ok == false {
-		err = os.Mkdir(data["root"], 0755)
+		err = os.Mkdir(root, 0755)
 		if err != nil {
-			return "", errors.New("Site dir create failed!" + err.Error())
+			return "", util.WrapError(util.CODE_INTERNAL, "Site dir create failed!", err)
 		}
 	}
 
 	// 设置站点目录权限
 
-	// 重截Nginx使配置变更生效
-	var argv []string
-	if strings.Index(s.nginxBin, " ") >= 0 {
-		argv = strings.Split(s.nginxBin, " ")
-		s.nginxBin = argv[0]
-		argv = argv[1:]
-	} else {
-		argv = make([]string, 0)
-	}
-	cmd := exec.Command(s.nginxBin, argv...)
-	_, err = cmd.Output()
+	// 写入配置文件并重载Nginx使配置变更生效
+	JobProgress(ctx, 50, "nginx reload")
+	configFile := c.nginxConfDir + p.Domain + ".conf"
+	err = s.apply(ctx, c, configFile, []byte(c.config(p)))
 	if err != nil {
-		return "", errors.New("Nginx reload Error!" + err.Error())
+		return "", err
 	}
 
 	return "site update ok", nil
 }
 
 // 暂停站点
-func (s *site) Pause(data map[string]string) (msg string, err error) {
-	var ok bool
-	var k, v, config, configFile string
-
-	// 开始处理站点配置文件
-	// 判断参数
-	for _, k = range fieldSitePause {
-		if v, ok = data[k]; !ok || v == "" {
-			return "", errors.New(k + " is empty")
-		}
-	}
-	configFile = s.nginxConfDir + data["domain"] + ".conf"
-	// 读取配置文件
-	ok, _ = util.IsExist(configFile)
-	if ok == false {
-		return "", errors.New("Site " + data["domain"] + " not exist!")
-	}
-	fileHandle, err := os.OpenFile(configFile, os.O_RDWR, 0664)
-	defer fileHandle.Close()
+func (s *site) Pause(ctx context.Context, params interface{}) (msg string, err error) {
+	c := s.getConf()
+	domain := params.(*siteDomainParams).Domain
+
+	// 读取配置文件，读取和写入之间持有站点修改锁
+	s.change.Lock()
+	defer s.change.Unlock()
+	configFile := c.nginxConfDir + domain + ".conf"
+	lines, err := readSiteConfig(configFile, domain)
 	if err != nil {
-		return "", errors.New("Nginx site config file open failed!" + err.Error())
+		return "", err
+	}
+	if len(lines) > 0 && lines[0][0] == '#' {
+		return "", util.NewError(util.CODE_CONFLICT, "site already paused!")
 	}
-	reader := bufio.NewReader(fileHandle)
-	config = ""
 	// 注释掉配置文件
-	var i int = 0
-	for {
-		line, err := reader.ReadString('\n')
-		if err != nil {
-			if err == io.EOF {
-				break
-			} else {
-				return "", errors.New("Nginx site config read error!" + err.Error())
-			}
-		}
-		if i == 0 && len(line) > 0 && line[0] == '#' {
-			return "", errors.New("site already paused!")
-		}
+	config := ""
+	for _, line := range lines {
 		config += "#" + line
-		i++
-	}
-	// 写入配置文件
-	_, err = fileHandle.WriteAt([]byte(config), 0)
-	if err != nil {
-		return "", errors.New("Nginx Config Write Error!" + err.Error())
 	}
 
-	// 重截Nginx使配置变更生效
-	var argv []string
-	if strings.Index(s.nginxBin, " ") >= 0 {
-		argv = strings.Split(s.nginxBin, " ")
-		s.nginxBin = argv[0]
-		argv = argv[1:]
-	} else {
-		argv = make([]string, 0)
-	}
-	cmd := exec.Command(s.nginxBin, argv...)
-	_, err = cmd.Output()
+	// 写入配置文件并重载Nginx使配置变更生效
+	err = s.applyLocked(ctx, c, configFile, []byte(config))
 	if err != nil {
-		return "", errors.New("Nginx reload Error!" + err.Error())
+		return "", err
 	}
 
 	return "site pause ok", nil
 }
 
 // 开启站点
-func (s *site) Start(data map[string]string) (msg string, err error) {
-	var ok bool
-	var k, v, config, configFile string
-
-	// 开始处理站点配置文件
-	// 判断参数
-	for _, k = range fieldSiteStart {
-		if v, ok = data[k]; !ok || v == "" {
-			return "", errors.New(k + " is empty")
-		}
+func (s *site) Start(ctx context.Context, params interface{}) (msg string, err error) {
+	c := s.getConf()
+	domain := params.(*siteDomainParams).Domain
+
+	// 读取配置文件，读取和写入之间持有站点修改锁
+	s.change.Lock()
+	defer s.change.Unlock()
+	configFile := c.nginxConfDir + domain + ".conf"
+	lines, err := readSiteConfig(configFile, domain)
+	if err != nil {
+		return "", err
 	}
-	configFile = s.nginxConfDir + data["domain"] + ".conf"
-	// 读取配置文件
-	ok, _ = util.IsExist(configFile)
-	if ok == false {
-		return "", errors.New("Site " + data["domain"] + " not exist!")
+	if len(lines) > 0 && lines[0][0] != '#' {
+		return "", util.NewError(util.CODE_CONFLICT, "site already started!")
 	}
-	fileHandle, err := os.OpenFile(configFile, os.O_RDWR, 0664)
-	defer fileHandle.Close()
+	// 清理注释配置文件
+	config := ""
+	for _, line := range lines {
+		config += strings.TrimPrefix(line, "#")
+	}
+
+	// 写入配置文件并重载Nginx使配置变更生效
+	err = s.applyLocked(ctx, c, configFile, []byte(config))
 	if err != nil {
-		return "", errors.New("Nginx site config file open failed!" + err.Error())
+		return "", err
 	}
-	reader := bufio.NewReader(fileHandle)
-	config = ""
-	// 清理注释配置文件
-	var i int = 0
-	for {
-		line, err := reader.ReadString('\n')
-		if err != nil {
-			if err == io.EOF {
-				break
-			} else {
-				return "", errors.New("Nginx site config read error!" + err.Error())
-			}
-		}
-		if i == 0 && len(line) > 0 && line[0] != '#' {
-			return "", errors.New("site already started!")
-		}
-		config += string(line[1:])
-		i++
+
+	return "site start ok", nil
+}
+
+// 删除站点
+func (s *site) Delete(ctx context.Context, params interface{}) (msg string, err error) {
+	c := s.getConf()
+	p := params.(*siteDeleteParams)
+	root := c.siteDir + p.Root
+
+	// 删除配置文件并重载Nginx使配置变更生效
+	configFile := c.nginxConfDir + p.Domain + ".conf"
+	err = s.apply(ctx, c, configFile, nil)
+	if err != nil {
+		return "", err
 	}
-	// 写入配置文件
-	fileHandle.Truncate(0)
-	_, err = fileHandle.WriteAt([]byte(config), 0)
+	// 删除站点目录
+	os.Rename(root, root+".bak")
+
+	// 删除站点日志
+	log := c.logDir + p.Domain + "_access.log"
+	err = os.Remove(log)
 	if err != nil {
-		return "", errors.New("Nginx Config Write Error!" + err.Error())
+		if _, ok := err.(*os.PathError); !ok {
+			return "", util.WrapError(util.CODE_INTERNAL, "Nginx site logfile delete Error!", err)
+		}
 	}
 
-	// 重截Nginx使配置变更生效
-	var argv []string
-	if strings.Index(s.nginxBin, " ") >= 0 {
-		argv = strings.Split(s.nginxBin, " ")
-		s.nginxBin = argv[0]
-		argv = argv[1:]
-	} else {
-		argv = make([]string, 0)
+	return "site delete ok", nil
+}
+
+// 读取站点配置文件，按行返回，每行包含换行符
+func readSiteConfig(configFile, domain string) ([]string, error) {
+	data, err := ioutil.ReadFile(configFile)
+	if os.IsNotExist(err) {
+		return nil, util.NewError(util.CODE_NOT_FOUND, "Site "+domain+" not exist!")
 	}
-	cmd := exec.Command(s.nginxBin, argv...)
-	_, err = cmd.Output()
 	if err != nil {
-		return "", errors.New("Nginx reload Error!" + err.Error())
+		return nil, util.WrapError(util.CODE_INTERNAL, "Nginx site config read error!", err)
+	}
+	lines := strings.SplitAfter(string(data), "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
 	}
+	return lines, nil
+}
 
-	return "site start ok", nil
+// 以事务方式应用站点配置文件，config为nil表示删除配置文件
+// 新配置先写入临时文件再原子替换，Nginx配置检测或重载失败时恢复原配置文件，
+// 不会留下导致之后所有站点重载失败的配置，错误详情中包含Nginx的错误输出
+func (s *site) apply(ctx context.Context, c *siteConf, configFile string, config []byte) error {
+	s.change.Lock()
+	defer s.change.Unlock()
+	return s.applyLocked(ctx, c, configFile, config)
 }
 
-// 删除站点
-func (s *site) Delete(data map[string]string) (msg string, err error) {
-	var ok bool
-	var k, v, configFile string
-
-	// 开始处理站点配置文件
-	// 判断参数
-	for _, k = range fieldSiteDelete {
-		if v, ok = data[k]; !ok || v == "" {
-			return "", errors.New(k + " is empty")
+// 应用站点配置文件，调用时需持有s.change
+func (s *site) applyLocked(ctx context.Context, c *siteConf, configFile string, config []byte) error {
+	old, err := ioutil.ReadFile(configFile)
+	if err != nil && !os.IsNotExist(err) {
+		return util.WrapError(util.CODE_INTERNAL, "Nginx site config read error!", err)
+	}
+	existed := err == nil
+	if config == nil {
+		err = os.Remove(configFile)
+		if err != nil && !os.IsNotExist(err) {
+			return util.WrapError(util.CODE_INTERNAL, "Nginx site config delete Error!", err)
 		}
-		if k == "root" {
-			data[k] = s.siteDir + data[k]
+	} else {
+		err = util.WriteFileAtomic(configFile, config, 0664)
+		if err != nil {
+			return util.WrapError(util.CODE_INTERNAL, "Nginx Config Write Error!", err)
 		}
 	}
-	configFile = s.nginxConfDir + data["domain"] + ".conf"
-	// 删除配置文件
-	err = os.Remove(configFile)
-	if err != nil {
-		if _, ok := err.(*os.PathError); !ok {
-			return "", errors.New("Nginx site config delete Error!" + err.Error())
+	err = c.test(ctx)
+	if err == nil {
+		err = s.reload(ctx, c)
+	}
+	if err == nil {
+		return nil
+	}
+	// 恢复原配置文件
+	var rerr error
+	if existed {
+		rerr = util.WriteFileAtomic(configFile, old, 0664)
+	} else {
+		rerr = os.Remove(configFile)
+		if os.IsNotExist(rerr) {
+			rerr = nil
 		}
 	}
+	if rerr != nil {
+		s.main.Log.Error("Nginx site config restore Error: "+rerr.Error(), util.LogFields{"file": configFile})
+	}
+	return err
+}
 
-	// 重截Nginx使配置变更生效
-	var argv []string
-	if strings.Index(s.nginxBin, " ") >= 0 {
-		argv = strings.Split(s.nginxBin, " ")
-		s.nginxBin = argv[0]
-		argv = argv[1:]
-	} else {
-		argv = make([]string, 0)
+// 站点配置文件快照，返回恢复快照并重载Nginx的函数
+func (s *site) snapshot(domain string) (func() error, error) {
+	c := s.getConf()
+	configFile := c.nginxConfDir + domain + ".conf"
+	config, err := ioutil.ReadFile(configFile)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, util.WrapError(util.CODE_INTERNAL, "Nginx site config read error!", err)
+	}
+	if os.IsNotExist(err) {
+		config = nil // 恢复时删除配置文件
+	} else if config == nil {
+		config = []byte{}
+	}
+	return func() error {
+		return s.apply(context.Background(), c, configFile, config)
+	}, nil
+}
+
+// 回滚准备：添加站点
+func (s *site) undoCreate(params interface{}) (func() error, error) {
+	c := s.getConf()
+	p := params.(*siteParams)
+	configFile := c.nginxConfDir + p.Domain + ".conf"
+	if ok, _ := util.IsExist(configFile); ok {
+		return func() error { return nil }, nil // 站点已经存在，添加不会做任何修改
 	}
-	cmd := exec.Command(s.nginxBin, argv...)
-	_, err = cmd.Output()
+	restore, err := s.snapshot(p.Domain)
 	if err != nil {
-		return "", errors.New("Nginx reload Error!" + err.Error())
+		return nil, err
 	}
-	// 删除站点目录
-	os.Rename(data["root"], data["root"]+".bak")
+	root := c.siteDir + p.Root
+	return func() error {
+		os.Remove(root) // 只删除空的站点目录
+		return restore()
+	}, nil
+}
 
-	// 删除站点日志
-	log := s.logDir + data["domain"] + "_access.log"
-	err = os.Remove(log)
+// 回滚准备：更新站点
+func (s *site) undoUpdate(params interface{}) (func() error, error) {
+	return s.snapshot(params.(*siteParams).Domain)
+}
+
+// 回滚准备：暂停站点
+func (s *site) undoPause(params interface{}) (func() error, error) {
+	p := *params.(*siteDomainParams)
+	return func() error {
+		_, err := s.Start(context.Background(), &p)
+		return err
+	}, nil
+}
+
+// 回滚准备：开启站点
+func (s *site) undoStart(params interface{}) (func() error, error) {
+	p := *params.(*siteDomainParams)
+	return func() error {
+		_, err := s.Pause(context.Background(), &p)
+		return err
+	}, nil
+}
+
+// 回滚准备：删除站点，站点日志无法恢复
+func (s *site) undoDelete(params interface{}) (func() error, error) {
+	c := s.getConf()
+	p := params.(*siteDeleteParams)
+	restore, err := s.snapshot(p.Domain)
 	if err != nil {
-		if _, ok := err.(*os.PathError); !ok {
-			return "", errors.New("Nginx site logfile delete Error!" + err.Error())
-		}
+		return nil, err
 	}
-
-	return "site delete ok", nil
+	root := c.siteDir + p.Root
+	return func() error {
+		if ok, _ := util.IsExist(root + ".bak"); ok {
+			os.Rename(root+".bak", root)
+		}
+		return restore()
+	}, nil
 }
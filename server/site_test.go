@@ -3,9 +3,128 @@
 package server
 
 import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sfss/util"
+	"strconv"
+	"sync"
 	"testing"
 )
 
 func TestSiteCreate(t *testing.T) {
 
 }
+
+// 测试用的站点，nginxTest为配置检测命令
+func testSite(t *testing.T, nginxTest string) (*site, *siteConf, string) {
+	dir, err := ioutil.TempDir("", "sfss-site")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	c := new(siteConf)
+	c.nginxBin = "true"
+	c.nginxTest = nginxTest
+	c.nginxConfDir = dir + "/"
+	c.siteDir = dir + "/"
+	c.logDir = dir + "/"
+	c.siteTpl = "server_name [DOMAIN];\nroot [ROOT];\n"
+	s := new(site)
+	s.main = new(util.SFSS)
+	s.conf = c
+	return s, c, dir
+}
+
+func TestSiteApply1(t *testing.T) {
+	s, c, dir := testSite(t, "false")
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "a.com.conf")
+	ioutil.WriteFile(file, []byte("old config\n"), 0664)
+	// 配置检测失败时恢复原配置
+	err := s.apply(context.Background(), c, file, []byte("bad config\n"))
+	if e, ok := err.(*util.Error); !ok || e.Code != util.CODE_UNAVAILABLE {
+		t.Fatal("apply should fail with unavailable: ", err)
+	}
+	data, _ := ioutil.ReadFile(file)
+	if string(data) != "old config\n" {
+		t.Error("config should be restored: ", string(data))
+	}
+	// 新建的配置文件被删除
+	file = filepath.Join(dir, "b.com.conf")
+	s.apply(context.Background(), c, file, []byte("bad config\n"))
+	if ok, _ := util.IsExist(file); ok {
+		t.Error("new config should be removed")
+	}
+	// 删除失败时恢复
+	file = filepath.Join(dir, "a.com.conf")
+	s.apply(context.Background(), c, file, nil)
+	if ok, _ := util.IsExist(file); !ok {
+		t.Error("deleted config should be restored")
+	}
+	if files, _ := filepath.Glob(filepath.Join(dir, ".*.tmp")); len(files) > 0 {
+		t.Error("temp files should be removed: ", files)
+	}
+}
+
+func TestSitePause1(t *testing.T) {
+	s, _, dir := testSite(t, "true")
+	defer os.RemoveAll(dir)
+	ctx := context.Background()
+	p := &siteParams{Siteid: 1, Domain: "a.com", Root: "a.com", Connections: 1, Bandwidth: 1}
+	_, err := s.Create(ctx, p)
+	if err != nil {
+		t.Fatal("site create failed: ", err.Error())
+	}
+	file := filepath.Join(dir, "a.com.conf")
+	origin, _ := ioutil.ReadFile(file)
+	_, err = s.Pause(ctx, &siteDomainParams{Domain: "a.com"})
+	if err != nil {
+		t.Fatal("site pause failed: ", err.Error())
+	}
+	data, _ := ioutil.ReadFile(file)
+	if string(data) != "#server_name a.com;\n#root "+dir+"/a.com;\n" {
+		t.Error("paused config mismatch: ", string(data))
+	}
+	_, err = s.Pause(ctx, &siteDomainParams{Domain: "a.com"})
+	if e, ok := err.(*util.Error); !ok || e.Code != util.CODE_CONFLICT {
+		t.Error("pause twice should conflict: ", err)
+	}
+	_, err = s.Start(ctx, &siteDomainParams{Domain: "a.com"})
+	if err != nil {
+		t.Fatal("site start failed: ", err.Error())
+	}
+	data, _ = ioutil.ReadFile(file)
+	if string(data) != string(origin) {
+		t.Error("started config mismatch: ", string(data))
+	}
+	_, err = s.Start(ctx, &siteDomainParams{Domain: "b.com"})
+	if e, ok := err.(*util.Error); !ok || e.Code != util.CODE_NOT_FOUND {
+		t.Error("start missing site should be not found: ", err)
+	}
+}
+
+func TestSiteApply2(t *testing.T) {
+	s, c, dir := testSite(t, "")
+	defer os.RemoveAll(dir)
+	// 检测命令执行期间如果有其他操作同时检测，记录overlap
+	script := filepath.Join(dir, "test.sh")
+	ioutil.WriteFile(script, []byte("#!/bin/sh\ncd "+dir+"\n"+
+		"[ -e running ] && touch overlap\ntouch running\nsleep 0.02\nrm -f running\n"), 0755)
+	c.nginxTest = script
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			file := filepath.Join(dir, strconv.Itoa(i)+".com.conf")
+			if err := s.apply(context.Background(), c, file, []byte("config\n")); err != nil {
+				t.Error("apply failed: ", err.Error())
+			}
+		}(i)
+	}
+	wg.Wait()
+	if ok, _ := util.IsExist(filepath.Join(dir, "overlap")); ok {
+		t.Error("concurrent apply should be serialized")
+	}
+}
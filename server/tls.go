@@ -0,0 +1,74 @@
+// Copyright (c) 2013 Beijing CmsTop Technology Co.,Ltd. (http://www.cmstop.com)
+
+// Provides TLS listener
+/*
+TLS加密
+开启后TCP接口和HTTP接口都使用TLS，配置clientCA后要求客户端提供由该CA签发的证书，
+客户端证书主题可以在控制端密钥表中绑定到控制端（subject），用于权限检测和日志。
+*/
+
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"github.com/9466/goconfig"
+	"io/ioutil"
+	"sfss/util"
+)
+
+// 加载TLS配置，未开启时返回nil
+func loadTLSConfig(conf *goconfig.ConfigFile) (*tls.Config, error) {
+	enable, _ := conf.GetBool("tls", "enable")
+	if !enable {
+		return nil, nil
+	}
+	certFile, err := conf.GetString("tls", "cert")
+	if err != nil {
+		return nil, err
+	}
+	keyFile, err := conf.GetString("tls", "key")
+	if err != nil {
+		return nil, err
+	}
+	if certFile, err = util.GetPath(certFile); err != nil {
+		return nil, err
+	}
+	if keyFile, err = util.GetPath(keyFile); err != nil {
+		return nil, err
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, errors.New("TLS certificate load Error: " + err.Error())
+	}
+	config := new(tls.Config)
+	config.Certificates = []tls.Certificate{cert}
+	config.MinVersion = tls.VersionTLS12
+	// 要求客户端证书
+	caFile, _ := conf.GetString("tls", "clientCA")
+	if caFile != "" {
+		if caFile, err = util.GetPath(caFile); err != nil {
+			return nil, err
+		}
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, errors.New("TLS clientCA read Error: " + err.Error())
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("TLS clientCA has no valid certificate")
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+// 获取TLS连接的客户端证书，没有时返回nil
+func peerCertificate(state *tls.ConnectionState) *x509.Certificate {
+	if state == nil || len(state.PeerCertificates) == 0 {
+		return nil
+	}
+	return state.PeerCertificates[0]
+}
@@ -0,0 +1,335 @@
+// Copyright (c) 2013 Beijing CmsTop Technology Co.,Ltd. (http://www.cmstop.com)
+
+// Provides audit trail
+/*
+审计日志
+每个控制操作记录一行JSON（AuditData）追加到单独的审计文件，不切割也不修改已有记录。
+开启hash链时，每条记录包含上一条记录的hash（prev）和本条记录的hash，
+hash为sha256(本条记录hash字段为空时的JSON)，修改或删除任意一条记录都会使之后的校验失败，见Verify。
+Query按站点域名、数据库名称、方法和时间范围查询记录，批量操作按子操作的数据匹配，
+返回的记录数和总长度都有上限（AUDIT_QUERY_MAX、AUDIT_QUERY_BYTES），保证响应不超过数据包大小限制，
+省略了更早的记录时以最早一条记录的时间作为until继续查询。
+平滑重启时新进程使用NewPendingAuditLog，父进程关闭文件前记录暂存在内存中，
+Attach时接着父进程的最后一条记录写入，hash链保持连续；暂存的记录写入前不能被查询。
+*/
+
+package util
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	AUDIT_QUERY_LIMIT = 100     // 默认查询返回的记录数
+	AUDIT_QUERY_MAX   = 1000    // 查询返回的最大记录数
+	AUDIT_LINE_MAX    = 1 << 20 // 单条记录的最大长度
+	AUDIT_QUERY_BYTES = 1 << 19 // 查询返回记录的最大总长度，加密和base64编码后不超过MAX_PACKET_SIZE
+)
+
+// 审计记录查询条件，为空的条件不限制
+type AuditQuery struct {
+	Controller string // 控制端编号，只返回该控制端的记录
+	Domain     string // 站点域名
+	Name       string // 数据库名称
+	Method     string // 业务操作类型
+	Since      int64  // 开始时间，unix时间戳，包含
+	Until      int64  // 结束时间，unix时间戳，包含
+	Limit      int    // 返回的记录数，返回最新的记录
+}
+
+// 审计日志，可以在多个协程中并发使用
+type AuditLog struct {
+	file    string       // 审计文件
+	chain   bool         // 是否开启hash链
+	lock    sync.Mutex   // 写入锁
+	fh      *os.File     // 审计文件句柄
+	last    string       // 最后一条记录的hash
+	pending []*AuditData // 等待Attach写入的记录，为nil时不暂存
+}
+
+// 打开审计日志，开启hash链时从最后一条记录继续
+func NewAuditLog(file string, chain bool) (*AuditLog, error) {
+	a := new(AuditLog)
+	a.file = file
+	a.chain = chain
+	err := a.open()
+	if err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// 创建暂不打开文件的审计日志，追加的记录暂存在内存中，Attach时写入文件
+func NewPendingAuditLog(file string, chain bool) *AuditLog {
+	a := new(AuditLog)
+	a.file = file
+	a.chain = chain
+	a.pending = make([]*AuditData, 0)
+	return a
+}
+
+// 打开审计文件并写入暂存的记录
+func (a *AuditLog) Attach() error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.fh != nil {
+		return errors.New("audit file is already attached")
+	}
+	err := a.open()
+	if err != nil {
+		return err
+	}
+	pending := a.pending
+	a.pending = nil
+	for _, e := range pending {
+		err = a.write(e)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 打开审计文件，开启hash链时读取最后一条记录的hash
+func (a *AuditLog) open() error {
+	if a.chain {
+		err := a.scan(func(e *AuditData, line int) error {
+			a.last = e.Hash
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	fh, err := os.OpenFile(a.file, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+	if err != nil {
+		return errors.New("audit file open Error: " + err.Error())
+	}
+	a.fh = fh
+	return nil
+}
+
+// 追加一条审计记录，开启hash链时设置记录的prev和hash
+func (a *AuditLog) Append(e *AuditData) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.fh == nil && a.pending != nil {
+		r := *e
+		a.pending = append(a.pending, &r)
+		return nil
+	}
+	if a.fh == nil {
+		return errors.New("audit file closed")
+	}
+	return a.write(e)
+}
+
+// 写入一条记录，调用时需持有a.lock
+func (a *AuditLog) write(e *AuditData) error {
+	e.Prev = ""
+	e.Hash = ""
+	if a.chain {
+		e.Prev = a.last
+		hash, err := auditHash(e)
+		if err != nil {
+			return err
+		}
+		e.Hash = hash
+	}
+	data, err := json.Marshal(e)
+	if err != nil {
+		return errors.New("audit json encode Error: " + err.Error())
+	}
+	_, err = a.fh.Write(append(data, '\n'))
+	if err == nil {
+		err = a.fh.Sync()
+	}
+	if err != nil {
+		return errors.New("audit file write Error: " + err.Error())
+	}
+	if a.chain {
+		a.last = e.Hash
+	}
+	return nil
+}
+
+// 查询审计记录，返回符合条件的最新记录，按时间顺序排列
+// 记录数超过limit或总长度超过AUDIT_QUERY_BYTES时省略更早的记录，more为true
+// 单条记录超过AUDIT_QUERY_BYTES时不返回业务数据
+func (a *AuditLog) Query(q *AuditQuery) (result []AuditData, more bool, err error) {
+	limit := q.Limit
+	if limit <= 0 {
+		limit = AUDIT_QUERY_LIMIT
+	}
+	if limit > AUDIT_QUERY_MAX {
+		limit = AUDIT_QUERY_MAX
+	}
+	result = make([]AuditData, 0)
+	err = a.scan(func(e *AuditData, line int) error {
+		if q.match(e) {
+			result = append(result, *e)
+			if len(result) > limit {
+				result = result[1:]
+				more = true
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	// 从最新的记录开始累计长度
+	total := 0
+	for i := len(result) - 1; i >= 0; i-- {
+		data, _ := json.Marshal(&result[i])
+		if len(data) > AUDIT_QUERY_BYTES && i == len(result)-1 {
+			result[i].Data = map[string]interface{}{"omitted": "record too large"}
+			data, _ = json.Marshal(&result[i])
+		}
+		total += len(data)
+		if total > AUDIT_QUERY_BYTES {
+			return result[i+1:], true, nil
+		}
+	}
+	return result, more, nil
+}
+
+// 校验hash链，返回校验的记录数，记录被修改或删除时返回错误
+func (a *AuditLog) Verify() (int, error) {
+	prev := ""
+	n := 0
+	err := a.scan(func(e *AuditData, line int) error {
+		n++
+		if e.Hash == "" {
+			prev = "" // 未开启hash链时的记录
+			return nil
+		}
+		if e.Prev != prev {
+			return errors.New("audit line " + strconv.Itoa(line) + " Error: prev hash mismatch")
+		}
+		hash := e.Hash
+		check, err := auditHash(e)
+		if err != nil {
+			return err
+		}
+		if check != hash {
+			return errors.New("audit line " + strconv.Itoa(line) + " Error: hash mismatch")
+		}
+		prev = hash
+		return nil
+	})
+	return n, err
+}
+
+// 关闭审计日志，未Attach时暂存的记录丢弃并返回错误
+func (a *AuditLog) Close() error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.fh == nil {
+		n := len(a.pending)
+		a.pending = nil
+		if n > 0 {
+			return errors.New("audit file not attached, " + strconv.Itoa(n) + " records dropped")
+		}
+		return nil
+	}
+	err := a.fh.Close()
+	a.fh = nil
+	return err
+}
+
+// 依次读取每条记录，文件不存在时没有记录
+func (a *AuditLog) scan(f func(e *AuditData, line int) error) error {
+	fh, err := os.Open(a.file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.New("audit file open Error: " + err.Error())
+	}
+	defer fh.Close()
+	scanner := bufio.NewScanner(fh)
+	scanner.Buffer(make([]byte, 64*1024), AUDIT_LINE_MAX)
+	line := 0
+	for scanner.Scan() {
+		line++
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		e := new(AuditData)
+		dec := json.NewDecoder(bytes.NewReader(scanner.Bytes()))
+		dec.UseNumber() // 保持数字原样，校验hash时重新编码结果不变
+		err = dec.Decode(e)
+		if err != nil {
+			return errors.New("audit line " + strconv.Itoa(line) + " Error: " + err.Error())
+		}
+		err = f(e, line)
+		if err != nil {
+			return err
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return errors.New("audit file read Error: " + err.Error())
+	}
+	return nil
+}
+
+// 计算记录的hash，hash字段不参与计算
+func auditHash(e *AuditData) (string, error) {
+	c := *e
+	c.Hash = ""
+	data, err := json.Marshal(&c)
+	if err != nil {
+		return "", errors.New("audit json encode Error: " + err.Error())
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// 判断记录是否符合查询条件
+func (q *AuditQuery) match(e *AuditData) bool {
+	if q.Controller != "" && e.Controller != q.Controller && !strings.HasPrefix(e.Controller, q.Controller+"(") {
+		return false // 记录的控制端标识为编号或“编号(名称)”
+	}
+	if q.Method != "" && q.Method != e.Method {
+		return false
+	}
+	if q.Since > 0 && e.Time < q.Since {
+		return false
+	}
+	if q.Until > 0 && e.Time > q.Until {
+		return false
+	}
+	if q.Domain != "" && !auditDataMatch(e.Data, "domain", q.Domain) {
+		return false
+	}
+	if q.Name != "" && !auditDataMatch(e.Data, "name", q.Name) {
+		return false
+	}
+	return true
+}
+
+// 判断业务数据或批量操作的子操作数据中，字段是否等于指定的值
+func auditDataMatch(data map[string]interface{}, key, value string) bool {
+	if v, ok := data[key].(string); ok && v == value {
+		return true
+	}
+	orders, _ := data["orders"].([]interface{})
+	for _, o := range orders {
+		sub, _ := o.(map[string]interface{})
+		d, _ := sub["data"].(map[string]interface{})
+		if auditDataMatch(d, key, value) {
+			return true
+		}
+	}
+	return false
+}
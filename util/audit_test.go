@@ -0,0 +1,116 @@
+// Copyright (c) 2013 Beijing CmsTop Technology Co.,Ltd. (http://www.cmstop.com)
+
+package util
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAudit1(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sfss-audit")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "audit.log")
+	a, err := NewAuditLog(file, true)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	a.Append(&AuditData{Time: 100, Controller: "1(cms)", Method: "site_pause", Data: map[string]interface{}{"domain": "a.com"}})
+	a.Append(&AuditData{Time: 200, Controller: "1(cms)", Method: "db_create", Data: map[string]interface{}{"name": "a", "siteid": 12.0}})
+	a.Close()
+
+	// 重新打开后继续hash链
+	a, err = NewAuditLog(file, true)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer a.Close()
+	a.Append(&AuditData{Time: 300, Method: "batch", Data: map[string]interface{}{"orders": []interface{}{
+		map[string]interface{}{"method": "site_delete", "data": map[string]interface{}{"domain": "a.com"}},
+	}}})
+	n, err := a.Verify()
+	if err != nil || n != 3 {
+		t.Fatal("audit verify Error: ", n, err)
+	}
+	result, _, _ := a.Query(&AuditQuery{Domain: "a.com"})
+	if len(result) != 2 || result[0].Method != "site_pause" || result[1].Method != "batch" {
+		t.Error("audit query by domain mismatch: ", result)
+	}
+	result, _, _ = a.Query(&AuditQuery{Since: 150, Until: 250})
+	if len(result) != 1 || result[0].Method != "db_create" {
+		t.Error("audit query by time mismatch: ", result)
+	}
+	result, _, _ = a.Query(&AuditQuery{Limit: 1})
+	if len(result) != 1 || result[0].Time != 300 {
+		t.Error("audit query should return the latest: ", result)
+	}
+
+	// 修改记录后校验失败
+	data, _ := ioutil.ReadFile(file)
+	ioutil.WriteFile(file, []byte(strings.Replace(string(data), "site_pause", "site_start", 1)), 0640)
+	if _, err = a.Verify(); err == nil {
+		t.Error("tampered audit log should fail verify")
+	}
+}
+
+func TestAuditPending1(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sfss-audit")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "audit.log")
+	parent, err := NewAuditLog(file, true)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	// 新进程的记录先暂存，父进程关闭文件后接着写入
+	a := NewPendingAuditLog(file, true)
+	a.Append(&AuditData{Time: 200, Method: "site_create"})
+	parent.Append(&AuditData{Time: 100, Method: "site_pause"})
+	parent.Close()
+	if err = a.Attach(); err != nil {
+		t.Fatal("attach failed: ", err.Error())
+	}
+	defer a.Close()
+	n, err := a.Verify()
+	if err != nil || n != 2 {
+		t.Error("hash chain should continue after attach: ", n, err)
+	}
+}
+
+func TestAuditQueryBytes1(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sfss-audit")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	a, err := NewAuditLog(filepath.Join(dir, "audit.log"), false)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer a.Close()
+	big := strings.Repeat("x", AUDIT_QUERY_BYTES/4)
+	for i := 0; i < 8; i++ {
+		a.Append(&AuditData{Time: int64(i), Method: "site_create", Data: map[string]interface{}{"config": big}})
+	}
+	result, more, err := a.Query(&AuditQuery{})
+	if err != nil || !more || len(result) == 0 || len(result) >= 4 {
+		t.Fatal("query should be limited by size: ", len(result), more, err)
+	}
+	if result[len(result)-1].Time != 7 {
+		t.Error("newest records should be returned: ", result[len(result)-1].Time)
+	}
+	// 单条记录过大时不返回业务数据
+	a.Append(&AuditData{Time: 8, Method: "site_create", Data: map[string]interface{}{"config": big + big + big + big}})
+	result, _, _ = a.Query(&AuditQuery{Limit: 1})
+	if len(result) != 1 || result[0].Data["config"] != nil {
+		t.Error("too large record data should be omitted: ", len(result))
+	}
+}
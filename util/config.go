@@ -0,0 +1,179 @@
+// Copyright (c) 2013 Beijing CmsTop Technology Co.,Ltd. (http://www.cmstop.com)
+
+// Provides layered configuration
+/*
+分层配置
+配置依次由三层合并，后面的覆盖前面的：
+	配置文件   默认为程序目录下的conf/sfss.conf，可以用-config指定
+	环境变量   NFSS_<SECTION>_<OPTION>，如NFSS_DB_MYSQLPASS覆盖[db]的mysqlPass，
+	          名称不区分大小写，只能覆盖配置文件中已有的配置项，密钥可以在配置文件中留空
+	命令行参数 -set section.option=value，可以重复使用
+任意一层的值以file:开头时，从对应的文件读取实际的值（去掉首尾空白），用于单独存放的密钥文件，
+相对路径相对于程序目录，如 mysqlPass = "file:/run/secrets/mysql_pass"。
+DumpConfig输出合并后的配置，密钥类的配置项只显示为******。
+*/
+
+package util
+
+import (
+	"errors"
+	"github.com/9466/goconfig"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	CONFIG_ENV_PREFIX  = "NFSS_"  // 覆盖配置项的环境变量前缀
+	CONFIG_FILE_PREFIX = "file:"  // 从文件读取配置值的前缀
+	CONFIG_SECRET_MASK = "******" // 输出配置时密钥的显示
+)
+
+// 密钥类配置项名称包含的关键字，[keys]中的配置项都是密钥
+var secretWords = []string{"pass", "key", "secret", "token"}
+
+// 读取配置文件，并依次使用环境变量和命令行参数覆盖
+// env为KEY=VALUE格式的环境变量列表，通常为os.Environ()；sets为section.option=value格式的覆盖列表
+func LoadConfig(file string, env []string, sets []string) (*goconfig.ConfigFile, error) {
+	conf, err := goconfig.ReadConfigFile(file)
+	if err != nil {
+		return nil, errors.New("ReadConfigFile Error: " + err.Error())
+	}
+	for _, kv := range env {
+		section, option, value, ok := parseEnv(kv)
+		if !ok {
+			continue
+		}
+		section, option, ok = findOption(conf, section, option)
+		if !ok {
+			return nil, errors.New("config env " + kv[:strings.Index(kv, "=")] + " Error: option not found in config file")
+		}
+		conf.AddOption(section, option, value)
+	}
+	for _, set := range sets {
+		section, option, value, err := ParseConfigSet(set)
+		if err != nil {
+			return nil, err
+		}
+		if s, o, ok := findOption(conf, section, option); ok {
+			section, option = s, o
+		}
+		conf.AddSection(section)
+		conf.AddOption(section, option, value)
+	}
+	// 读取file:开头的配置值
+	for _, section := range conf.GetSections() {
+		options, _ := conf.GetOptions(section)
+		for _, option := range options {
+			value, _ := conf.GetRawString(section, option)
+			if !strings.HasPrefix(value, CONFIG_FILE_PREFIX) {
+				continue
+			}
+			value, err = readSecret(value)
+			if err != nil {
+				return nil, errors.New("config " + section + "." + option + " Error: " + err.Error())
+			}
+			conf.AddOption(section, option, value)
+		}
+	}
+	return conf, nil
+}
+
+// 解析section.option=value格式的配置覆盖
+func ParseConfigSet(set string) (section, option, value string, err error) {
+	i := strings.Index(set, "=")
+	j := strings.Index(set, ".")
+	if i < 0 || j <= 0 || j > i-2 {
+		return "", "", "", errors.New("config set " + set + " Error: should be section.option=value")
+	}
+	return set[:j], set[j+1 : i], set[i+1:], nil
+}
+
+// 解析NFSS_SECTION_OPTION=value格式的环境变量，不是配置覆盖时ok为false
+func parseEnv(kv string) (section, option, value string, ok bool) {
+	if !strings.HasPrefix(kv, CONFIG_ENV_PREFIX) {
+		return "", "", "", false
+	}
+	i := strings.Index(kv, "=")
+	if i < 0 {
+		return "", "", "", false
+	}
+	parts := strings.SplitN(kv[len(CONFIG_ENV_PREFIX):i], "_", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", "", false
+	}
+	return parts[0], parts[1], kv[i+1:], true
+}
+
+// 不区分大小写查找配置文件中已有的配置项，返回配置文件中的名称
+func findOption(conf *goconfig.ConfigFile, section, option string) (string, string, bool) {
+	for _, s := range conf.GetSections() {
+		if !strings.EqualFold(s, section) {
+			continue
+		}
+		options, _ := conf.GetOptions(s)
+		for _, o := range options {
+			if strings.EqualFold(o, option) {
+				return s, o, true
+			}
+		}
+	}
+	return section, option, false
+}
+
+// 读取file:开头的配置值对应的文件
+func readSecret(value string) (string, error) {
+	file, err := GetPath(strings.TrimPrefix(value, CONFIG_FILE_PREFIX))
+	if err != nil {
+		return "", err
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// 判断是否密钥类的配置项
+func IsSecretOption(section, option string) bool {
+	if strings.ToLower(section) == "keys" {
+		return true
+	}
+	return IsSecretField(option)
+}
+
+// 判断名称是否密钥类的字段，如mysqlPass、password
+func IsSecretField(name string) bool {
+	name = strings.ToLower(name)
+	for _, w := range secretWords {
+		if strings.Contains(name, w) {
+			return true
+		}
+	}
+	return false
+}
+
+// 输出合并后的配置，密钥类的配置项已隐藏
+func DumpConfig(conf *goconfig.ConfigFile) string {
+	sections := conf.GetSections()
+	sort.Strings(sections)
+	var b strings.Builder
+	for _, section := range sections {
+		options, _ := conf.GetOptions(section)
+		if len(options) == 0 {
+			continue
+		}
+		sort.Strings(options)
+		b.WriteString("[" + section + "]\n")
+		for _, option := range options {
+			value, _ := conf.GetRawString(section, option)
+			if value != "" && IsSecretOption(section, option) {
+				value = CONFIG_SECRET_MASK
+			}
+			b.WriteString(option + " = " + strconv.Quote(value) + "\n")
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
@@ -0,0 +1,53 @@
+// Copyright (c) 2013 Beijing CmsTop Technology Co.,Ltd. (http://www.cmstop.com)
+
+package util
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestConfigSet1(t *testing.T) {
+	section, option, value, err := ParseConfigSet("db.mysqlPass=a=b")
+	if err != nil || section != "db" || option != "mysqlPass" || value != "a=b" {
+		t.Error("ParseConfigSet error: ", section, option, value, err)
+	}
+	for _, bad := range []string{"db", "db=1", ".x=1", "db.=1"} {
+		if _, _, _, err := ParseConfigSet(bad); err == nil {
+			t.Error(bad + " should be rejected")
+		}
+	}
+}
+
+func TestConfigEnv1(t *testing.T) {
+	section, option, value, ok := parseEnv("NFSS_DB_MYSQLPASS=secret")
+	if !ok || section != "DB" || option != "MYSQLPASS" || value != "secret" {
+		t.Error("parseEnv error: ", section, option, value)
+	}
+	for _, kv := range []string{"PATH=/bin", "NFSS_DB=1", "NFSS__X=1", "SFSS_LISTEN_FDS=tcp"} {
+		if _, _, _, ok := parseEnv(kv); ok {
+			t.Error(kv + " should not be a config env")
+		}
+	}
+}
+
+func TestConfigSecret1(t *testing.T) {
+	f, err := ioutil.TempFile("", "sfss")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("  p@ss\n")
+	f.Close()
+	v, err := readSecret(CONFIG_FILE_PREFIX + f.Name())
+	if err != nil || v != "p@ss" {
+		t.Error("readSecret error: ", v, err)
+	}
+	if !IsSecretOption("db", "mysqlPass") || !IsSecretOption("server", "serverKEY") || !IsSecretOption("keys", "k1") {
+		t.Error("secret options should be masked")
+	}
+	if IsSecretOption("site", "siteDir") {
+		t.Error("siteDir is not a secret")
+	}
+}
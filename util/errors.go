@@ -0,0 +1,81 @@
+// Copyright (c) 2013 Beijing CmsTop Technology Co.,Ltd. (http://www.cmstop.com)
+
+// Provides structured errors
+/*
+结构化错误
+业务方法和协议处理返回带状态码的Error，响应时写入SendData的code、message和details，
+控制端按状态码（见CODE_VALIDATION等）区分错误类型，不需要解析错误信息。
+没有状态码的错误按CODE_INTERNAL处理。
+*/
+
+package util
+
+// 错误详情
+type ErrorDetails struct {
+	Fields []FieldError `json:"fields,omitempty"` // 参数校验失败的字段
+	Output string       `json:"output,omitempty"` // 外部命令的输出，如Nginx的错误信息
+	Cause  string       `json:"cause,omitempty"`  // 底层错误信息
+}
+
+// 字段错误
+type FieldError struct {
+	Field   string `json:"field"`   // 字段名称
+	Message string `json:"message"` // 错误信息
+}
+
+// 带状态码的错误
+type Error struct {
+	Code    int           // 状态码
+	Message string        // 错误信息
+	Details *ErrorDetails // 错误详情，可以为nil
+}
+
+// 创建一个带状态码的错误
+func NewError(code int, msg string) *Error {
+	return &Error{Code: code, Message: msg}
+}
+
+// 创建一个带状态码的错误，err为底层错误，记录在details.cause中
+func WrapError(code int, msg string, err error) *Error {
+	e := NewError(code, msg)
+	if err != nil {
+		e.Details = &ErrorDetails{Cause: err.Error()}
+	}
+	return e
+}
+
+func (e *Error) Error() string {
+	if e.Details != nil && e.Details.Cause != "" {
+		return e.Message + ": " + e.Details.Cause
+	}
+	return e.Message
+}
+
+// 错误的状态码，没有状态码的错误为CODE_INTERNAL
+func ErrorCode(err error) int {
+	if err == nil {
+		return CODE_OK
+	}
+	if e, ok := err.(*Error); ok {
+		return e.Code
+	}
+	return CODE_INTERNAL
+}
+
+// 判断状态码是否表示可以原样重试的临时错误，如MySQL不可用、Nginx重载超时
+// 这类结果不记录到幂等键，控制端可以使用同一个幂等键重试
+func Retryable(code int) bool {
+	return code == CODE_UNAVAILABLE
+}
+
+// 生成错误响应
+func ErrorSend(err error) *SendData {
+	send := new(SendData)
+	send.Code = ErrorCode(err)
+	send.Message = err.Error()
+	if e, ok := err.(*Error); ok {
+		send.Message = e.Message
+		send.Details = e.Details
+	}
+	return send
+}
@@ -0,0 +1,37 @@
+// Copyright (c) 2013 Beijing CmsTop Technology Co.,Ltd. (http://www.cmstop.com)
+
+package util
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+func TestErrorSend1(t *testing.T) {
+	err := WrapError(CODE_UNAVAILABLE, "Nginx reload Error!", errors.New("exit status 1"))
+	err.Details.Output = "nginx: [emerg] unknown directive"
+	if err.Error() != "Nginx reload Error!: exit status 1" {
+		t.Error("Error message error: ", err.Error())
+	}
+	send := ErrorSend(err)
+	if send.Code != CODE_UNAVAILABLE || send.Message != "Nginx reload Error!" {
+		t.Fatal("ErrorSend error: ", send)
+	}
+	data, _ := json.Marshal(send)
+	back := new(SendData)
+	if e := json.Unmarshal(data, back); e != nil || back.Details == nil || back.Details.Output != err.Details.Output {
+		t.Error("details json error: ", string(data))
+	}
+}
+
+func TestErrorSend2(t *testing.T) {
+	// 没有状态码的错误按内部错误处理
+	send := ErrorSend(errors.New("boom"))
+	if send.Code != CODE_INTERNAL || send.Message != "boom" || send.Details != nil {
+		t.Error("plain error send error: ", send)
+	}
+	if ErrorCode(nil) != CODE_OK {
+		t.Error("nil error code should be CODE_OK")
+	}
+}
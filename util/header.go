@@ -3,35 +3,140 @@
 package util
 
 import (
+	"context"
 	"github.com/9466/goconfig"
 	"log"
+	"sync"
+)
+
+// 通讯协议版本，由请求中的version字段协商，未指定时为PROTOCOL_V1
+const (
+	PROTOCOL_V1 = 1 // 原始协议：响应为未封装的明文JSON，客户端读取到连接关闭
+	PROTOCOL_V2 = 2 // 响应使用与请求相同的长度前缀封装
+	PROTOCOL_V3 = 3 // 响应使用长度前缀封装，并使用与请求相同的加密结构ReceiveData
+	PROTOCOL_V4 = 4 // 同PROTOCOL_V3，请求与响应改用AES-GCM加密，每个数据包使用随机nonce
+)
+
+// 响应状态码，数值保持稳定，控制端可以按状态码区分错误类型
+const (
+	CODE_OK          = 0  // 成功
+	CODE_ERROR       = 1  // 请求格式错误，如数据包、JSON或加密数据无法解析
+	CODE_REPLAY      = 2  // 请求重放或签发时间超出时间窗口
+	CODE_AUTH        = 3  // 控制端未授权或无权调用该方法
+	CODE_VALIDATION  = 4  // 业务参数校验失败，details.fields为每个字段的错误
+	CODE_NOT_FOUND   = 5  // 方法、站点、数据库或任务不存在
+	CODE_EXISTS      = 6  // 要创建的资源已经存在
+	CODE_CONFLICT    = 7  // 资源状态冲突，如站点已暂停、幂等键正在使用
+	CODE_UNAVAILABLE = 8  // 后端服务不可用或执行失败，如Nginx重载、MySQL，details.output为命令输出
+	CODE_INTERNAL    = 9  // 服务器内部错误
+	CODE_UNSUPPORTED = 10 // 方法在当前服务器类型上不支持
+)
+
+// 异步任务状态
+const (
+	JOB_QUEUED   = "queued"   // 排队等待执行
+	JOB_RUNNING  = "running"  // 正在执行
+	JOB_DONE     = "done"     // 执行成功
+	JOB_FAILED   = "failed"   // 执行失败，或服务重启时未完成
+	JOB_CANCELED = "canceled" // 已取消
 )
 
 // 系统公共数据结构
+// 生命周期和连接计数见lifecycle.go
 type SFSS struct {
 	Conf     *goconfig.ConfigFile // 配置文件接口
-	Logger   *log.Logger          // 日志处理接口
+	Logger   *log.Logger          // 日志处理接口，输出info级别的日志
+	Log      *Logger              // 分级日志，nil时不输出
+	Metrics  *Metrics             // 监控指标，未开启时为nil
 	Chs      chan int             // 进程处理channel
-	Shutdown bool                 // 程序是否关闭标识
-	ConnNum  int                  // 当前TCP连接数
+	ConfFile string               // 配置文件路径，热加载时重新读取
+	ConfSets []string             // 命令行参数中的配置覆盖，热加载时重新应用
+	once     sync.Once            // 生命周期初始化
+	ctx      context.Context      // 进程生命周期，停止服务时取消
+	cancel   context.CancelFunc   // 取消生命周期
+	lock     sync.Mutex           // 连接计数锁
+	cond     *sync.Cond           // 连接数归零通知
+	connNum  int                  // 当前正在处理的连接数
 }
 
 // 接收数据结构
 type ReceiveData struct {
-	Serverid int    `json:"serverid"` // 服务器编号
-	Data     string `json:"data"`     // 加密后的数据
+	Serverid  int    `json:"serverid"`            // 服务器编号
+	Id        uint32 `json:"id,omitempty"`        // 请求编号，持久连接中用于匹配响应
+	Version   int    `json:"version,omitempty"`   // 通讯协议版本
+	Keyid     string `json:"keyid,omitempty"`     // 加密密钥编号，PROTOCOL_V4使用
+	Nonce     string `json:"nonce,omitempty"`     // 加密随机数，PROTOCOL_V4使用
+	Keepalive bool   `json:"keepalive,omitempty"` // 是否使用持久连接，由连接的第一个请求决定
+	Data      string `json:"data"`                // 加密后的数据
 }
 
 // 响应数据结构
 type SendData struct {
-	Code    int    `json:"code"`    // 状态码，0 表示成功，非0表示失败
-	Message string `json:"message"` // 消息字符串
+	Id      uint32        `json:"id,omitempty"`      // 对应的请求编号
+	Code    int           `json:"code"`              // 状态码，0 表示成功，非0表示失败
+	Message string        `json:"message"`           // 消息字符串
+	Details *ErrorDetails `json:"details,omitempty"` // 错误详情
+	Steps   []StepResult  `json:"steps,omitempty"`   // 批量操作每个步骤的结果
+	Job     *JobData      `json:"job,omitempty"`     // 异步任务，提交任务和job_status、job_cancel返回
+	Jobs    []JobData     `json:"jobs,omitempty"`    // 异步任务列表，job_list返回
+	Reload  *ReloadData   `json:"reload,omitempty"`  // 配置热加载结果，config_reload返回
+	Audit   []AuditData   `json:"audit,omitempty"`   // 审计记录，audit_query返回
+}
+
+// 配置热加载结果，配置项为section.option，站点模板为nginx.tpl
+type ReloadData struct {
+	Applied []string `json:"applied"` // 已经生效的配置项
+	Restart []string `json:"restart"` // 已修改但需要重启才能生效的配置项
+}
+
+// 批量操作步骤结果
+type StepResult struct {
+	Method   string        `json:"method"`             // 业务操作类型
+	Code     int           `json:"code"`               // 状态码，0 表示成功，非0表示失败或未执行
+	Message  string        `json:"message"`            // 消息字符串
+	Details  *ErrorDetails `json:"details,omitempty"`  // 错误详情
+	Rollback string        `json:"rollback,omitempty"` // 回滚结果，ok表示已撤销
+	Skipped  bool          `json:"skipped,omitempty"`  // 是否因前面的步骤失败而未执行
 }
 
 // 业务数据结构
 type OrderData struct {
-	Method string            `json:"method"` // 业务操作类型
-	Data   map[string]string `json:"data"`   // 业务操作数据
+	Method         string                 `json:"method"`                    // 业务操作类型
+	Time           int64                  `json:"time,omitempty"`            // 签发时间，unix时间戳，用于重放检测
+	Nonce          string                 `json:"nonce,omitempty"`           // 唯一随机字符串，用于重放检测
+	Data           map[string]interface{} `json:"data"`                      // 业务操作数据，字段类型由业务方法的参数结构体决定，兼容字符串
+	Orders         []OrderData            `json:"orders,omitempty"`          // 批量操作batch的子操作，按顺序执行
+	Async          bool                   `json:"async,omitempty"`           // 是否作为异步任务执行，立即返回任务编号
+	IdempotencyKey string                 `json:"idempotency_key,omitempty"` // 幂等键，重试时返回首次执行的结果
+}
+
+// 异步任务数据结构
+type JobData struct {
+	Id       string    `json:"id"`                 // 任务编号
+	Method   string    `json:"method"`             // 业务操作类型
+	Owner    string    `json:"owner,omitempty"`    // 提交任务的控制端编号，本地管理接口为admin
+	Status   string    `json:"status"`             // 任务状态，见JOB_QUEUED等
+	Progress int       `json:"progress"`           // 执行进度，0-100
+	Message  string    `json:"message,omitempty"`  // 进度说明
+	Created  int64     `json:"created"`            // 提交时间，unix时间戳
+	Started  int64     `json:"started,omitempty"`  // 开始执行时间
+	Finished int64     `json:"finished,omitempty"` // 结束时间
+	Result   *SendData `json:"result,omitempty"`   // 执行结果
+}
+
+// 审计记录
+type AuditData struct {
+	Time       int64                  `json:"time"`           // 请求时间，unix时间戳
+	Controller string                 `json:"controller"`     // 控制端标识，本地管理接口为admin
+	Remote     string                 `json:"remote"`         // 请求来源地址
+	Method     string                 `json:"method"`         // 业务操作类型
+	Data       map[string]interface{} `json:"data,omitempty"` // 业务操作数据，密码等已隐藏，批量操作的子操作在orders中
+	Code       int                    `json:"code"`           // 执行结果状态码
+	Message    string                 `json:"message"`        // 执行结果消息
+	Duration   int64                  `json:"duration_ms"`    // 执行耗时，单位毫秒
+	Job        string                 `json:"job,omitempty"`  // 作为异步任务执行时的任务编号
+	Prev       string                 `json:"prev,omitempty"` // 上一条记录的hash，开启hash链时使用
+	Hash       string                 `json:"hash,omitempty"` // 本条记录的hash
 }
 
 // 测试接口返回数据结构
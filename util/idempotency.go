@@ -0,0 +1,282 @@
+// Copyright (c) 2013 Beijing CmsTop Technology Co.,Ltd. (http://www.cmstop.com)
+
+// Provides idempotency keys
+/*
+幂等键
+请求可以携带控制端生成的幂等键，服务器在时间窗口内记录每个幂等键的执行结果，
+控制端超时重试时直接返回记录的结果，不再重复执行。
+同一个幂等键只能用于相同的请求内容，首次请求未执行完成时重试会被拒绝。
+只记录最终结果，可以重试的临时错误（见Retryable）放弃记录，控制端使用同一个幂等键重试时重新执行。
+结果以追加方式写入文件，重启后重新加载。
+过期的记录在Begin、Finish时定期清理（间隔IDEM_PURGE_INTERVAL），清理后或追加的行数
+超过IDEM_COMPACT_LINES时在Finish中压缩文件，内存和文件都不会随时间无限增长。
+平滑重启时新进程先只在内存中记录，父进程关闭文件后通过Attach加载文件并合并。
+*/
+
+package util
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	IDEMPOTENCY_KEY_MAX_LENGTH = 128  // 幂等键最大长度
+	IDEM_PURGE_INTERVAL        = 60   // 清理过期记录的间隔，单位秒
+	IDEM_COMPACT_LINES         = 1000 // 上次压缩后追加的行数超过该值时压缩文件
+)
+
+var (
+	ErrIdemKeyIllegal = errors.New("idempotency key is too long or bad")                 // 幂等键格式错误
+	ErrIdemMismatch   = errors.New("idempotency key already used by a different order")  // 幂等键已用于不同的请求
+	ErrIdemPending    = errors.New("order with the same idempotency key is in progress") // 首次请求尚未执行完成
+)
+
+// 幂等键记录
+type idemEntry struct {
+	Key    string    `json:"key"`    // 幂等键
+	Digest string    `json:"digest"` // 请求内容摘要
+	Time   int64     `json:"time"`   // 首次请求时间
+	Result *SendData `json:"result"` // 执行结果，执行中为nil
+}
+
+// 幂等键缓存
+type IdemCache struct {
+	window   int64                 // 结果保留时间，单位秒
+	file     string                // 持久化文件
+	lock     sync.Mutex            // 缓存锁
+	entries  map[string]*idemEntry // 幂等键记录
+	fh       *os.File              // 持久化文件句柄
+	appended int                   // 上次压缩后追加的行数
+	expired  int                   // 上次压缩后清理的已写入文件的记录数
+	purged   int64                 // 上次清理过期记录的时间
+}
+
+// 创建幂等键缓存，file为空时不持久化
+func NewIdemCache(file string, window time.Duration) (*IdemCache, error) {
+	c := new(IdemCache)
+	c.window = int64(window / time.Second)
+	c.file = file
+	c.entries = make(map[string]*idemEntry)
+	if file == "" {
+		return c, nil
+	}
+	err := c.Attach(file)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// 开始持久化到文件，加载文件中未过期的执行结果与缓存合并后重写文件，缓存中已有的幂等键优先
+func (c *IdemCache) Attach(file string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.fh != nil {
+		return errors.New("idempotency cache file is already attached")
+	}
+	c.file = file
+	err := c.load()
+	if err != nil {
+		return err
+	}
+	return c.compact()
+}
+
+// 开始处理带幂等键的请求，digest为请求内容摘要
+// 已有执行结果时返回结果的副本，否则记录为执行中并返回nil，执行结束后必须调用Finish或Abort
+func (c *IdemCache) Begin(key, digest string) (*SendData, error) {
+	if key == "" || len(key) > IDEMPOTENCY_KEY_MAX_LENGTH || strings.ContainsAny(key, " \t\r\n") {
+		return nil, ErrIdemKeyIllegal
+	}
+	now := time.Now().Unix()
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.purge(now)
+	e, ok := c.entries[key]
+	if ok && e.Time < now-c.window {
+		if e.Result != nil {
+			c.expired++
+		}
+		delete(c.entries, key)
+		ok = false
+	}
+	if !ok {
+		e = new(idemEntry)
+		e.Key = key
+		e.Digest = digest
+		e.Time = now
+		c.entries[key] = e
+		return nil, nil
+	}
+	if e.Digest != digest {
+		return nil, ErrIdemMismatch
+	}
+	if e.Result == nil {
+		return nil, ErrIdemPending
+	}
+	send := *e.Result
+	return &send, nil
+}
+
+// 记录请求的执行结果
+func (c *IdemCache) Finish(key string, send *SendData) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.purge(time.Now().Unix())
+	e, ok := c.entries[key]
+	if !ok {
+		return c.maybeCompact()
+	}
+	result := *send
+	result.Id = 0 // 请求编号每次重试都不同
+	e.Result = &result
+	if c.fh == nil {
+		return nil
+	}
+	data, err := json.Marshal(e)
+	if err == nil {
+		_, err = c.fh.Write(append(data, '\n'))
+	}
+	if err != nil {
+		return errors.New("idempotency cache write Error: " + err.Error())
+	}
+	c.appended++
+	return c.maybeCompact()
+}
+
+// 清理过期的记录，间隔IDEM_PURGE_INTERVAL执行一次，调用时需持有c.lock
+func (c *IdemCache) purge(now int64) {
+	if now-c.purged < IDEM_PURGE_INTERVAL {
+		return
+	}
+	c.purged = now
+	expire := now - c.window
+	for key, e := range c.entries {
+		if e.Time < expire {
+			if e.Result != nil {
+				c.expired++
+			}
+			delete(c.entries, key)
+		}
+	}
+}
+
+// 文件中有已清理的记录，或追加的行数过多时压缩文件，调用时需持有c.lock
+func (c *IdemCache) maybeCompact() error {
+	if c.fh == nil || (c.expired == 0 && c.appended < IDEM_COMPACT_LINES) {
+		return nil
+	}
+	return c.compact()
+}
+
+// 放弃执行中的请求，之后可以使用同一个幂等键重试
+func (c *IdemCache) Abort(key string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if e, ok := c.entries[key]; ok && e.Result == nil {
+		delete(c.entries, key)
+	}
+}
+
+// 关闭缓存文件
+func (c *IdemCache) Close() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.fh == nil {
+		return nil
+	}
+	err := c.fh.Close()
+	c.fh = nil
+	return err
+}
+
+// 从文件加载未过期的执行结果，缓存中已有的幂等键不覆盖
+func (c *IdemCache) load() error {
+	f, err := os.Open(c.file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+	expire := time.Now().Unix() - c.window
+	loaded := make(map[string]*idemEntry)
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), MAX_PACKET_SIZE)
+	for scanner.Scan() {
+		e := new(idemEntry)
+		err = json.Unmarshal(scanner.Bytes(), e)
+		if err != nil || e.Result == nil || e.Time < expire {
+			continue
+		}
+		loaded[e.Key] = e
+	}
+	for key, e := range loaded {
+		if _, ok := c.entries[key]; !ok {
+			c.entries[key] = e
+		}
+	}
+	return scanner.Err()
+}
+
+// 将未过期的执行结果重写到文件，执行中的请求不写入
+func (c *IdemCache) compact() error {
+	if c.fh != nil {
+		c.fh.Close()
+		c.fh = nil
+	}
+	expire := time.Now().Unix() - c.window
+	tmpFile := c.file + ".tmp"
+	f, err := os.OpenFile(tmpFile, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	c.appended = 0
+	c.expired = 0
+	for key, e := range c.entries {
+		if e.Time < expire {
+			delete(c.entries, key)
+			continue
+		}
+		if e.Result == nil {
+			continue
+		}
+		data, err := json.Marshal(e)
+		if err != nil {
+			continue
+		}
+		w.Write(append(data, '\n'))
+	}
+	err = w.Flush()
+	f.Close()
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmpFile, c.file)
+	if err != nil {
+		return err
+	}
+	c.fh, err = os.OpenFile(c.file, os.O_WRONLY|os.O_APPEND, 0600)
+	return err
+}
+
+// 计算请求内容摘要，不包括签发时间、nonce和幂等键
+func OrderDigest(order *OrderData) string {
+	o := *order
+	o.Time = 0
+	o.Nonce = ""
+	o.IdempotencyKey = ""
+	data, _ := json.Marshal(&o)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
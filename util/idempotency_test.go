@@ -0,0 +1,78 @@
+// Copyright (c) 2013 Beijing CmsTop Technology Co.,Ltd. (http://www.cmstop.com)
+
+package util
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIdemCache1(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sfss")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "idempotency.dat")
+	c, err := NewIdemCache(file, time.Hour)
+	if err != nil {
+		t.Fatal("NewIdemCache failed: ", err.Error())
+	}
+	order := &OrderData{Method: "site_create", Data: map[string]interface{}{"domain": "a.9466.cn"}}
+	digest := OrderDigest(order)
+	if send, err := c.Begin("1:abc", digest); send != nil || err != nil {
+		t.Fatal("first order should execute")
+	}
+	if _, err = c.Begin("1:abc", digest); err != ErrIdemPending {
+		t.Error("order in progress should be rejected")
+	}
+	c.Finish("1:abc", &SendData{Id: 5, Message: "site create ok"})
+	order.Data["domain"] = "b.9466.cn"
+	if _, err = c.Begin("1:abc", OrderDigest(order)); err != ErrIdemMismatch {
+		t.Error("different order should be rejected")
+	}
+	c.Close()
+
+	// 重启后仍然返回记录的结果
+	c, err = NewIdemCache(file, time.Hour)
+	if err != nil {
+		t.Fatal("NewIdemCache reload failed: ", err.Error())
+	}
+	defer c.Close()
+	send, err := c.Begin("1:abc", digest)
+	if err != nil || send == nil || send.Message != "site create ok" || send.Id != 0 {
+		t.Error("recorded result error: ", send, err)
+	}
+}
+
+func TestIdemCacheExpire1(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sfss")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "idempotency.dat")
+	c, err := NewIdemCache(file, time.Hour)
+	if err != nil {
+		t.Fatal("NewIdemCache failed: ", err.Error())
+	}
+	defer c.Close()
+	c.Begin("1:old", "d1")
+	c.Finish("1:old", &SendData{Message: "ok"})
+	// 模拟记录过期，并到达下一次清理时间
+	c.entries["1:old"].Time -= 7200
+	c.purged -= IDEM_PURGE_INTERVAL
+	c.Begin("1:new", "d2")
+	if _, ok := c.entries["1:old"]; ok {
+		t.Error("expired key should be removed from memory")
+	}
+	c.Finish("1:new", &SendData{Message: "ok"})
+	data, _ := ioutil.ReadFile(file)
+	if strings.Contains(string(data), "1:old") || !strings.Contains(string(data), "1:new") {
+		t.Error("expired key should be removed from file: ", string(data))
+	}
+}
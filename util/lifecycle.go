@@ -0,0 +1,77 @@
+// Copyright (c) 2013 Beijing CmsTop Technology Co.,Ltd. (http://www.cmstop.com)
+
+// Provides process lifecycle
+/*
+进程生命周期
+SFSS的Context在收到停止信号时取消，各服务监听这个Context停止接收新连接；
+连接计数由ConnBegin、ConnEnd维护，停止服务时通过ConnWait等待正在处理的连接结束。
+这些方法可以在多个协程中并发调用，SFSS的零值可以直接使用。
+*/
+
+package util
+
+import (
+	"context"
+	"sync"
+)
+
+// 初始化生命周期数据，只执行一次
+func (s *SFSS) lifeInit() {
+	s.once.Do(func() {
+		s.ctx, s.cancel = context.WithCancel(context.Background())
+		s.cond = sync.NewCond(&s.lock)
+	})
+}
+
+// 进程生命周期Context，停止服务时取消
+func (s *SFSS) Context() context.Context {
+	s.lifeInit()
+	return s.ctx
+}
+
+// 开始停止服务，可以重复调用
+func (s *SFSS) Shutdown() {
+	s.lifeInit()
+	s.cancel()
+}
+
+// 是否正在停止服务
+func (s *SFSS) IsShutdown() bool {
+	return s.Context().Err() != nil
+}
+
+// 开始处理一个连接，连接数+1
+func (s *SFSS) ConnBegin() {
+	s.lifeInit()
+	s.lock.Lock()
+	s.connNum++
+	s.lock.Unlock()
+}
+
+// 结束处理一个连接，连接数-1
+func (s *SFSS) ConnEnd() {
+	s.lifeInit()
+	s.lock.Lock()
+	s.connNum--
+	if s.connNum <= 0 {
+		s.cond.Broadcast()
+	}
+	s.lock.Unlock()
+}
+
+// 当前正在处理的连接数
+func (s *SFSS) ConnNum() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.connNum
+}
+
+// 等待所有连接处理结束
+func (s *SFSS) ConnWait() {
+	s.lifeInit()
+	s.lock.Lock()
+	for s.connNum > 0 {
+		s.cond.Wait()
+	}
+	s.lock.Unlock()
+}
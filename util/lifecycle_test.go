@@ -0,0 +1,42 @@
+// Copyright (c) 2013 Beijing CmsTop Technology Co.,Ltd. (http://www.cmstop.com)
+
+package util
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLifecycle1(t *testing.T) {
+	s := new(SFSS)
+	if s.IsShutdown() {
+		t.Fatal("new SFSS should not be shutdown")
+	}
+	s.ConnBegin()
+	s.ConnBegin()
+	if s.ConnNum() != 2 {
+		t.Error("ConnNum should be 2: ", s.ConnNum())
+	}
+	done := make(chan bool)
+	go func() {
+		s.ConnWait()
+		close(done)
+	}()
+	s.ConnEnd()
+	select {
+	case <-done:
+		t.Fatal("ConnWait returned with active connections")
+	case <-time.After(20 * time.Millisecond):
+	}
+	s.ConnEnd()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("ConnWait not returned after all connections end")
+	}
+	s.Shutdown()
+	s.Shutdown()
+	if !s.IsShutdown() || s.Context().Err() == nil {
+		t.Error("SFSS should be shutdown")
+	}
+}
@@ -0,0 +1,469 @@
+// Copyright (c) 2013 Beijing CmsTop Technology Co.,Ltd. (http://www.cmstop.com)
+
+// Provides leveled logging with rotation
+/*
+分级日志
+日志分为debug、info、warn、error四级，低于[log] level的日志不输出。
+format = json时每行输出一个JSON对象，包含time、level、msg和附加字段，
+如业务请求的method、serverid、domain或name、duration_ms，便于日志系统采集；
+默认的text格式为 时间 级别 内容 key=value ...
+Std返回写入info级别的*log.Logger，兼容原有的日志调用。
+
+日志文件按大小（maxSize，单位MB）和日期（daily）自动切割，
+切割后的文件名为 原文件名.日期，同一天多次切割时再加序号，compress开启时压缩为.gz，
+超过days天的切割文件自动删除，0表示不删除。
+使用外部logrotate时关闭自动切割，切割后发送SIGUSR2信号重新打开日志文件。
+*/
+
+package util
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/9466/goconfig"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 日志级别
+const (
+	LOG_DEBUG = iota // 调试信息
+	LOG_INFO         // 一般信息
+	LOG_WARN         // 请求失败等需要关注的信息
+	LOG_ERROR        // 服务端错误
+)
+
+const (
+	DEF_LOG_MAX_SIZE = 100 // 默认按大小切割的文件大小，单位MB
+	DEF_LOG_DAYS     = 7   // 默认保留切割文件的天数
+	LOG_DAY_FORMAT   = "20060102"
+)
+
+// 日志级别名称，按级别顺序
+var logLevelNames = []string{"debug", "info", "warn", "error"}
+
+// 日志附加字段
+type LogFields map[string]interface{}
+
+// 解析日志级别名称
+func ParseLogLevel(name string) (int, error) {
+	for i, n := range logLevelNames {
+		if strings.EqualFold(name, n) {
+			return i, nil
+		}
+	}
+	return 0, errors.New("log level " + name + " Error: should be debug, info, warn or error")
+}
+
+// 日志配置
+type LogConfig struct {
+	File     string // 日志文件路径
+	Level    int    // 输出的最低级别
+	Json     bool   // 是否输出JSON格式
+	MaxSize  int64  // 按大小切割的文件大小，单位字节，0表示不按大小切割
+	Daily    bool   // 是否按日期切割
+	Days     int    // 保留切割文件的天数，0表示不删除
+	Compress bool   // 是否压缩切割文件
+}
+
+// 读取[log]配置
+func LoadLogConfig(conf *goconfig.ConfigFile) (*LogConfig, error) {
+	c := new(LogConfig)
+	file, err := conf.GetString("log", "file")
+	if err != nil {
+		return nil, errors.New("log file Error: " + err.Error())
+	}
+	c.File, err = GetPath(file)
+	if err != nil {
+		return nil, errors.New("log file Error: " + err.Error())
+	}
+	c.Level = LOG_INFO
+	if level, err := conf.GetString("log", "level"); err == nil && level != "" {
+		c.Level, err = ParseLogLevel(level)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if format, err := conf.GetString("log", "format"); err == nil && format != "" {
+		if format != "text" && format != "json" {
+			return nil, errors.New("log format " + format + " Error: should be text or json")
+		}
+		c.Json = format == "json"
+	}
+	maxSize, err := conf.GetInt64("log", "maxSize")
+	if err != nil {
+		maxSize = DEF_LOG_MAX_SIZE
+	}
+	if maxSize < 0 {
+		return nil, errors.New("log maxSize Error: should not be negative")
+	}
+	c.MaxSize = maxSize << 20
+	c.Daily, err = conf.GetBool("log", "daily")
+	if err != nil {
+		c.Daily = true
+	}
+	c.Days, err = conf.GetInt("log", "days")
+	if err != nil {
+		c.Days = DEF_LOG_DAYS
+	}
+	if c.Days < 0 {
+		return nil, errors.New("log days Error: should not be negative")
+	}
+	c.Compress, err = conf.GetBool("log", "compress")
+	if err != nil {
+		c.Compress = true
+	}
+	return c, nil
+}
+
+// 按配置打开日志
+func OpenLog(c *LogConfig) (*Logger, error) {
+	w, err := NewRotateWriter(c.File, c.MaxSize, c.Daily, c.Days, c.Compress)
+	if err != nil {
+		return nil, err
+	}
+	return NewLogger(w, c.Level, c.Json), nil
+}
+
+// 分级日志，可以在多个协程中并发使用
+// nil的Logger不输出任何日志
+type Logger struct {
+	out    io.Writer   // 日志输出
+	level  int         // 输出的最低级别
+	json   bool        // 是否输出JSON格式
+	fields LogFields   // 每条日志都附加的字段
+	lock   *sync.Mutex // 输出锁，With得到的Logger共用
+}
+
+// 创建分级日志
+func NewLogger(out io.Writer, level int, json bool) *Logger {
+	l := new(Logger)
+	l.out = out
+	l.level = level
+	l.json = json
+	l.lock = new(sync.Mutex)
+	return l
+}
+
+// 返回附加了字段的Logger，输出到同一个日志
+func (l *Logger) With(fields LogFields) *Logger {
+	if l == nil {
+		return nil
+	}
+	n := new(Logger)
+	*n = *l
+	n.fields = make(LogFields, len(l.fields)+len(fields))
+	for k, v := range l.fields {
+		n.fields[k] = v
+	}
+	for k, v := range fields {
+		n.fields[k] = v
+	}
+	return n
+}
+
+// 是否输出该级别的日志
+func (l *Logger) Enabled(level int) bool {
+	return l != nil && level >= l.level
+}
+
+func (l *Logger) Debug(msg string, fields ...LogFields) {
+	l.Output(LOG_DEBUG, msg, fields...)
+}
+
+func (l *Logger) Info(msg string, fields ...LogFields) {
+	l.Output(LOG_INFO, msg, fields...)
+}
+
+func (l *Logger) Warn(msg string, fields ...LogFields) {
+	l.Output(LOG_WARN, msg, fields...)
+}
+
+func (l *Logger) Error(msg string, fields ...LogFields) {
+	l.Output(LOG_ERROR, msg, fields...)
+}
+
+// 输出一条日志
+func (l *Logger) Output(level int, msg string, fields ...LogFields) {
+	if !l.Enabled(level) {
+		return
+	}
+	all := l.fields
+	if len(fields) > 0 {
+		all = make(LogFields)
+		for k, v := range l.fields {
+			all[k] = v
+		}
+		for _, f := range fields {
+			for k, v := range f {
+				all[k] = v
+			}
+		}
+	}
+	now := time.Now()
+	var line []byte
+	if l.json {
+		data := make(map[string]interface{}, len(all)+3)
+		for k, v := range all {
+			if err, ok := v.(error); ok {
+				v = err.Error()
+			}
+			data[k] = v
+		}
+		data["time"] = now.Format(time.RFC3339)
+		data["level"] = logLevelNames[level]
+		data["msg"] = msg
+		var err error
+		line, err = json.Marshal(data)
+		if err != nil {
+			line, _ = json.Marshal(map[string]string{"time": data["time"].(string), "level": logLevelNames[level], "msg": msg})
+		}
+	} else {
+		var b strings.Builder
+		b.WriteString(now.Format("2006/01/02 15:04:05 "))
+		b.WriteString(strings.ToUpper(logLevelNames[level]))
+		b.WriteString(" ")
+		b.WriteString(msg)
+		keys := make([]string, 0, len(all))
+		for k := range all {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			v := fmt.Sprint(all[k])
+			if v == "" || strings.ContainsAny(v, " \"=") {
+				v = strconv.Quote(v)
+			}
+			b.WriteString(" " + k + "=" + v)
+		}
+		line = []byte(b.String())
+	}
+	line = append(line, '\n')
+	l.lock.Lock()
+	l.out.Write(line)
+	l.lock.Unlock()
+}
+
+// 返回输出info级别日志的*log.Logger，兼容原有的日志调用
+func (l *Logger) Std() *log.Logger {
+	return log.New(&levelWriter{l, LOG_INFO}, "", 0)
+}
+
+// 重新打开日志文件，外部切割日志后调用
+func (l *Logger) Reopen() error {
+	if w, ok := l.out.(*RotateWriter); ok {
+		return w.Reopen()
+	}
+	return nil
+}
+
+// 关闭日志文件
+func (l *Logger) Close() error {
+	if c, ok := l.out.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// 把log.Logger的输出写为指定级别的日志
+type levelWriter struct {
+	logger *Logger // 分级日志
+	level  int     // 日志级别
+}
+
+func (w *levelWriter) Write(p []byte) (int, error) {
+	w.logger.Output(w.level, strings.TrimRight(string(p), "\n"))
+	return len(p), nil
+}
+
+// 自动切割的日志文件
+type RotateWriter struct {
+	file     string         // 日志文件路径
+	maxSize  int64          // 按大小切割的文件大小，0表示不按大小切割
+	daily    bool           // 是否按日期切割
+	days     int            // 保留切割文件的天数，0表示不删除
+	compress bool           // 是否压缩切割文件
+	lock     sync.Mutex     // 文件锁
+	fh       *os.File       // 当前日志文件
+	size     int64          // 当前文件大小
+	day      string         // 当前文件的日期
+	wg       sync.WaitGroup // 正在后台压缩和清理的任务
+}
+
+// 打开自动切割的日志文件
+func NewRotateWriter(file string, maxSize int64, daily bool, days int, compress bool) (*RotateWriter, error) {
+	w := new(RotateWriter)
+	w.file = file
+	w.maxSize = maxSize
+	w.daily = daily
+	w.days = days
+	w.compress = compress
+	err := w.open()
+	if err != nil {
+		return nil, err
+	}
+	w.clean()
+	return w, nil
+}
+
+// 打开日志文件，文件已存在时日期为最后修改的日期
+func (w *RotateWriter) open() error {
+	fh, err := os.OpenFile(w.file, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		return errors.New("log file open Error: " + err.Error())
+	}
+	fi, err := fh.Stat()
+	if err != nil {
+		fh.Close()
+		return errors.New("log file stat Error: " + err.Error())
+	}
+	w.fh = fh
+	w.size = fi.Size()
+	w.day = time.Now().Format(LOG_DAY_FORMAT)
+	if w.size > 0 {
+		w.day = fi.ModTime().Format(LOG_DAY_FORMAT)
+	}
+	return nil
+}
+
+func (w *RotateWriter) Write(p []byte) (int, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.fh == nil {
+		return 0, errors.New("log file closed")
+	}
+	if w.size > 0 && ((w.daily && time.Now().Format(LOG_DAY_FORMAT) != w.day) ||
+		(w.maxSize > 0 && w.size+int64(len(p)) > w.maxSize)) {
+		err := w.rotate()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+		}
+	}
+	n, err := w.fh.Write(p)
+	w.size += int64(n)
+	return n, err
+}
+
+// 切割日志文件，调用者已加锁
+func (w *RotateWriter) rotate() error {
+	name := w.backupName()
+	w.fh.Close()
+	err := os.Rename(w.file, name)
+	if err2 := w.open(); err2 != nil {
+		return err2
+	}
+	if err != nil {
+		return errors.New("log file rotate Error: " + err.Error())
+	}
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+		if w.compress {
+			err := gzipFile(name)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err.Error())
+			}
+		}
+		w.clean()
+	}()
+	return nil
+}
+
+// 切割文件名，同一天多次切割时加序号
+func (w *RotateWriter) backupName() string {
+	name := w.file + "." + w.day
+	for i := 1; ; i++ {
+		exist, _ := IsExist(name)
+		gzExist, _ := IsExist(name + ".gz")
+		if !exist && !gzExist {
+			return name
+		}
+		name = w.file + "." + w.day + "." + strconv.Itoa(i)
+	}
+}
+
+// 删除超过保留天数的切割文件
+func (w *RotateWriter) clean() {
+	if w.days <= 0 {
+		return
+	}
+	files, err := filepath.Glob(w.file + ".*")
+	if err != nil {
+		return
+	}
+	expire := time.Now().AddDate(0, 0, -w.days)
+	for _, f := range files {
+		fi, err := os.Stat(f)
+		if err == nil && !fi.IsDir() && fi.ModTime().Before(expire) {
+			os.Remove(f)
+		}
+	}
+}
+
+// 重新打开日志文件
+func (w *RotateWriter) Reopen() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	old := w.fh
+	err := w.open()
+	if err != nil {
+		return err // 继续使用原文件
+	}
+	if old != nil {
+		old.Close()
+	}
+	return nil
+}
+
+// 关闭日志文件，等待后台压缩结束
+func (w *RotateWriter) Close() error {
+	w.lock.Lock()
+	var err error
+	if w.fh != nil {
+		err = w.fh.Close()
+		w.fh = nil
+	}
+	w.lock.Unlock()
+	w.wg.Wait()
+	return err
+}
+
+// 压缩文件为.gz，并删除原文件，保留原文件的修改时间
+func gzipFile(name string) error {
+	in, err := os.Open(name)
+	if err != nil {
+		return errors.New("log gzip Error: " + err.Error())
+	}
+	defer in.Close()
+	fi, err := in.Stat()
+	if err != nil {
+		return errors.New("log gzip Error: " + err.Error())
+	}
+	out, err := os.OpenFile(name+".gz", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0666)
+	if err != nil {
+		return errors.New("log gzip Error: " + err.Error())
+	}
+	gz := gzip.NewWriter(out)
+	_, err = io.Copy(gz, in)
+	if err == nil {
+		err = gz.Close()
+	}
+	if err2 := out.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		os.Remove(name + ".gz")
+		return errors.New("log gzip Error: " + err.Error())
+	}
+	os.Chtimes(name+".gz", fi.ModTime(), fi.ModTime())
+	return os.Remove(name)
+}
@@ -0,0 +1,110 @@
+// Copyright (c) 2013 Beijing CmsTop Technology Co.,Ltd. (http://www.cmstop.com)
+
+package util
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLogLevel1(t *testing.T) {
+	var b bytes.Buffer
+	l := NewLogger(&b, LOG_WARN, false)
+	l.Info("hidden")
+	l.With(LogFields{"method": "site_create"}).Warn("order failed", LogFields{"domain": "a.com"})
+	l.Std().Println("std info")
+	out := b.String()
+	if strings.Contains(out, "hidden") || strings.Contains(out, "std info") {
+		t.Error("info should not be logged at warn level: ", out)
+	}
+	if !strings.Contains(out, "WARN order failed domain=a.com method=site_create") {
+		t.Error("warn log mismatch: ", out)
+	}
+	if _, err := ParseLogLevel("verbose"); err == nil {
+		t.Error("unknown log level should fail")
+	}
+	var nl *Logger
+	nl.Error("nil logger should not panic")
+}
+
+func TestLogJson1(t *testing.T) {
+	var b bytes.Buffer
+	l := NewLogger(&b, LOG_DEBUG, true)
+	l.Info("order site_create: ok", LogFields{"serverid": "1", "duration_ms": 12})
+	data := make(map[string]interface{})
+	err := json.Unmarshal(b.Bytes(), &data)
+	if err != nil {
+		t.Fatal("json log decode Error: ", err.Error(), b.String())
+	}
+	if data["level"] != "info" || data["msg"] != "order site_create: ok" || data["serverid"] != "1" || data["duration_ms"] != float64(12) {
+		t.Error("json log mismatch: ", b.String())
+	}
+}
+
+func TestRotate1(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sfss-log")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "sfss.log")
+	// 过期的切割文件
+	old := file + ".20000101.gz"
+	ioutil.WriteFile(old, []byte("old"), 0666)
+	os.Chtimes(old, time.Now().AddDate(0, 0, -10), time.Now().AddDate(0, 0, -10))
+
+	w, err := NewRotateWriter(file, 10, false, 7, true)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	w.Write([]byte("0123456789"))
+	w.Write([]byte("abc"))
+	w.Write([]byte("def"))
+	w.Close()
+	if ok, _ := IsExist(old); ok {
+		t.Error("expired log should be removed")
+	}
+	data, _ := ioutil.ReadFile(file)
+	if string(data) != "abcdef" {
+		t.Error("current log mismatch: ", string(data))
+	}
+	day := time.Now().Format(LOG_DAY_FORMAT)
+	if ok, _ := IsExist(file + "." + day + ".gz"); !ok {
+		t.Error("rotated log should be compressed")
+	}
+	if ok, _ := IsExist(file + "." + day); ok {
+		t.Error("rotated log should be removed after compress")
+	}
+}
+
+func TestRotateReopen1(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sfss-log")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "sfss.log")
+	w, err := NewRotateWriter(file, 0, false, 0, false)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer w.Close()
+	w.Write([]byte("before\n"))
+	// 外部切割
+	os.Rename(file, file+".1")
+	err = w.Reopen()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	w.Write([]byte("after\n"))
+	data, _ := ioutil.ReadFile(file)
+	if string(data) != "after\n" {
+		t.Error("reopened log mismatch: ", string(data))
+	}
+}
@@ -0,0 +1,266 @@
+// Copyright (c) 2013 Beijing CmsTop Technology Co.,Ltd. (http://www.cmstop.com)
+
+// Provides Prometheus-compatible metrics
+/*
+监控指标
+Metrics保存计数器（counter）、直方图（histogram）和采集时计算的仪表（gauge），
+Write按Prometheus文本格式输出，供Prometheus等监控系统采集。
+同名的指标只注册一次，再次获取时返回已注册的指标，各组件可以直接按名称使用。
+nil的Metrics和指标不记录任何数据，未开启监控时调用方不需要判断。
+*/
+
+package util
+
+import (
+	"bufio"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	METRIC_COUNTER   = "counter"
+	METRIC_GAUGE     = "gauge"
+	METRIC_HISTOGRAM = "histogram"
+)
+
+// 默认的直方图区间，单位秒
+var DefMetricBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// 监控指标注册表，可以在多个协程中并发使用
+type Metrics struct {
+	lock     sync.Mutex               // 注册表锁
+	families map[string]*metricFamily // 已注册的指标，按名称
+}
+
+// 同名的一组指标
+type metricFamily struct {
+	name    string                   // 指标名称
+	help    string                   // 指标说明
+	typ     string                   // 指标类型
+	labels  []string                 // 标签名称
+	buckets []float64                // 直方图区间上限，升序
+	lock    sync.Mutex               // 数据锁
+	series  map[string]*metricSeries // 按标签值保存的数据
+	gauge   func() (float64, error)  // 仪表的采集函数
+}
+
+// 一组标签值对应的数据
+type metricSeries struct {
+	values []string // 标签值
+	value  float64  // 计数器的值，或直方图的总和
+	count  uint64   // 直方图的观测次数
+	counts []uint64 // 直方图每个区间的观测次数，不累计
+}
+
+// 计数器
+type CounterVec struct {
+	f *metricFamily
+}
+
+// 直方图
+type HistogramVec struct {
+	f *metricFamily
+}
+
+// 创建监控指标注册表
+func NewMetrics() *Metrics {
+	m := new(Metrics)
+	m.families = make(map[string]*metricFamily)
+	return m
+}
+
+// 获取或注册指标
+func (m *Metrics) family(name, help, typ string, buckets []float64, labels []string) *metricFamily {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if f, ok := m.families[name]; ok {
+		return f
+	}
+	f := new(metricFamily)
+	f.name = name
+	f.help = help
+	f.typ = typ
+	f.buckets = buckets
+	f.labels = labels
+	f.series = make(map[string]*metricSeries)
+	m.families[name] = f
+	return f
+}
+
+// 获取或注册计数器，labels为标签名称
+func (m *Metrics) Counter(name, help string, labels ...string) *CounterVec {
+	if m == nil {
+		return nil
+	}
+	return &CounterVec{m.family(name, help, METRIC_COUNTER, nil, labels)}
+}
+
+// 获取或注册直方图，buckets为nil时使用DefMetricBuckets
+func (m *Metrics) Histogram(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	if m == nil {
+		return nil
+	}
+	if buckets == nil {
+		buckets = DefMetricBuckets
+	}
+	return &HistogramVec{m.family(name, help, METRIC_HISTOGRAM, buckets, labels)}
+}
+
+// 注册仪表，采集时调用f取值，f返回错误时不输出该指标
+func (m *Metrics) GaugeFunc(name, help string, f func() (float64, error)) {
+	if m == nil {
+		return
+	}
+	m.family(name, help, METRIC_GAUGE, nil, nil).gauge = f
+}
+
+// 计数器加1，values为标签值，顺序与注册时的标签名称相同
+func (c *CounterVec) Inc(values ...string) {
+	c.Add(1, values...)
+}
+
+// 计数器增加v
+func (c *CounterVec) Add(v float64, values ...string) {
+	if c == nil {
+		return
+	}
+	c.f.lock.Lock()
+	c.f.get(values).value += v
+	c.f.lock.Unlock()
+}
+
+// 记录一次观测值，耗时的单位为秒
+func (h *HistogramVec) Observe(v float64, values ...string) {
+	if h == nil {
+		return
+	}
+	h.f.lock.Lock()
+	s := h.f.get(values)
+	s.value += v
+	s.count++
+	for i, b := range h.f.buckets {
+		if v <= b {
+			s.counts[i]++
+			break
+		}
+	}
+	h.f.lock.Unlock()
+}
+
+// 获取标签值对应的数据，调用者已加锁
+func (f *metricFamily) get(values []string) *metricSeries {
+	key := strings.Join(values, "\xff")
+	s, ok := f.series[key]
+	if !ok {
+		s = new(metricSeries)
+		s.values = append([]string(nil), values...)
+		s.counts = make([]uint64, len(f.buckets))
+		f.series[key] = s
+	}
+	return s
+}
+
+// 按Prometheus文本格式输出全部指标
+func (m *Metrics) Write(w io.Writer) error {
+	if m == nil {
+		return nil
+	}
+	m.lock.Lock()
+	families := make([]*metricFamily, 0, len(m.families))
+	for _, f := range m.families {
+		families = append(families, f)
+	}
+	m.lock.Unlock()
+	sort.Slice(families, func(i, j int) bool { return families[i].name < families[j].name })
+	b := bufio.NewWriter(w)
+	for _, f := range families {
+		f.write(b)
+	}
+	return b.Flush()
+}
+
+// 输出一组指标
+func (f *metricFamily) write(b *bufio.Writer) {
+	if f.typ == METRIC_GAUGE {
+		v, err := f.gauge()
+		if err != nil {
+			return
+		}
+		f.header(b)
+		b.WriteString(f.name + " " + formatMetric(v) + "\n")
+		return
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	keys := make([]string, 0, len(f.series))
+	for k := range f.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	f.header(b)
+	for _, k := range keys {
+		s := f.series[k]
+		labels := f.labelPairs(s.values)
+		if f.typ == METRIC_COUNTER {
+			b.WriteString(f.name + metricLabels(labels) + " " + formatMetric(s.value) + "\n")
+			continue
+		}
+		var cum uint64
+		for i, bound := range f.buckets {
+			cum += s.counts[i]
+			le := append(labels, "le", formatMetric(bound))
+			b.WriteString(f.name + "_bucket" + metricLabels(le) + " " + strconv.FormatUint(cum, 10) + "\n")
+		}
+		le := append(labels, "le", "+Inf")
+		b.WriteString(f.name + "_bucket" + metricLabels(le) + " " + strconv.FormatUint(s.count, 10) + "\n")
+		b.WriteString(f.name + "_sum" + metricLabels(labels) + " " + formatMetric(s.value) + "\n")
+		b.WriteString(f.name + "_count" + metricLabels(labels) + " " + strconv.FormatUint(s.count, 10) + "\n")
+	}
+}
+
+// 输出指标的说明和类型
+func (f *metricFamily) header(b *bufio.Writer) {
+	b.WriteString("# HELP " + f.name + " " + strings.NewReplacer("\\", `\\`, "\n", `\n`).Replace(f.help) + "\n")
+	b.WriteString("# TYPE " + f.name + " " + f.typ + "\n")
+}
+
+// 标签名称和值依次排列
+func (f *metricFamily) labelPairs(values []string) []string {
+	pairs := make([]string, 0, len(f.labels)*2+2)
+	for i, name := range f.labels {
+		v := ""
+		if i < len(values) {
+			v = values[i]
+		}
+		pairs = append(pairs, name, v)
+	}
+	return pairs
+}
+
+// 格式化标签，如{method="site_create",code="5"}
+func metricLabels(pairs []string) string {
+	if len(pairs) == 0 {
+		return ""
+	}
+	r := strings.NewReplacer("\\", `\\`, "\"", `\"`, "\n", `\n`)
+	parts := make([]string, 0, len(pairs)/2)
+	for i := 0; i+1 < len(pairs); i += 2 {
+		parts = append(parts, pairs[i]+"=\""+r.Replace(pairs[i+1])+"\"")
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+// 格式化指标值
+func formatMetric(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	if math.IsInf(v, -1) {
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
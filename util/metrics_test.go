@@ -0,0 +1,45 @@
+// Copyright (c) 2013 Beijing CmsTop Technology Co.,Ltd. (http://www.cmstop.com)
+
+package util
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestMetrics1(t *testing.T) {
+	m := NewMetrics()
+	m.Counter("nfss_requests_total", "Total requests.", "method").Inc("site_create")
+	m.Counter("nfss_requests_total", "Total requests.", "method").Add(2, "site_create")
+	h := m.Histogram("nfss_request_duration_seconds", "Latency.", []float64{0.1, 1}, "method")
+	h.Observe(0.05, "db_create")
+	h.Observe(0.5, "db_create")
+	m.GaugeFunc("nfss_sites", "Sites.", func() (float64, error) { return 7, nil })
+	m.GaugeFunc("nfss_databases", "Databases.", func() (float64, error) { return 0, errors.New("down") })
+	var b bytes.Buffer
+	m.Write(&b)
+	out := b.String()
+	for _, line := range []string{
+		"# TYPE nfss_requests_total counter",
+		`nfss_requests_total{method="site_create"} 3`,
+		`nfss_request_duration_seconds_bucket{method="db_create",le="0.1"} 1`,
+		`nfss_request_duration_seconds_bucket{method="db_create",le="1"} 2`,
+		`nfss_request_duration_seconds_bucket{method="db_create",le="+Inf"} 2`,
+		`nfss_request_duration_seconds_sum{method="db_create"} 0.55`,
+		`nfss_request_duration_seconds_count{method="db_create"} 2`,
+		"nfss_sites 7",
+	} {
+		if !strings.Contains(out, line+"\n") {
+			t.Error("metrics missing line: ", line)
+		}
+	}
+	if strings.Contains(out, "nfss_databases") {
+		t.Error("failed gauge should be omitted")
+	}
+
+	var nm *Metrics
+	nm.Counter("x", "x").Inc()
+	nm.Histogram("y", "y", nil).Observe(1)
+}
@@ -6,18 +6,35 @@ package util
 import (
 	"database/sql"
 	"errors"
-	_ "github.com/go-sql-driver/mysql"
+	"github.com/go-sql-driver/mysql"
 	"strings"
+	"time"
 )
 
 const (
-	DENI_DB_NAMES = "mysql,test,admin" // 禁止使用的数据库
+	DENI_DB_NAMES = "mysql,test,admin"                          // 禁止使用的数据库
+	SYS_DB_NAMES  = "information_schema,performance_schema,sys" // MySQL系统数据库
+)
+
+// MySQL错误号
+const (
+	MYSQL_ER_DB_CREATE_EXISTS  = 1007 // 数据库已经存在
+	MYSQL_ER_DB_DROP_EXISTS    = 1008 // 要删除的数据库不存在
+	MYSQL_ER_BAD_DB            = 1049 // 数据库不存在
+	MYSQL_ER_PASSWORD_NO_MATCH = 1133 // 帐号不存在
+	MYSQL_ER_CANNOT_USER       = 1396 // 帐号操作失败，如创建已存在的帐号、删除不存在的帐号
+)
+
+var (
+	ErrDbNameDeny     = errors.New("name is deny!")  // 禁止使用的数据库名称
+	ErrDbUserNotFound = errors.New("user not found") // 数据库帐号不存在
 )
 
 // 数据库连接结构
 type DbMySQL struct {
-	Psn  string
-	Conn *sql.DB
+	Psn     string
+	Conn    *sql.DB
+	Observe func(op string, d time.Duration) // 每次调用结束时回调，用于记录调用耗时，可以为nil
 }
 
 // 创建数据库实例
@@ -43,6 +60,13 @@ func (s *DbMySQL) connect() (*sql.DB, error) {
 	return conn, nil
 }
 
+// 记录一次调用的耗时
+func (s *DbMySQL) observe(op string, start time.Time) {
+	if s.Observe != nil {
+		s.Observe(op, time.Since(start))
+	}
+}
+
 func (s *DbMySQL) ping() error {
 	err := s.Conn.Ping()
 	if err != nil {
@@ -58,6 +82,7 @@ func (s *DbMySQL) ping() error {
 
 // 获取数据库版本
 func (s *DbMySQL) Version() (string, error) {
+	defer s.observe("version", time.Now())
 	err := s.ping()
 	if err != nil {
 		return "", err
@@ -77,6 +102,7 @@ func (s *DbMySQL) Version() (string, error) {
 // 执行一条SQL语句
 // 如果出错返回err,正常返回nil
 func (s *DbMySQL) Exec(sql string) error {
+	defer s.observe("exec", time.Now())
 	var err error
 	err = s.ping()
 	if err != nil {
@@ -91,6 +117,7 @@ func (s *DbMySQL) Exec(sql string) error {
 
 // 刷新数据库权限
 func (s *DbMySQL) Flush() error {
+	defer s.observe("flush", time.Now())
 	var err error
 	err = s.ping()
 	if err != nil {
@@ -116,15 +143,16 @@ func (s *DbMySQL) checkDbName(name string) bool {
 	return true
 }
 
-// 创建数据库
+// 创建数据库，数据库已经存在时不报错
 func (s *DbMySQL) CreateDb(name string) error {
+	defer s.observe("create_db", time.Now())
 	var err error
 	err = s.ping()
 	if err != nil {
 		return err
 	}
 	if ok := s.checkDbName(name); !ok {
-		return errors.New("name is deny!")
+		return ErrDbNameDeny
 	}
 	_, err = s.Conn.Exec("CREATE DATABASE IF NOT EXISTS " + name + " default charset utf8 COLLATE utf8_general_ci")
 	if err != nil {
@@ -135,13 +163,14 @@ func (s *DbMySQL) CreateDb(name string) error {
 
 // 创建用户并设置权限
 func (s *DbMySQL) CreateUser(name, user, host, pass string) error {
+	defer s.observe("create_user", time.Now())
 	var err error
 	err = s.ping()
 	if err != nil {
 		return err
 	}
 	if ok := s.checkDbName(name); !ok {
-		return errors.New("name is deny!")
+		return ErrDbNameDeny
 	}
 	_, err = s.Conn.Exec("GRANT ALL ON " + name + ".* TO '" + user + "'@'" + host + "' IDENTIFIED BY '" + pass + "'")
 	if err != nil {
@@ -150,29 +179,43 @@ func (s *DbMySQL) CreateUser(name, user, host, pass string) error {
 	return nil
 }
 
-// 修改用户密码
+// 修改用户密码，帐号不存在时返回ErrDbUserNotFound
 func (s *DbMySQL) Password(user, pass string) error {
+	defer s.observe("password", time.Now())
 	var err error
 	err = s.ping()
 	if err != nil {
 		return err
 	}
-	_, err = s.Conn.Exec("UPDATE mysql.user SET `password`=PASSWORD('" + pass + "') WHERE user='" + user + "'")
+	res, err := s.Conn.Exec("UPDATE mysql.user SET `password`=PASSWORD('" + pass + "') WHERE user='" + user + "'")
 	if err != nil {
 		return err
 	}
+	n, err := res.RowsAffected()
+	if err != nil || n > 0 {
+		return err
+	}
+	// 没有修改的行：帐号不存在，或新密码与原密码相同
+	ok, err := s.UserExists(user)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrDbUserNotFound
+	}
 	return nil
 }
 
 // 删除数据库
 func (s *DbMySQL) DeleteDb(name string) error {
+	defer s.observe("delete_db", time.Now())
 	var err error
 	err = s.ping()
 	if err != nil {
 		return err
 	}
 	if ok := s.checkDbName(name); !ok {
-		return errors.New("name is deny!")
+		return ErrDbNameDeny
 	}
 	_, err = s.Conn.Exec("DROP DATABASE IF EXISTS " + name)
 	if err != nil {
@@ -183,13 +226,14 @@ func (s *DbMySQL) DeleteDb(name string) error {
 
 // 删除用户
 func (s *DbMySQL) DeleteUser(name string) error {
+	defer s.observe("delete_user", time.Now())
 	var err error
 	err = s.ping()
 	if err != nil {
 		return err
 	}
 	if ok := s.checkDbName(name); !ok {
-		return errors.New("name is deny!")
+		return ErrDbNameDeny
 	}
 	_, err = s.Conn.Exec("DELETE FROM mysql.user WHERE user='" + name + "'")
 	if err != nil {
@@ -198,8 +242,41 @@ func (s *DbMySQL) DeleteUser(name string) error {
 	return nil
 }
 
+// 判断数据库是否存在
+func (s *DbMySQL) DbExists(name string) (bool, error) {
+	defer s.observe("db_exists", time.Now())
+	var n int
+	err := s.ping()
+	if err != nil {
+		return false, err
+	}
+	row := s.Conn.QueryRow("SELECT COUNT(*) FROM information_schema.SCHEMATA WHERE SCHEMA_NAME=?", name)
+	err = row.Scan(&n)
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// 判断用户是否存在
+func (s *DbMySQL) UserExists(user string) (bool, error) {
+	defer s.observe("user_exists", time.Now())
+	var n int
+	err := s.ping()
+	if err != nil {
+		return false, err
+	}
+	row := s.Conn.QueryRow("SELECT COUNT(*) FROM mysql.user WHERE user=?", user)
+	err = row.Scan(&n)
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
 // 获取数据库大小
 func (s *DbMySQL) GetDbSize(name string) (int64, error) {
+	defer s.observe("db_size", time.Now())
 	var size int64
 	var err error
 	err = s.ping()
@@ -207,7 +284,7 @@ func (s *DbMySQL) GetDbSize(name string) (int64, error) {
 		return size, err
 	}
 	if ok := s.checkDbName(name); !ok {
-		return size, errors.New("name is deny!")
+		return size, ErrDbNameDeny
 	}
 	row := s.Conn.QueryRow("SELECT SUM(DATA_LENGTH) + SUM(INDEX_LENGTH) FROM information_schema.TABLES WHERE table_schema='" + name + "'")
 	err = row.Scan(&size)
@@ -219,3 +296,72 @@ func (s *DbMySQL) GetDbSize(name string) (int64, error) {
 	}
 	return size, nil
 }
+
+// 获取当前帐号的授权语句
+func (s *DbMySQL) Grants() ([]string, error) {
+	defer s.observe("grants", time.Now())
+	err := s.ping()
+	if err != nil {
+		return nil, err
+	}
+	rows, err := s.Conn.Query("SHOW GRANTS FOR CURRENT_USER()")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	grants := make([]string, 0)
+	for rows.Next() {
+		var g string
+		err = rows.Scan(&g)
+		if err != nil {
+			return nil, err
+		}
+		grants = append(grants, g)
+	}
+	return grants, rows.Err()
+}
+
+// 统计管理的数据库数量，不包括系统数据库和禁止使用的数据库
+func (s *DbMySQL) CountDbs() (int, error) {
+	defer s.observe("count_dbs", time.Now())
+	err := s.ping()
+	if err != nil {
+		return 0, err
+	}
+	rows, err := s.Conn.Query("SELECT SCHEMA_NAME FROM information_schema.SCHEMATA")
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	sys := strings.Split(SYS_DB_NAMES, ",")
+	n := 0
+	for rows.Next() {
+		var name string
+		err = rows.Scan(&name)
+		if err != nil {
+			return 0, err
+		}
+		if s.checkDbName(name) && !inStrings(sys, strings.ToLower(name)) {
+			n++
+		}
+	}
+	return n, rows.Err()
+}
+
+// MySQL返回的错误号，不是MySQL服务器返回的错误（如连接失败）时为0
+func MySQLErrorNumber(err error) int {
+	if me, ok := err.(*mysql.MySQLError); ok {
+		return int(me.Number)
+	}
+	return 0
+}
+
+// 判断字符串是否在列表中
+func inStrings(list []string, v string) bool {
+	for _, s := range list {
+		if s == v {
+			return true
+		}
+	}
+	return false
+}
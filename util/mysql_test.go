@@ -39,3 +39,24 @@ func TestGetDbSize1(t *testing.T) {
 	}
 	fmt.Printf("Db Size %s \n", FormatSize(size))
 }
+
+// 连接测试用的MySQL，连接失败时跳过测试
+func testDb(t *testing.T) *DbMySQL {
+	db, err := NewDb("root:123456@tcp(127.0.0.1:3306)/?charset=utf8")
+	if err == nil {
+		err = db.Conn.Ping()
+	}
+	if err != nil {
+		t.Skip("MySQL is unreachable: ", err.Error())
+	}
+	return db
+}
+
+func TestGrants1(t *testing.T) {
+	db := testDb(t)
+	grants, err := db.Grants()
+	if err != nil {
+		t.Error(err)
+	}
+	fmt.Printf("Grants %v \n", grants)
+}
@@ -0,0 +1,216 @@
+// Copyright (c) 2013 Beijing CmsTop Technology Co.,Ltd. (http://www.cmstop.com)
+
+// Provides replay protection
+/*
+请求重放检测
+每个请求携带签发时间和唯一的nonce，签发时间超出允许的时间窗口即拒绝，
+时间窗口内的nonce记录在有限大小的缓存中，重复出现即为重放。
+缓存满时只淘汰已过期的nonce，仍然全部在时间窗口内时拒绝新的请求（ErrReplayFull），
+避免大量请求挤出未过期的nonce后重放截获的请求。
+缓存以追加方式写入文件，重启后重新加载，文件过大时自动压缩。
+平滑重启时新进程先只在内存中检测，父进程关闭文件后通过Attach加载文件并合并。
+*/
+
+package util
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	NONCE_MAX_LENGTH = 64 // nonce最大长度
+)
+
+var (
+	ErrReplay       = errors.New("order replayed")              // 请求重放
+	ErrOrderExpired = errors.New("order time out of window")    // 请求签发时间超出时间窗口
+	ErrNonceIllegal = errors.New("order nonce is empty or bad") // nonce为空或格式错误
+	ErrReplayFull   = errors.New("replay cache is full")        // 缓存中的nonce都未过期，稍后重试
+)
+
+// 重放检测缓存
+type ReplayCache struct {
+	window int64            // 允许的时间窗口，单位秒
+	size   int              // 缓存最大条数
+	file   string           // 持久化文件
+	lock   sync.Mutex       // 缓存锁
+	seen   map[string]int64 // 已处理的nonce及其签发时间
+	queue  []string         // 按加入顺序排列的nonce，用于淘汰
+	fh     *os.File         // 持久化文件句柄
+	lines  int              // 持久化文件行数
+}
+
+// 创建重放检测缓存，file为空时不持久化
+func NewReplayCache(file string, window time.Duration, size int) (*ReplayCache, error) {
+	if size <= 0 {
+		return nil, errors.New("replay cache size should greater than 0")
+	}
+	c := new(ReplayCache)
+	c.window = int64(window / time.Second)
+	c.size = size
+	c.file = file
+	c.seen = make(map[string]int64)
+	c.queue = make([]string, 0, size)
+	if file == "" {
+		return c, nil
+	}
+	err := c.Attach(file)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// 开始持久化到文件，加载文件中未过期的nonce与缓存合并后重写文件
+func (c *ReplayCache) Attach(file string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.fh != nil {
+		return errors.New("replay cache file is already attached")
+	}
+	c.file = file
+	err := c.load()
+	if err != nil {
+		return err
+	}
+	return c.compact()
+}
+
+// 检测请求，通过检测的nonce加入缓存
+func (c *ReplayCache) Check(nonce string, issued int64) error {
+	if nonce == "" || len(nonce) > NONCE_MAX_LENGTH || strings.ContainsAny(nonce, " \t\r\n") {
+		return ErrNonceIllegal
+	}
+	now := time.Now().Unix()
+	if issued < now-c.window || issued > now+c.window {
+		return ErrOrderExpired
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if _, ok := c.seen[nonce]; ok {
+		return ErrReplay
+	}
+	if !c.add(nonce, issued) {
+		return ErrReplayFull
+	}
+	if c.fh == nil {
+		return nil
+	}
+	_, err := fmt.Fprintf(c.fh, "%s %d\n", nonce, issued)
+	if err != nil {
+		return errors.New("replay cache write Error: " + err.Error())
+	}
+	c.lines++
+	if c.lines > c.size*2 {
+		return c.compact()
+	}
+	return nil
+}
+
+// 关闭缓存文件
+func (c *ReplayCache) Close() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.fh == nil {
+		return nil
+	}
+	err := c.fh.Close()
+	c.fh = nil
+	return err
+}
+
+// 加入缓存，缓存满时淘汰已过期的nonce，没有可以淘汰的nonce时返回false
+func (c *ReplayCache) add(nonce string, issued int64) bool {
+	if len(c.queue) >= c.size {
+		c.expire()
+	}
+	if len(c.queue) >= c.size {
+		return false
+	}
+	c.seen[nonce] = issued
+	c.queue = append(c.queue, nonce)
+	return true
+}
+
+// 淘汰超出时间窗口的nonce
+func (c *ReplayCache) expire() {
+	expire := time.Now().Unix() - c.window
+	queue := make([]string, 0, c.size)
+	for _, nonce := range c.queue {
+		if c.seen[nonce] < expire {
+			delete(c.seen, nonce)
+			continue
+		}
+		queue = append(queue, nonce)
+	}
+	c.queue = queue
+}
+
+// 从文件加载未过期的nonce
+func (c *ReplayCache) load() error {
+	f, err := os.Open(c.file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+	expire := time.Now().Unix() - c.window
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		issued, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil || issued < expire {
+			continue
+		}
+		if _, ok := c.seen[fields[0]]; !ok {
+			c.add(fields[0], issued)
+		}
+	}
+	return scanner.Err()
+}
+
+// 将缓存中未过期的nonce重写到文件
+func (c *ReplayCache) compact() error {
+	if c.fh != nil {
+		c.fh.Close()
+		c.fh = nil
+	}
+	expire := time.Now().Unix() - c.window
+	tmpFile := c.file + ".tmp"
+	f, err := os.OpenFile(tmpFile, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	c.lines = 0
+	for _, nonce := range c.queue {
+		if c.seen[nonce] < expire {
+			continue
+		}
+		fmt.Fprintf(w, "%s %d\n", nonce, c.seen[nonce])
+		c.lines++
+	}
+	err = w.Flush()
+	f.Close()
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmpFile, c.file)
+	if err != nil {
+		return err
+	}
+	c.fh, err = os.OpenFile(c.file, os.O_WRONLY|os.O_APPEND, 0600)
+	return err
+}
@@ -0,0 +1,67 @@
+// Copyright (c) 2013 Beijing CmsTop Technology Co.,Ltd. (http://www.cmstop.com)
+
+package util
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestReplayCache1(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sfss")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "replay.dat")
+	c, err := NewReplayCache(file, 5*time.Minute, 10)
+	if err != nil {
+		t.Fatal("NewReplayCache failed: ", err.Error())
+	}
+	now := time.Now().Unix()
+	if err = c.Check("abc", now); err != nil {
+		t.Error("first order should pass: ", err.Error())
+	}
+	if err = c.Check("abc", now); err != ErrReplay {
+		t.Error("replayed order should be rejected")
+	}
+	if err = c.Check("def", now-3600); err != ErrOrderExpired {
+		t.Error("expired order should be rejected")
+	}
+	c.Close()
+
+	// 重启后仍然能检测到重放
+	c, err = NewReplayCache(file, 5*time.Minute, 10)
+	if err != nil {
+		t.Fatal("NewReplayCache reload failed: ", err.Error())
+	}
+	defer c.Close()
+	if err = c.Check("abc", now); err != ErrReplay {
+		t.Error("replayed order should be rejected after reload")
+	}
+}
+
+func TestReplayFull1(t *testing.T) {
+	c, err := NewReplayCache("", 5*time.Minute, 2)
+	if err != nil {
+		t.Fatal("NewReplayCache failed: ", err.Error())
+	}
+	now := time.Now().Unix()
+	c.Check("a", now)
+	c.Check("b", now)
+	// 未过期的nonce不能被挤出
+	if err = c.Check("c", now); err != ErrReplayFull {
+		t.Error("full cache should reject new order: ", err)
+	}
+	if err = c.Check("a", now); err != ErrReplay {
+		t.Error("live nonce should not be evicted: ", err)
+	}
+	// 过期的nonce可以淘汰
+	c.seen["a"] = now - 3600
+	if err = c.Check("c", now); err != nil {
+		t.Error("expired nonce should be evicted: ", err)
+	}
+}
@@ -9,11 +9,13 @@ import (
 	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
+	crand "crypto/rand"
 	"encoding/base64"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"math/rand"
 	"net"
 	"os"
@@ -28,35 +30,56 @@ const (
 	RAND_MAX_LENGTH = 64                                                               // 随机字符串最大长度
 )
 
+// 数据包超过MAX_PACKET_SIZE
+var ErrPacketTooLarge = errors.New("too large packet! packet size should less than 1M")
+
 // 协议封装读取
 func TCPConnRead(conn *net.TCPConn) ([]byte, error) {
-	conn.SetReadDeadline(time.Now().Add(time.Second * 30))
-	result := bytes.NewBuffer(nil)
+	return ConnRead(conn, time.Second*30)
+}
+
+// 协议封装读取，读取一个4字节小端长度前缀加数据的数据包
+// timeout为等待数据包的最长时间，为0时不限制
+func ConnRead(conn net.Conn, timeout time.Duration) ([]byte, error) {
+	if timeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(timeout))
+	} else {
+		conn.SetReadDeadline(time.Time{})
+	}
 	data := make([]byte, 4)
-	num, err := conn.Read(data)
+	num, err := io.ReadFull(conn, data)
 	if err != nil || num != 4 {
 		if err == nil {
 			err = errors.New("length read error")
 		}
 		return nil, err
 	}
-	result.Write(data[0:num])
 	var length int32
-	err = binary.Read(result, binary.LittleEndian, &length)
+	err = binary.Read(bytes.NewBuffer(data), binary.LittleEndian, &length)
 	if err != nil {
 		return nil, err
 	}
-	if length > MAX_PACKET_SIZE {
-		return nil, errors.New("too large packet! packet size should less than 1M")
+	if length < 0 || length > MAX_PACKET_SIZE {
+		return nil, ErrPacketTooLarge
 	}
 	data = make([]byte, length)
-	result = bytes.NewBuffer(nil)
-	num, err = io.ReadFull(conn, data)
+	_, err = io.ReadFull(conn, data)
 	if err != nil {
 		return nil, err
 	}
-	result.Write(data[0:num])
-	return result.Bytes(), nil
+	return data, nil
+}
+
+// 协议封装写入，与ConnRead格式相同：4字节小端长度前缀加数据
+func ConnWrite(conn net.Conn, data []byte) error {
+	if len(data) > MAX_PACKET_SIZE {
+		return ErrPacketTooLarge
+	}
+	result := bytes.NewBuffer(nil)
+	binary.Write(result, binary.LittleEndian, int32(len(data)))
+	result.Write(data)
+	_, err := conn.Write(result.Bytes())
+	return err
 }
 
 // aes加密
@@ -66,6 +89,9 @@ func AesEncrypt(data, iv, key []byte) ([]byte, error) {
 		return nil, err
 	}
 	blockSize := block.BlockSize()
+	if len(iv) != blockSize {
+		return nil, errors.New("AES iv length Illegal")
+	}
 	data = PKCS5Padding(data, blockSize)
 	blockMode := cipher.NewCBCEncrypter(block, iv)
 	cryptData := make([]byte, len(data))
@@ -87,8 +113,14 @@ func AesDecrypt(data, iv, key []byte) ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
-	blockMode := cipher.NewCBCDecrypter(block, iv)
 	blockSize := block.BlockSize()
+	if len(iv) != blockSize {
+		return nil, errors.New("AES iv length Illegal")
+	}
+	if len(data) == 0 || len(data)%blockSize != 0 {
+		return nil, errors.New("AES decrypt data length Illegal")
+	}
+	blockMode := cipher.NewCBCDecrypter(block, iv)
 	origData := make([]byte, len(data))
 	blockMode.CryptBlocks(origData, data)
 	origData, err = PKCS5UnPadding(origData, blockSize)
@@ -98,6 +130,54 @@ func AesDecrypt(data, iv, key []byte) ([]byte, error) {
 	return origData, nil
 }
 
+// aes-gcm加密，每次加密使用随机nonce
+// 返回base64编码的密文和nonce
+func GcmEncrypt(data, key []byte) ([]byte, []byte, error) {
+	aead, err := newGcm(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	_, err = io.ReadFull(crand.Reader, nonce)
+	if err != nil {
+		return nil, nil, err
+	}
+	cryptData := aead.Seal(nil, nonce, data, nil)
+	baseData := make([]byte, base64.StdEncoding.EncodedLen(len(cryptData)))
+	base64.StdEncoding.Encode(baseData, cryptData)
+	baseNonce := make([]byte, base64.StdEncoding.EncodedLen(len(nonce)))
+	base64.StdEncoding.Encode(baseNonce, nonce)
+	return baseData, baseNonce, nil
+}
+
+// aes-gcm解密并校验数据完整性，data和nonce为base64编码
+func GcmDecrypt(data, nonce, key []byte) ([]byte, error) {
+	aead, err := newGcm(key)
+	if err != nil {
+		return nil, err
+	}
+	cryptData, err := base64.StdEncoding.DecodeString(string(data))
+	if err != nil {
+		return nil, err
+	}
+	nonceData, err := base64.StdEncoding.DecodeString(string(nonce))
+	if err != nil {
+		return nil, err
+	}
+	if len(nonceData) != aead.NonceSize() {
+		return nil, errors.New("AES-GCM nonce length Illegal")
+	}
+	return aead.Open(nil, nonceData, cryptData, nil)
+}
+
+func newGcm(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
 // aes加密补码
 func PKCS5Padding(data []byte, blockSize int) []byte {
 	padding := blockSize - len(data)%blockSize
@@ -108,8 +188,11 @@ func PKCS5Padding(data []byte, blockSize int) []byte {
 // aes解密去码
 func PKCS5UnPadding(data []byte, blockSize int) ([]byte, error) {
 	length := len(data)
+	if length == 0 || length%blockSize != 0 {
+		return nil, errors.New("AES PCKS5UnPadding penic, data length Illegal")
+	}
 	unpadding := int(data[length-1])
-	if unpadding >= blockSize {
+	if unpadding == 0 || unpadding > blockSize {
 		return nil, errors.New("AES PCKS5UnPadding penic, unpadding Illegal")
 	}
 	return data[:(length - unpadding)], nil
@@ -124,6 +207,18 @@ func GetDir() (string, error) {
 	return filepath.Dir(path), nil
 }
 
+// 获取文件的绝对路径，相对路径以程序运行的目录为基准
+func GetPath(file string) (string, error) {
+	if file == "" || file[0] == '/' {
+		return file, nil
+	}
+	dir, err := GetDir()
+	if err != nil {
+		return "", errors.New("GetDir Error: " + err.Error())
+	}
+	return dir + "/" + file, nil
+}
+
 // 判断一个文件或目录是否存在
 func IsExist(path string) (bool, error) {
 	_, err := os.Stat(path)
@@ -150,6 +245,37 @@ func IsWritable(path string) (bool, error) {
 	return false, err
 }
 
+// 原子写入文件，先写入同目录的临时文件再重命名，写入失败时原文件不变
+// 临时文件以.开头、以.tmp结尾，不会被Nginx的 include *.conf 加载
+func WriteFileAtomic(file string, data []byte, perm os.FileMode) error {
+	dir, base := filepath.Split(file)
+	if dir == "" {
+		dir = "."
+	}
+	fh, err := ioutil.TempFile(dir, "."+base+".*.tmp")
+	if err != nil {
+		return err
+	}
+	tmp := fh.Name()
+	_, err = fh.Write(data)
+	if err == nil {
+		err = fh.Sync()
+	}
+	if cerr := fh.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(tmp, perm)
+	}
+	if err == nil {
+		err = os.Rename(tmp, file)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
 // 生成一个随机字符串
 func RandString(n int) string {
 	if n > RAND_MAX_LENGTH {
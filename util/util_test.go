@@ -4,7 +4,12 @@ package util
 
 import (
 	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 )
 
 var iv = []byte("1234567890123456")
@@ -23,6 +28,74 @@ func TestEncrypt1(t *testing.T) {
 	if string(decryptText) != string(plainText) {
 		t.Error("data check error!")
 	}
+	if _, err = AesDecrypt(cryptText, iv[:8], key); err == nil {
+		t.Error("short iv should be rejected")
+	}
+}
+
+func TestGcmEncrypt1(t *testing.T) {
+	plainText := []byte("i am coldstar")
+	cryptText, nonce, err := GcmEncrypt(plainText, key)
+	if err != nil {
+		t.Error("encrypt failed: ", err.Error())
+	}
+	cryptText2, nonce2, _ := GcmEncrypt(plainText, key)
+	if string(cryptText) == string(cryptText2) || string(nonce) == string(nonce2) {
+		t.Error("nonce should be random!")
+	}
+	decryptText, err := GcmDecrypt(cryptText, nonce, key)
+	if err != nil {
+		t.Error("decrypt failed: ", err.Error())
+	}
+	if string(decryptText) != string(plainText) {
+		t.Error("data check error!")
+	}
+	cryptText[0] ^= 1
+	if _, err = GcmDecrypt(cryptText, nonce, key); err == nil {
+		t.Error("tampered data should not decrypt!")
+	}
+}
+
+func TestConnReadWrite1(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	go ConnWrite(client, []byte("i am coldstar"))
+	data, err := ConnRead(server, time.Second)
+	if err != nil {
+		t.Error("ConnRead failed: ", err.Error())
+	}
+	if string(data) != "i am coldstar" {
+		t.Error("data check error!")
+	}
+}
+
+func TestWriteFileAtomic1(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sfss-util")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "a.com.conf")
+	ioutil.WriteFile(file, []byte("old config"), 0600)
+	err = WriteFileAtomic(file, []byte("new"), 0644)
+	if err != nil {
+		t.Fatal("WriteFileAtomic failed: ", err.Error())
+	}
+	data, _ := ioutil.ReadFile(file)
+	if string(data) != "new" {
+		t.Error("file content mismatch: ", string(data))
+	}
+	if fi, _ := os.Stat(file); fi.Mode().Perm() != 0644 {
+		t.Error("file mode mismatch: ", fi.Mode())
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 1 {
+		t.Error("temp file should be removed")
+	}
+	err = WriteFileAtomic(filepath.Join(dir, "none", "b.conf"), []byte("new"), 0644)
+	if err == nil {
+		t.Error("write to missing dir should fail")
+	}
 }
 
 func TestRandString1(t *testing.T) {